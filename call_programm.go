@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"signal/media"
 	"signal/sip"
 
 	"github.com/google/uuid"
@@ -11,6 +12,7 @@ import (
 type CallProgrammConfig struct {
 	Target   *sip.Destination `json:"target"`
 	Greeting string           `json:"greeting"`
+	Ringback bool             `json:"ringback"`
 }
 
 type CallProgramm struct {
@@ -25,9 +27,11 @@ func (cp *CallProgramm) isGreeting() bool {
 
 func (cp *CallProgramm) init(ctx context.Context, m *Meeting, uas *UAS) error {
 	m.scenario.onUASEvent(UAS_READY, cp.onUASReady)
+	m.scenario.onUASEvent(UAS_CANCEL, cp.onUASCancel)
 	m.scenario.onUASEvent(UAS_END, cp.onUASEnd)
 
 	m.scenario.onUACEvent(UAC_RINGING, cp.onUACRinging)
+	m.scenario.onUACEvent(UAC_PROGRESS, cp.onUACProgress)
 	m.scenario.onUACEvent(UAC_READY, cp.onUACReady)
 	m.scenario.onUACEvent(UAC_END, cp.onUACEnd)
 
@@ -55,7 +59,13 @@ func (cp *CallProgramm) init(ctx context.Context, m *Meeting, uas *UAS) error {
 			Str("where", "CallProgramm.init").
 			Msg("While init")
 		return err
+	} else if mc, err := media.NewMediaChanal(m.id, uac.callID, uas.server.clock); err != nil {
+		log.Error().Err(err).Str("Call-ID", uas.callID).
+			Str("where", "CallProgramm.init").
+			Msg("While init")
+		return err
 	} else {
+		uac.mediaChanal = mc
 		cp.uac = uac
 		uas.meeting.appendUAC(uac)
 		uas.server.userAgentPool[uac.callID] = uac
@@ -63,7 +73,8 @@ func (cp *CallProgramm) init(ctx context.Context, m *Meeting, uas *UAS) error {
 			return cp.uas.accept()
 		} else {
 			from, _ := invite.GetHeaders().GetFrom()
-			return uac.call(from)
+			maxForwards, _ := invite.GetHeaders().GetMaxForwards()
+			return uac.call(from, maxForwards.Value)
 		}
 	}
 }
@@ -73,16 +84,98 @@ func (cp *CallProgramm) onUASReady(ctx context.Context, uas *UAS) {
 		cp.uas.mediaChanal.Play()
 		cp.uac.mediaChanal.Beeps()
 	} else {
+		cp.uas.mediaChanal.Stop()
 		cp.uas.meeting.mediaMixer.Join(cp.uas.mediaChanal)
 		cp.uac.meeting.mediaMixer.Join(cp.uac.mediaChanal)
 		cp.uac.accept()
 	}
 }
 
-func (cp *CallProgramm) onUASEnd(ctx context.Context, uas *UAS) {}
+func (cp *CallProgramm) onUASCancel(ctx context.Context, uas *UAS) {
+	if cp.uac != nil {
+		cp.uac.cancel()
+	}
+}
+
+func (cp *CallProgramm) onUASEnd(ctx context.Context, uas *UAS) {
+	uas.mediaChanal.End()
+	if cp.isGreeting() {
+		cp.uac.mediaChanal.End()
+	}
+}
+
+// onUACRinging relays alerting of the callee, its early media is bridged
+// to the caller, ringback is played here when it has none and the
+// programm asks for it
+func (cp *CallProgramm) onUACRinging(ctx context.Context, uac *UAC) {
+	if cp.earlyFork(uac) != nil {
+		cp.bridgeEarlyMedia(sip.Ringing)
+	} else if cp.config.Ringback {
+		cp.uas.earlyMedia(sip.Ringing)
+		cp.uas.mediaChanal.Ringback()
+	} else {
+		cp.uas.ringing()
+	}
+}
+
+// onUACProgress relays 183 of the callee with its early media
+func (cp *CallProgramm) onUACProgress(ctx context.Context, uac *UAC) {
+	if cp.earlyFork(uac) != nil {
+		cp.bridgeEarlyMedia(sip.SessionProgress)
+	}
+}
+
+// earlyFork is the early dialog of the callee which media is bridged, the
+// caller hears a single fork while the others keep ringing (RFC 3960 3.2)
+func (cp *CallProgramm) earlyFork(uac *UAC) *sip.Dialog {
+	early := uac.earlyDialogs()
+	for _, d := range early {
+		if d.RemoteTag == uac.earlyTag {
+			log.Info().Str("Call-ID", uac.callID).
+				Str("where", "CallProgramm.earlyFork").
+				Str("tag", d.RemoteTag).
+				Int("early_dialogs", len(early)).
+				Msg("Early media of the fork is bridged")
+			return d
+		}
+	}
+	return nil
+}
 
-func (cp *CallProgramm) onUACRinging(ctx context.Context, uac *UAC) {}
+// bridgeEarlyMedia answers the caller by provisional response c and
+// joins both legs to the mixer, local ringback stops
+func (cp *CallProgramm) bridgeEarlyMedia(c sip.ResponseCode) {
+	cp.uas.mediaChanal.Stop()
+	if err := cp.uas.earlyMedia(c); err != nil {
+		log.Error().Err(err).Str("Call-ID", cp.uas.callID).
+			Str("where", "CallProgramm.bridgeEarlyMedia").
+			Msg("While relay early media")
+		return
+	}
+	cp.uas.meeting.mediaMixer.Join(cp.uas.mediaChanal)
+	cp.uac.meeting.mediaMixer.Join(cp.uac.mediaChanal)
+}
 
-func (cp *CallProgramm) onUACReady(ctx context.Context, uac *UAC) {}
+// onUACReady answers the caller, ACK of the callee is sent once the
+// caller acknowledges in onUASReady
+func (cp *CallProgramm) onUACReady(ctx context.Context, uac *UAC) {
+	if !cp.isGreeting() {
+		cp.uas.mediaChanal.Stop()
+		cp.uas.accept()
+	}
+}
 
-func (cp *CallProgramm) onUACEnd(ctx context.Context, uac *UAC) {}
+// onUACEnd relays failure of the callee to the caller not answered yet
+func (cp *CallProgramm) onUACEnd(ctx context.Context, uac *UAC) {
+	uac.mediaChanal.End()
+	cp.uas.mediaChanal.Stop()
+	if cp.uas.answered {
+		return
+	} else if err := cp.uas.reject(uac.failure()); err != nil {
+		log.Error().Err(err).Str("Call-ID", cp.uas.callID).
+			Str("where", "CallProgramm.onUACEnd").
+			Msg("While relay failure")
+	} else {
+		cp.uas.meeting.scenario.uasEmit(UAS_END, ctx, cp.uas)
+	}
+}
@@ -0,0 +1,67 @@
+package clock
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is source of time for timers of SIP and media, tests inject
+// Fake to advance time without sleeping
+type Clock interface {
+	Now() time.Time
+	AfterFunc(time.Duration, func()) Timer
+	NewTicker(time.Duration) Ticker
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{
+		ticker: time.NewTicker(d),
+	}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (rt *realTicker) C() <-chan time.Time {
+	return rt.ticker.C
+}
+
+func (rt *realTicker) Stop() {
+	rt.ticker.Stop()
+}
+
+// REAL clock of the system
+var REAL Clock = realClock{}
+
+// WithTimeout cancels context after d of the clock
+func WithTimeout(parent context.Context, c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := c.(realClock); ok {
+		return context.WithTimeout(parent, d)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	timer := c.AfterFunc(d, cancel)
+	return ctx, func() {
+		timer.Stop()
+		cancel()
+	}
+}
@@ -0,0 +1,151 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake clock moves only by Advance, due timers run in the goroutine
+// calling Advance in order of their time
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    int
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *Fake
+	when  time.Time
+	seq   int
+	f     func()
+}
+
+func (ft *fakeTimer) Stop() bool {
+	ft.clock.mu.Lock()
+	defer ft.clock.mu.Unlock()
+	return ft.clock.remove(ft)
+}
+
+type fakeTicker struct {
+	clock   *Fake
+	period  time.Duration
+	c       chan time.Time
+	timer   *fakeTimer
+	stopped bool
+}
+
+func (ft *fakeTicker) C() <-chan time.Time {
+	return ft.c
+}
+
+func (ft *fakeTicker) Stop() {
+	ft.clock.mu.Lock()
+	defer ft.clock.mu.Unlock()
+	ft.stopped = true
+	ft.clock.remove(ft.timer)
+}
+
+// tick drops the time when previous is not read, as time.Ticker does
+func (ft *fakeTicker) tick() {
+	ft.clock.mu.Lock()
+	if ft.stopped {
+		ft.clock.mu.Unlock()
+		return
+	}
+	now := ft.clock.now
+	ft.timer = ft.clock.add(ft.period, ft.tick)
+	ft.clock.mu.Unlock()
+
+	select {
+	case ft.c <- now:
+	default:
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.add(d, fn)
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ft := &fakeTicker{
+		clock:  f,
+		period: d,
+		c:      make(chan time.Time, 1),
+	}
+	ft.timer = f.add(d, ft.tick)
+	return ft
+}
+
+// Advance moves the clock by d running timers due meanwhile, timers
+// started by them run too when they are due
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	until := f.now.Add(d)
+	for len(f.timers) > 0 && !f.timers[0].when.After(until) {
+		ft := f.timers[0]
+		f.timers = f.timers[1:]
+		f.now = ft.when
+		f.mu.Unlock()
+		ft.f()
+		f.mu.Lock()
+	}
+	f.now = until
+	f.mu.Unlock()
+}
+
+// Pending returns count of timers and tickers not fired yet
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+func (f *Fake) add(d time.Duration, fn func()) *fakeTimer {
+	f.seq++
+	ft := &fakeTimer{
+		clock: f,
+		when:  f.now.Add(d),
+		seq:   f.seq,
+		f:     fn,
+	}
+	f.timers = append(f.timers, ft)
+	sort.Slice(f.timers, func(i, j int) bool {
+		if f.timers[i].when.Equal(f.timers[j].when) {
+			return f.timers[i].seq < f.timers[j].seq
+		}
+		return f.timers[i].when.Before(f.timers[j].when)
+	})
+	return ft
+}
+
+func (f *Fake) remove(ft *fakeTimer) bool {
+	for i, t := range f.timers {
+		if t == ft {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now:    now,
+		timers: make([]*fakeTimer, 0),
+	}
+}
@@ -0,0 +1,91 @@
+package clock_test
+
+import (
+	"context"
+	"reflect"
+	"signal/clock"
+	"testing"
+	"time"
+)
+
+var START = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeAfterFunc(t *testing.T) {
+	c := clock.NewFake(START)
+	fired := make([]string, 0)
+
+	c.AfterFunc(2*time.Second, func() {
+		fired = append(fired, "b")
+	})
+	c.AfterFunc(time.Second, func() {
+		fired = append(fired, "a")
+		c.AfterFunc(500*time.Millisecond, func() {
+			fired = append(fired, "a2")
+		})
+	})
+	stopped := c.AfterFunc(time.Second, func() {
+		fired = append(fired, "stopped")
+	})
+	if !stopped.Stop() {
+		t.Errorf("Pending timer is not stopped")
+	}
+
+	c.Advance(999 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Errorf("Timers fired early: %v", fired)
+	}
+
+	c.Advance(time.Second)
+	if expected := []string{"a", "a2"}; !reflect.DeepEqual(fired, expected) {
+		t.Errorf("Fired %v, expected %v", fired, expected)
+	} else if now := c.Now(); !now.Equal(START.Add(1999 * time.Millisecond)) {
+		t.Errorf("Now %s", now)
+	}
+
+	c.Advance(time.Millisecond)
+	if expected := []string{"a", "a2", "b"}; !reflect.DeepEqual(fired, expected) {
+		t.Errorf("Fired %v, expected %v", fired, expected)
+	} else if c.Pending() != 0 {
+		t.Errorf("Pending %d timers", c.Pending())
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	c := clock.NewFake(START)
+	ticker := c.NewTicker(20 * time.Millisecond)
+
+	for i := 1; i <= 3; i++ {
+		c.Advance(20 * time.Millisecond)
+		select {
+		case tick := <-ticker.C():
+			if expected := START.Add(time.Duration(i) * 20 * time.Millisecond); !tick.Equal(expected) {
+				t.Errorf("Tick %s, expected %s", tick, expected)
+			}
+		default:
+			t.Errorf("No tick %d", i)
+		}
+	}
+
+	ticker.Stop()
+	c.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Errorf("Tick after stop")
+	default:
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	c := clock.NewFake(START)
+	ctx, cancel := clock.WithTimeout(context.Background(), c, 6*time.Second)
+	defer cancel()
+
+	c.Advance(5 * time.Second)
+	if ctx.Err() != nil {
+		t.Errorf("Context is done early")
+	}
+	c.Advance(time.Second)
+	if ctx.Err() == nil {
+		t.Errorf("Context is not done by the clock")
+	}
+}
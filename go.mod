@@ -1,6 +1,6 @@
 module signal
 
-go 1.17
+go 1.18
 
 require (
 	github.com/google/uuid v1.3.0
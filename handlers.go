@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"signal/media"
 	"signal/sip"
 
 	"github.com/rs/zerolog/log"
@@ -25,10 +26,23 @@ func (s *Server) onRegister(ctx context.Context, cid string, req *sip.Request) e
 }
 
 func (s *Server) onInvite(ctx context.Context, cid string, req *sip.Request) error {
+	if to, err := req.GetHeaders().GetTo(); err != nil {
+		return err
+	} else if to.Tag != "" {
+		return s.onReinvite(ctx, cid, req)
+	}
 	return s.register.auth(ctx, cid, req, func(ctx context.Context, registration *Registration) error {
+		s.recordRoute(req)
 		if uas, err := NewUAS(cid, s); err != nil {
 			return err
 		} else {
+			uas.registration = registration
+			uas.history.writeRequest(req)
+			if rejected, err := uas.rejectReliability(req); rejected || err != nil {
+				return err
+			} else if intervalTooSmall(req) {
+				return uas.respond(req, sip.SessionIntervalTooSmall, withMinSE)
+			}
 			log.Info().Str("Call-ID", cid).
 				Str("where", "UAS.onInvite").
 				Msg("Meeting not created")
@@ -37,18 +51,25 @@ func (s *Server) onInvite(ctx context.Context, cid string, req *sip.Request) err
 					Str("where", "UAS.onInvite").
 					Msg("While create new meeting")
 				return err
-			} else if meeting, err := NewMeeting(ctx, scenario); err != nil {
+			} else if meeting, err := NewMeeting(ctx, scenario, s.clock); err != nil {
 				log.Err(err).Str("Call-ID", cid).
 					Str("where", "UAS.onInvite").
 					Msg("While create new meeting")
 				return err
+			} else if mc, err := media.NewMediaChanal(meeting.id, cid, s.clock); err != nil {
+				log.Err(err).Str("Call-ID", cid).
+					Str("where", "UAS.onInvite").
+					Msg("While create media chanal")
+				return err
 			} else {
+				uas.mediaChanal = mc
 				log.Info().Str("Call-ID", cid).
 					Str("where", "UAS.onInvite").
 					Str("meeting_id", meeting.id.String()).
 					Str("scenario_id", scenario.id).
 					Msg("Create new meeting")
-				uas.meeting.appendUAS(uas)
+				meeting.appendUAS(uas)
+				s.userAgentPool[cid] = uas
 			}
 
 			if resp, err := req.MakeResponse(sip.Trying); err != nil {
@@ -71,3 +92,35 @@ func (s *Server) onInvite(ctx context.Context, cid string, req *sip.Request) err
 		}
 	})
 }
+
+// onReinvite passes INVITE within dialog to its user agent, 481 when
+// the dialog is unknown (RFC 3261 12.2.2)
+func (s *Server) onReinvite(ctx context.Context, cid string, req *sip.Request) error {
+	if ua, ok := s.userAgentPool[cid]; ok {
+		return ua.handleRequest(ctx, cid, req)
+	}
+	log.Info().Str("Call-ID", cid).
+		Str("where", "Server.onReinvite").
+		Msg("re-INVITE does not match dialog")
+	return s.transport.SendSIP(req.MakeErrorResponse(sip.CallLegDoesNotExist))
+}
+
+// onCancel answers 481 when CANCEL matches no INVITE, pending INVITE is
+// terminated by its UAS (RFC 3261 9.2)
+func (s *Server) onCancel(ctx context.Context, cid string, req *sip.Request) error {
+	if invite, pending, err := s.transactions.MatchInvite(*req); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "Server.onCancel").
+			Msg("CANCEL does not match INVITE")
+		return s.transport.SendSIP(req.MakeErrorResponse(sip.CallLegDoesNotExist))
+	} else if ua, ok := s.userAgentPool[cid]; ok && pending {
+		return ua.handleRequest(ctx, cid, req)
+	} else if resp, err := req.MakeResponse(sip.Ok); err != nil {
+		return err
+	} else if err := s.transport.SendSIP(resp); err != nil {
+		return err
+	} else if pending {
+		return s.transport.SendSIP(invite.MakeErrorResponse(sip.RequestTerminated))
+	}
+	return nil
+}
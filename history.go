@@ -28,6 +28,22 @@ func (h *History) getInvite() *sip.Request {
 	return nil
 }
 
+// isAnswered reports whether INVITE with CSeq number cseq got final
+// response
+func (h *History) isAnswered(cseq int) bool {
+	return h.getFinal(cseq) != nil
+}
+
+// getFinal response of INVITE with CSeq number cseq, nil until it comes
+func (h *History) getFinal(cseq int) *sip.Response {
+	for _, resp := range h.resps {
+		if resp.Headers.CSeq != nil && resp.Headers.CSeq.Method == sip.INVITE && resp.Headers.CSeq.Value == cseq && resp.Code >= sip.Ok {
+			return resp
+		}
+	}
+	return nil
+}
+
 func NewHistory() *History {
 	return &History{
 		reqs:  make([]*sip.Request, 0),
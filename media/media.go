@@ -2,15 +2,29 @@ package media
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"signal/clock"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/spf13/viper"
 )
 
+var ErrNoRemote = errors.New("remote media is not negotiated")
+
 type MediaChanal struct {
+	mu          sync.Mutex
 	conn        *net.UDPConn
+	host        net.IP
+	clock       clock.Clock
+	session     Session
+	pacer       *Pacer
+	ssrc        uint32
+	seq         uint16
+	timestamp   uint32
 	inputBuffer bytes.Buffer
 }
 
@@ -26,7 +40,11 @@ func (mc *MediaChanal) IsStarted() bool {
 	return false
 }
 
-func (mc *MediaChanal) End() {}
+// End stops local media and releases the port
+func (mc *MediaChanal) End() {
+	mc.Stop()
+	mc.conn.Close()
+}
 
 func (mc *MediaChanal) Listen() {
 	defer mc.conn.Close()
@@ -36,8 +54,7 @@ func (mc *MediaChanal) Listen() {
 		if l, _, err := mc.conn.ReadFrom(buffer); err != nil {
 			continue
 		} else {
-			rtpp := NewRTPPacket()
-			rtpp.Decode(buffer[:l])
+			rtpp := Decode(buffer[:l])
 			fmt.Println("Padding:", rtpp.Padding)
 			fmt.Println("Extension:", rtpp.Extension)
 			fmt.Println("CSRCCount:", rtpp.CSRCCount)
@@ -75,9 +92,85 @@ func (mc *MediaChanal) Play(f ...string) {
 
 func (ms *MediaChanal) Beeps() {}
 
-func (mc *MediaChanal) Stop() {}
+// Ringback plays ringback tone to the remote side until Stop, it is early
+// media of the call the callee alerts without media of its own
+func (mc *MediaChanal) Ringback() {
+	tone := NewRingback()
+	mc.pace(func() bool {
+		_, format := mc.remote()
+		err := mc.send(tone.Frame(format))
+		return !errors.Is(err, net.ErrClosed)
+	})
+}
+
+// remote address and format of negotiated media, shared with goroutines
+// of pacer and mixer
+func (mc *MediaChanal) remote() (*net.UDPAddr, int) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.session.Remote, mc.session.Format
+}
+
+// send payload of local media as the next RTP packet (RFC 3550 5.1)
+func (mc *MediaChanal) send(payload []byte) error {
+	remote, format := mc.remote()
+	if remote == nil {
+		return ErrNoRemote
+	}
+	rtpp := RTPPacket{
+		PayloadType:    uint8(format),
+		SequenceNumber: mc.seq,
+		Timestamp:      mc.timestamp,
+		SSRC:           mc.ssrc,
+		Payload:        payload,
+	}
+	mc.seq++
+	mc.timestamp += uint32(len(payload))
+	_, err := mc.conn.WriteToUDP(rtpp.Encode(), remote)
+	return err
+}
+
+// forward RTP packet of another chanal to the remote side
+func (mc *MediaChanal) forward(packet []byte) error {
+	if remote, _ := mc.remote(); remote == nil {
+		return ErrNoRemote
+	} else {
+		_, err := mc.conn.WriteToUDP(packet, remote)
+		return err
+	}
+}
+
+// relay RTP of the remote side to the mixer until End closes the chanal
+func (mc *MediaChanal) relay(m *MediaMixer) {
+	defer m.leave(mc)
+
+	buffer := make([]byte, 1500)
+	for {
+		if l, _, err := mc.conn.ReadFromUDP(buffer); errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		} else {
+			m.forward(mc, buffer[:l])
+		}
+	}
+}
+
+// pace sends frames of local media at their play rate
+func (mc *MediaChanal) pace(send func() bool) {
+	mc.Stop()
+	mc.pacer = NewPacer(mc.clock, PTIME)
+	go mc.pacer.Run(send)
+}
+
+func (mc *MediaChanal) Stop() {
+	if mc.pacer != nil {
+		mc.pacer.Stop()
+		mc.pacer = nil
+	}
+}
 
-func NewMediaChanal(mid uuid.UUID, cid string) (*MediaChanal, error) {
+func NewMediaChanal(mid uuid.UUID, cid string, c clock.Clock) (*MediaChanal, error) {
 	host := viper.GetString("media.host")
 	port := viper.GetInt("media.port")
 
@@ -90,19 +183,13 @@ func NewMediaChanal(mid uuid.UUID, cid string) (*MediaChanal, error) {
 		return nil, err
 	} else {
 		return &MediaChanal{
-			conn: conn,
+			conn:  conn,
+			host:  advertisedHost(conn),
+			clock: c,
+			ssrc:  rand.Uint32(),
+			session: Session{
+				ID: c.Now().Unix(),
+			},
 		}, nil
 	}
 }
-
-type MediaMixer struct{}
-
-func (m MediaMixer) Join(mc *MediaChanal) {}
-
-func (m *MediaMixer) Play(f string) {}
-
-func (m *MediaMixer) Stop() {}
-
-func NewMediaMixer() (*MediaMixer, error) {
-	return &MediaMixer{}, nil
-}
@@ -0,0 +1,60 @@
+package media
+
+import (
+	"signal/clock"
+	"sync"
+)
+
+// MediaMixer relays RTP of every joined chanal to the others, so legs of
+// the meeting hear each other from early media on
+type MediaMixer struct {
+	clock   clock.Clock
+	mu      sync.Mutex
+	chanals []*MediaChanal
+}
+
+// Join chanal once, its media is relayed until End closes it
+func (m *MediaMixer) Join(mc *MediaChanal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, joined := range m.chanals {
+		if joined == mc {
+			return
+		}
+	}
+	m.chanals = append(m.chanals, mc)
+	go mc.relay(m)
+}
+
+func (m *MediaMixer) leave(mc *MediaChanal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, joined := range m.chanals {
+		if joined == mc {
+			m.chanals = append(m.chanals[:i], m.chanals[i+1:]...)
+			return
+		}
+	}
+}
+
+// forward packet received by chanal from to the other chanals
+func (m *MediaMixer) forward(from *MediaChanal, packet []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mc := range m.chanals {
+		if mc != from {
+			mc.forward(packet)
+		}
+	}
+}
+
+func (m *MediaMixer) Play(f string) {}
+
+func (m *MediaMixer) Stop() {}
+
+func NewMediaMixer(c clock.Clock) (*MediaMixer, error) {
+	return &MediaMixer{
+		clock:   c,
+		chanals: make([]*MediaChanal, 0),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package media_test
+
+import (
+	"net"
+	"signal/clock"
+	"signal/media"
+	"signal/sdp"
+	"testing"
+	"time"
+)
+
+// newPhone is remote side of chanal mc, the answer points media of mc to
+// the phone
+func newPhone(t *testing.T, mc *media.MediaChanal) *net.UDPConn {
+	if phone, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}); err != nil {
+		t.Fatal(err)
+		return nil
+	} else {
+		t.Cleanup(func() { phone.Close() })
+		answer, _ := sdp.DecodeSDP(SDP_OFFER)
+		answer.ConnectionData.ConnectionAddress.IP = net.ParseIP("127.0.0.1")
+		answer.MediaDescriptions[0].Port = phone.LocalAddr().(*net.UDPAddr).Port
+		answer.MediaDescriptions[0].Fmts = []int{8}
+		mc.Offer(sdp.Sendrecv)
+		if err := mc.Accept(answer); err != nil {
+			t.Fatal(err)
+		}
+		return phone
+	}
+}
+
+func TestMixer(t *testing.T) {
+	a, b := newTestChanal(t), newTestChanal(t)
+	phoneA, phoneB := newPhone(t, a), newPhone(t, b)
+
+	mm, _ := media.NewMediaMixer(clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)))
+	mm.Join(a)
+	mm.Join(b)
+	mm.Join(a)
+
+	port := a.Offer(sdp.Sendrecv).MediaDescriptions[0].Port
+	packet := (&media.RTPPacket{PayloadType: 8, SequenceNumber: 7, Payload: []byte{1, 2, 3}}).Encode()
+	if _, err := phoneA.WriteToUDP(packet, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := make([]byte, 1500)
+	phoneB.SetReadDeadline(time.Now().Add(time.Second))
+	if l, _, err := phoneB.ReadFromUDP(buffer); err != nil {
+		t.Fatalf("Media is not relayed: %v", err)
+	} else if rtpp := media.Decode(buffer[:l]); rtpp.SequenceNumber != 7 || string(rtpp.Payload) != "\x01\x02\x03" {
+		t.Errorf("Relayed packet %+v", rtpp)
+	}
+
+	phoneA.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := phoneA.ReadFromUDP(buffer); err == nil {
+		t.Errorf("Media is relayed back to its sender")
+	}
+}
@@ -0,0 +1,46 @@
+package media
+
+import (
+	"signal/clock"
+	"sync"
+	"time"
+)
+
+// PTIME is packetization time of audio frames (RFC 4566 6)
+var PTIME = 20 * time.Millisecond
+
+// Pacer calls send once per ptime of the clock, so frames of local
+// media leave at the rate they are played
+type Pacer struct {
+	ticker clock.Ticker
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// Run until send returns false or Stop
+func (p *Pacer) Run(send func() bool) {
+	defer p.ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.ticker.C():
+			if !send() {
+				return
+			}
+		}
+	}
+}
+
+func (p *Pacer) Stop() {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+}
+
+func NewPacer(c clock.Clock, ptime time.Duration) *Pacer {
+	return &Pacer{
+		ticker: c.NewTicker(ptime),
+		stop:   make(chan struct{}),
+	}
+}
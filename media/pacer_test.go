@@ -0,0 +1,53 @@
+package media_test
+
+import (
+	"signal/clock"
+	"signal/media"
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	c := clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := media.NewPacer(c, media.PTIME)
+
+	sent := make(chan int)
+	done := make(chan struct{})
+	frames := 0
+	go func() {
+		p.Run(func() bool {
+			frames++
+			sent <- frames
+			return frames < 3
+		})
+		close(done)
+	}()
+
+	c.Advance(media.PTIME - time.Millisecond)
+	select {
+	case <-sent:
+		t.Fatal("Frame sent before ptime")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	for i := 1; i <= 3; i++ {
+		c.Advance(media.PTIME)
+		select {
+		case n := <-sent:
+			if n != i {
+				t.Errorf("Frame %d, expected %d", n, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Frame %d is not sent", i)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Pacer does not stop")
+	}
+	if c.Pending() != 0 {
+		t.Errorf("Ticker is not stopped")
+	}
+}
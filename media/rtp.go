@@ -39,10 +39,15 @@ type RTPPacket struct {
 	CSRCs            []uint32
 	ExtensionProfile uint16
 	ExtensionLength  uint16
+	Payload          []byte
 }
 
 func (rtpp *RTPPacket) Encode() []byte {
-	packet := make([]byte, 16)
+	n := 12 + 4*int(rtpp.CSRCCount)
+	if rtpp.Extension == 1 {
+		n += 4
+	}
+	packet := make([]byte, n+len(rtpp.Payload))
 	var headers uint64 = 0
 
 	// Set version to 2, 1-2 bits
@@ -72,7 +77,7 @@ func (rtpp *RTPPacket) Encode() []byte {
 	binary.BigEndian.PutUint64(packet, headers)
 	binary.BigEndian.PutUint32(packet[8:12], rtpp.SSRC)
 
-	n := 12
+	n = 12
 	for i := 0; i < int(rtpp.CSRCCount); i++ {
 		binary.BigEndian.PutUint32(packet[n:n+4], rtpp.CSRCs[i])
 		n += 4
@@ -81,7 +86,9 @@ func (rtpp *RTPPacket) Encode() []byte {
 	if rtpp.Extension == 1 {
 		binary.BigEndian.PutUint16(packet[n:n+2], rtpp.ExtensionProfile)
 		binary.BigEndian.PutUint16(packet[n+2:n+4], rtpp.ExtensionLength)
+		n += 4
 	}
+	copy(packet[n:], rtpp.Payload)
 
 	return packet
 }
@@ -113,6 +120,11 @@ func Decode(packet []byte) RTPPacket {
 	if rtpp.Extension == 1 {
 		rtpp.ExtensionProfile = binary.BigEndian.Uint16(packet[n : n+2])
 		rtpp.ExtensionLength = binary.BigEndian.Uint16(packet[n+2 : n+4])
+		n += 4 + 4*int(rtpp.ExtensionLength)
+	}
+
+	if n <= len(packet) {
+		rtpp.Payload = packet[n:]
 	}
 
 	return rtpp
@@ -0,0 +1,156 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"signal/sdp"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+var ErrNoCommonFormat = errors.New("no common media format")
+
+// FORMATS are static payload types of G.711 in order of preference
+var FORMATS = []int{8, 0}
+
+var RTPMAPS = map[int]sdp.RTPmap{
+	8: {EncodingName: "PCMA", ClockRate: 8000},
+	0: {EncodingName: "PCMU", ClockRate: 8000},
+}
+
+// Session is negotiated media of the chanal (RFC 3264), Mode is
+// direction of local side
+type Session struct {
+	ID      int64
+	Version int64
+	Format  int
+	Mode    sdp.MediaDescriptionMode
+	Remote  *net.UDPAddr
+
+	described string
+}
+
+// Offer describes local media with all formats in mode (RFC 3264 5)
+func (mc *MediaChanal) Offer(mode sdp.MediaDescriptionMode) *sdp.SDP {
+	return mc.describe(FORMATS, mode)
+}
+
+// Answer takes remote media of offer and describes local media with
+// the first offered format it supports (RFC 3264 6)
+func (mc *MediaChanal) Answer(offer *sdp.SDP) (*sdp.SDP, error) {
+	if format, remote, err := negotiate(offer); err != nil {
+		return nil, err
+	} else {
+		mode := offer.Mode().Answer()
+		mc.mu.Lock()
+		mc.session.Format = format
+		mc.session.Remote = remote
+		mc.session.Mode = mode
+		mc.mu.Unlock()
+		return mc.describe([]int{format}, mode), nil
+	}
+}
+
+// Accept takes remote media of answer to the last offer (RFC 3264 7)
+func (mc *MediaChanal) Accept(answer *sdp.SDP) error {
+	if format, remote, err := negotiate(answer); err != nil {
+		return err
+	} else {
+		mc.mu.Lock()
+		mc.session.Format = format
+		mc.session.Remote = remote
+		mc.session.Mode = answer.Mode().Answer()
+		mc.mu.Unlock()
+		return nil
+	}
+}
+
+// Mode is direction of local media, sendonly and inactive hold the
+// remote side
+func (mc *MediaChanal) Mode() sdp.MediaDescriptionMode {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.session.Mode == "" {
+		return sdp.Sendrecv
+	}
+	return mc.session.Mode
+}
+
+// describe keeps version of the session while description is the same
+// (RFC 3264 8)
+func (mc *MediaChanal) describe(formats []int, mode sdp.MediaDescriptionMode) *sdp.SDP {
+	if described := fmt.Sprint(formats, mode); described != mc.session.described {
+		mc.session.described = described
+		mc.session.Version++
+	}
+
+	md := sdp.MediaDescription{
+		Media:   "audio",
+		Port:    mc.conn.LocalAddr().(*net.UDPAddr).Port,
+		Proto:   "RTP/AVP",
+		Fmt:     formats[0],
+		Fmts:    formats,
+		RTPmaps: make(map[int]sdp.RTPmap),
+		Fmtp:    make(map[int]string),
+	}
+	for _, f := range formats {
+		md.RTPmaps[f] = RTPMAPS[f]
+	}
+	ptime := int(PTIME.Milliseconds())
+	md.Ptime = &ptime
+	md.SetMode(mode)
+
+	name := "-"
+	return &sdp.SDP{
+		Origin: &sdp.Origin{
+			Username:       "-",
+			SessID:         strconv.FormatInt(mc.session.ID, 10),
+			SessVersion:    strconv.FormatInt(mc.session.Version, 10),
+			Nettype:        sdp.IN,
+			Addrtype:       sdp.IP4,
+			UnicastAddress: mc.host,
+		},
+		SessionName: &name,
+		ConnectionData: &sdp.ConnectionData{
+			Nettype:  sdp.IN,
+			Addrtype: sdp.IP4,
+			ConnectionAddress: sdp.ConnectionAddress{
+				IP: mc.host,
+			},
+		},
+		Timing:            &sdp.Timing{},
+		MediaDescriptions: []sdp.MediaDescription{md},
+	}
+}
+
+// negotiate finds the first audio stream and its format supported here
+func negotiate(s *sdp.SDP) (int, *net.UDPAddr, error) {
+	if s.ConnectionData == nil {
+		return 0, nil, sdp.ErrSDPFieldNotExists
+	}
+	for _, md := range s.MediaDescriptions {
+		if md.Media != "audio" || md.Port == 0 {
+			continue
+		}
+		for _, f := range md.Fmts {
+			if _, ok := RTPMAPS[f]; ok {
+				return f, &net.UDPAddr{
+					IP:   s.ConnectionData.ConnectionAddress.IP,
+					Port: md.Port,
+				}, nil
+			}
+		}
+	}
+	return 0, nil, ErrNoCommonFormat
+}
+
+// advertisedHost is address of media in SDP, host of the server when
+// media listens on all interfaces
+func advertisedHost(conn *net.UDPConn) net.IP {
+	if ip := conn.LocalAddr().(*net.UDPAddr).IP; ip != nil && !ip.IsUnspecified() {
+		return ip
+	}
+	return net.ParseIP(viper.GetString("server.host"))
+}
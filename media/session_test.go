@@ -0,0 +1,89 @@
+package media_test
+
+import (
+	"errors"
+	"signal/clock"
+	"signal/media"
+	"signal/sdp"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+var SDP_OFFER = `v=0
+o=alice 2890844526 2890844526 IN IP4 192.0.2.4
+s=-
+c=IN IP4 192.0.2.4
+t=0 0
+m=audio 49170 RTP/AVP 18 0 8
+a=rtpmap:18 G729/8000
+a=rtpmap:0 PCMU/8000
+a=rtpmap:8 PCMA/8000
+`
+
+func newTestChanal(t *testing.T) *media.MediaChanal {
+	viper.Set("media.host", "127.0.0.1")
+	c := clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	if mc, err := media.NewMediaChanal(uuid.New(), "test", c); err != nil {
+		t.Fatal(err)
+		return nil
+	} else {
+		t.Cleanup(mc.End)
+		return mc
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	mc := newTestChanal(t)
+	if offer, err := sdp.DecodeSDP(SDP_OFFER); err != nil {
+		t.Fatal(err)
+	} else if answer, err := mc.Answer(offer); err != nil {
+		t.Fatal(err)
+	} else if md := answer.MediaDescriptions[0]; len(md.Fmts) != 1 || md.Fmts[0] != 0 {
+		t.Errorf("Answer formats %v, expected offered order [0]", md.Fmts)
+	} else if md.Mode() != sdp.Sendrecv || mc.Mode() != sdp.Sendrecv {
+		t.Errorf("Answer mode %s, chanal mode %s", md.Mode(), mc.Mode())
+	} else if !answer.ConnectionData.ConnectionAddress.IP.Equal(answer.Origin.UnicastAddress) || md.Port == 0 {
+		t.Errorf("Answer address %s:%d", answer.ConnectionData.String(), md.Port)
+	} else if _, err := sdp.DecodeSDP(answer.Encode()); err != nil {
+		t.Errorf("Answer is not decoded: %v", err)
+	}
+
+	// hold by sendonly offer, same offer again keeps the version
+	hold, _ := sdp.DecodeSDP(SDP_OFFER)
+	hold.MediaDescriptions[0].SetMode(sdp.Sendonly)
+	if first, err := mc.Answer(hold); err != nil {
+		t.Fatal(err)
+	} else if second, err := mc.Answer(hold); err != nil {
+		t.Fatal(err)
+	} else if first.MediaDescriptions[0].Mode() != sdp.Recvonly || mc.Mode() != sdp.Recvonly {
+		t.Errorf("Hold answer mode %s", first.MediaDescriptions[0].Mode())
+	} else if first.Origin.SessVersion != "2" || second.Origin.SessVersion != "2" {
+		t.Errorf("Versions %s and %s, expected 2", first.Origin.SessVersion, second.Origin.SessVersion)
+	}
+
+	rejected, _ := sdp.DecodeSDP(SDP_OFFER)
+	rejected.MediaDescriptions[0].Fmts = []int{18}
+	if _, err := mc.Answer(rejected); !errors.Is(err, media.ErrNoCommonFormat) {
+		t.Errorf("Offer without common format: %v", err)
+	}
+}
+
+func TestOfferAccept(t *testing.T) {
+	mc := newTestChanal(t)
+	offer := mc.Offer(sdp.Sendonly)
+	if md := offer.MediaDescriptions[0]; len(md.Fmts) != len(media.FORMATS) || md.Mode() != sdp.Sendonly {
+		t.Errorf("Offer %s", offer.Encode())
+	}
+
+	answer, _ := sdp.DecodeSDP(SDP_OFFER)
+	answer.MediaDescriptions[0].Fmts = []int{8}
+	answer.MediaDescriptions[0].SetMode(sdp.Recvonly)
+	if err := mc.Accept(answer); err != nil {
+		t.Fatal(err)
+	} else if mc.Mode() != sdp.Sendonly {
+		t.Errorf("Mode %s, expected sendonly", mc.Mode())
+	}
+}
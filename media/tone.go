@@ -0,0 +1,103 @@
+package media
+
+import (
+	"math"
+	"time"
+)
+
+// RINGBACK_FREQUENCY of local ringback tone in Hz, the tone is on for
+// RINGBACK_ON of every RINGBACK_PERIOD (ITU-T E.180)
+var RINGBACK_FREQUENCY = 425.0
+var RINGBACK_ON = time.Second
+var RINGBACK_PERIOD = 5 * time.Second
+
+// SAMPLE_RATE of G.711 audio
+const SAMPLE_RATE = 8000
+
+var SEG_AEND = []int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+var SEG_UEND = []int{0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF, 0x1FFF}
+
+// Tone is a sine of frequency played on and off by cadence
+type Tone struct {
+	frequency float64
+	on        int
+	period    int
+	sample    int
+}
+
+// Frame of the next ptime of the tone encoded by G.711 format
+func (t *Tone) Frame(format int) []byte {
+	frame := make([]byte, int(PTIME.Seconds()*SAMPLE_RATE))
+	for i := range frame {
+		var pcm int16
+		if t.sample%t.period < t.on {
+			pcm = int16(8000 * math.Sin(2*math.Pi*t.frequency*float64(t.sample)/SAMPLE_RATE))
+		}
+		if format == 0 {
+			frame[i] = encodeUlaw(pcm)
+		} else {
+			frame[i] = encodeAlaw(pcm)
+		}
+		t.sample++
+	}
+	return frame
+}
+
+// NewRingback is tone the caller hears while the callee is alerted
+func NewRingback() *Tone {
+	return &Tone{
+		frequency: RINGBACK_FREQUENCY,
+		on:        int(RINGBACK_ON.Seconds() * SAMPLE_RATE),
+		period:    int(RINGBACK_PERIOD.Seconds() * SAMPLE_RATE),
+	}
+}
+
+// segment of the compressed value, len(end) when pcm is out of range
+func segment(pcm int, end []int) int {
+	for i, e := range end {
+		if pcm <= e {
+			return i
+		}
+	}
+	return len(end)
+}
+
+// encodeAlaw 16 bit linear sample by A-law (ITU-T G.711)
+func encodeAlaw(sample int16) byte {
+	pcm := int(sample) >> 3
+	mask := 0xD5
+	if pcm < 0 {
+		mask = 0x55
+		pcm = -pcm - 1
+	}
+	seg := segment(pcm, SEG_AEND)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	aval := seg << 4
+	if seg < 2 {
+		aval |= (pcm >> 1) & 0xF
+	} else {
+		aval |= (pcm >> seg) & 0xF
+	}
+	return byte(aval ^ mask)
+}
+
+// encodeUlaw 16 bit linear sample by mu-law (ITU-T G.711)
+func encodeUlaw(sample int16) byte {
+	pcm := int(sample) >> 2
+	mask := 0xFF
+	if pcm < 0 {
+		mask = 0x7F
+		pcm = -pcm
+	}
+	if pcm > 8159 {
+		pcm = 8159
+	}
+	pcm += 0x84 >> 2
+	seg := segment(pcm, SEG_UEND)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	return byte(((seg << 4) | ((pcm >> (seg + 1)) & 0xF)) ^ mask)
+}
@@ -0,0 +1,32 @@
+package media_test
+
+import (
+	"signal/media"
+	"testing"
+)
+
+func TestRingback(t *testing.T) {
+	tone := media.NewRingback()
+	samples := int(media.PTIME.Seconds() * media.SAMPLE_RATE)
+	if frame := tone.Frame(8); len(frame) != samples {
+		t.Errorf("Frame of %d samples, expected %d", len(frame), samples)
+	} else if frame[0] != 0xD5 || frame[1] == 0xD5 {
+		t.Errorf("A-law tone starts with %x", frame[:2])
+	}
+
+	// the rest of the tone, then the cadence is silent
+	for i := 1; i < int(media.RINGBACK_ON/media.PTIME); i++ {
+		tone.Frame(8)
+	}
+	if frame := tone.Frame(0); frame[0] != 0xFF || frame[samples-1] != 0xFF {
+		t.Errorf("mu-law silence %x", frame[:2])
+	}
+
+	// the tone is on again after the period
+	for i := 1; i < int((media.RINGBACK_PERIOD-media.RINGBACK_ON)/media.PTIME); i++ {
+		tone.Frame(8)
+	}
+	if frame := tone.Frame(8); frame[0] != 0xD5 || frame[1] == 0xD5 {
+		t.Errorf("Tone is not on after period %s: %x", media.RINGBACK_PERIOD, frame[:2])
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"errors"
+	"signal/clock"
 	"signal/media"
+	"signal/sdp"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 )
 
 var ErrUnknownMeeting = errors.New("unknown meeting")
@@ -28,10 +31,82 @@ func (m *Meeting) appendUAC(uac *UAC) {
 	m.uacPool[uac.callID].meeting = m
 }
 
+// relayHold offers mode to the legs but the one of callID, so hold and
+// resume of one side by re-INVITE or UPDATE reach the other side. Leg
+// that allows UPDATE and completed offer and answer gets it, early one
+// included, established one gets re-INVITE otherwise (RFC 3311 5.1).
+func (m *Meeting) relayHold(callID string, mode sdp.MediaDescriptionMode) {
+	for cid, uas := range m.uasPool {
+		var err error
+		if cid == callID {
+			continue
+		} else if uas.canUpdate() && uas.negotiated {
+			err = uas.update(offerSession(uas.mediaChanal, mode))
+		} else if uas.isEstablished() {
+			err = uas.reinvite(offerSession(uas.mediaChanal, mode))
+		}
+		if err != nil {
+			log.Error().Err(err).Str("Call-ID", cid).
+				Str("where", "Meeting.relayHold").
+				Str("meeting_id", m.id.String()).
+				Msg("While relay hold")
+		}
+	}
+	for cid, uac := range m.uacPool {
+		var err error
+		if cid == callID {
+			continue
+		} else if uac.canUpdate() && uac.negotiated {
+			err = uac.update(offerSession(uac.mediaChanal, mode))
+		} else if uac.isEstablished() {
+			err = uac.reinvite(offerSession(uac.mediaChanal, mode))
+		}
+		if err != nil {
+			log.Error().Err(err).Str("Call-ID", cid).
+				Str("where", "Meeting.relayHold").
+				Str("meeting_id", m.id.String()).
+				Msg("While relay hold")
+		}
+	}
+}
+
+// expire ends the meeting when session of the leg callID was not
+// refreshed in time, every leg is closed with BYE (RFC 4028 10)
+func (m *Meeting) expire(ctx context.Context, callID string) {
+	log.Info().Str("Call-ID", callID).
+		Str("where", "Meeting.expire").
+		Str("meeting_id", m.id.String()).
+		Msg("Session expired")
+	for cid, uas := range m.uasPool {
+		if uas.isEstablished() {
+			if err := uas.bye(); err != nil {
+				log.Error().Err(err).Str("Call-ID", cid).
+					Str("where", "Meeting.expire").
+					Str("meeting_id", m.id.String()).
+					Msg("While send BYE")
+			}
+		}
+		m.scenario.uasEmit(UAS_END, ctx, uas)
+	}
+	for cid, uac := range m.uacPool {
+		if uac.isEstablished() {
+			if err := uac.bye(); err != nil {
+				log.Error().Err(err).Str("Call-ID", cid).
+					Str("where", "Meeting.expire").
+					Str("meeting_id", m.id.String()).
+					Msg("While send BYE")
+			}
+		} else {
+			uac.cancel()
+		}
+		m.scenario.uacEmit(UAC_END, ctx, uac)
+	}
+}
+
 var ErrMeetingHaseNotLag = errors.New("meeting hase not lag")
 
-func NewMeeting(ctx context.Context, s *Scenario) (*Meeting, error) {
-	if mm, err := media.NewMediaMixer(); err != nil {
+func NewMeeting(ctx context.Context, s *Scenario, c clock.Clock) (*Meeting, error) {
+	if mm, err := media.NewMediaMixer(c); err != nil {
 		return nil, err
 	} else {
 		m := &Meeting{
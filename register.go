@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net"
 	"signal/sip"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
@@ -23,14 +24,33 @@ const (
 	TransparentRegistration RegistrationType = "TRANSPARENT_REGISTRATION"
 )
 
+// Reliability of provisional responses in calls of the account (RFC 3262)
+type Reliability string
+
+const (
+	ReliabilityNone      Reliability = "NONE"
+	ReliabilitySupported Reliability = "SUPPORTED"
+	ReliabilityRequired  Reliability = "REQUIRED"
+)
+
 type Account struct {
 	RegistrationType RegistrationType `json:"registration_type"`
 	Login            string           `json:"login"`
 	Password         string           `json:"password"`
+	Reliability      Reliability      `json:"100rel"`
 	Incoming         *ScenarioConfig  `json:"incoming"`
 	Outgoing         *ScenarioConfig  `json:"outgoing"`
 }
 
+// reliability of the account, reliable provisional responses are not
+// used unless configured
+func (acc *Account) reliability() Reliability {
+	if acc == nil || acc.Reliability == "" {
+		return ReliabilityNone
+	}
+	return acc.Reliability
+}
+
 type Registration struct {
 	ID              uuid.UUID                       `json:"id"`
 	Destination     sip.Destination                 `json:"destination"`
@@ -41,7 +61,35 @@ type Registration struct {
 	SourceAddres    net.Addr                        `json:"source_addres"`
 	WWWAuthenticate map[string]*sip.WWWAuthenticate `json:"www-authenticate"`
 	Expires         int
-	Account         *Account `json:"account"`
+	AuthorizedAt    time.Time `json:"authorized_at"`
+	Account         *Account  `json:"account"`
+}
+
+// authorize registration at now, REGISTER sets its expiry by expires of
+// Contact or Expires of the request (RFC 3261 10.2.1.1)
+func (r *Registration) authorize(now time.Time, req *sip.Request) {
+	r.Authorized = true
+	r.AuthorizedAt = now
+	if req.Method != sip.REGISTER {
+		return
+	} else if req.Headers.Expires != nil && req.Headers.Expires.Value > 0 {
+		r.Expires = req.Headers.Expires.Value
+	}
+	for _, contact := range req.Headers.Contacts {
+		if contact.Expires > 0 {
+			r.Expires = contact.Expires
+			break
+		}
+	}
+}
+
+// isExpired when Expires seconds passed since authorization, registration
+// stored without time of authorization is authorized again
+func (r *Registration) isExpired(now time.Time) bool {
+	if r.AuthorizedAt.IsZero() {
+		return true
+	}
+	return now.After(r.AuthorizedAt.Add(time.Duration(r.Expires) * time.Second))
 }
 
 func NewRegistration(acc *Account, contacts []sip.Contact, addr net.Addr, destination sip.Destination, host, login string, authorized bool) *Registration {
@@ -168,7 +216,7 @@ func (r *Register) auth(ctx context.Context, cid string, req *sip.Request, handl
 			Msg("While auth")
 		return err
 	} else {
-		if registration, err := r.loadRegistration(ctx, host, login); err == nil && registration.Authorized {
+		if registration, err := r.loadRegistration(ctx, host, login); err == nil && registration.Authorized && !registration.isExpired(r.server.clock.Now()) {
 			log.Info().Str("Call-ID", cid).
 				Str("where", "Register.auth").
 				Str("host", host).
@@ -206,15 +254,16 @@ func (r *Register) auth(ctx context.Context, cid string, req *sip.Request, handl
 						Str("host", host).
 						Str("registration_id", registration.ID.String()).
 						Msg("Create new registration")
-					if err := r.storeRegistration(ctx, host, login, registration); err != nil {
-						log.Error().Err(err).Str("Call-ID", cid).
-							Str("where", "Register.auth").
-							Str("login", login).
-							Str("host", host).
-							Str("registration_id", registration.ID.String()).
-							Msg("While store registration")
-						return err
-					}
+				}
+				registration.authorize(r.server.clock.Now(), req)
+				if err := r.storeRegistration(ctx, host, login, registration); err != nil {
+					log.Error().Err(err).Str("Call-ID", cid).
+						Str("where", "Register.auth").
+						Str("login", login).
+						Str("host", host).
+						Str("registration_id", registration.ID.String()).
+						Msg("While store registration")
+					return err
 				}
 				log.Info().Str("Call-ID", cid).
 					Str("where", "Register.auth").
@@ -254,7 +303,7 @@ func (r *Register) auth(ctx context.Context, cid string, req *sip.Request, handl
 						Msg("Authorization response not expected")
 					return r.registration(ctx, cid, acc, registration, req)
 				} else {
-					registration.Authorized = true
+					registration.authorize(r.server.clock.Now(), req)
 					if err := r.storeRegistration(ctx, host, login, registration); err != nil {
 						log.Error().Err(err).Str("Call-ID", cid).
 							Str("where", "Register.auth").
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"signal/clock"
+	"signal/sip"
+	"testing"
+	"time"
+)
+
+func TestRegistrationExpires(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	registration := NewRegistration(nil, nil, nil, sip.Destination{}, "foo.bar.com", "user", false)
+	if !registration.isExpired(c.Now()) {
+		t.Error("Registration without authorization time is not expired")
+	}
+
+	register := &sip.Request{Method: sip.REGISTER}
+	register.Headers.Expires = &sip.IntegerHeader{Value: 600}
+	register.Headers.Contacts = []sip.Contact{{Address: sip.Address{URI: sip.URI{Login: "user", Host: "10.10.10.10"}}, Expires: 60}}
+	registration.authorize(c.Now(), register)
+	if registration.Expires != 60 {
+		t.Errorf("Expires %d, expected expires of Contact", registration.Expires)
+	}
+	c.Advance(60 * time.Second)
+	if registration.isExpired(c.Now()) {
+		t.Error("Registration expired before its Expires")
+	}
+	c.Advance(time.Second)
+	if !registration.isExpired(c.Now()) {
+		t.Error("Registration not expired after its Expires")
+	}
+
+	register.Headers.Contacts = nil
+	registration.authorize(c.Now(), register)
+	c.Advance(90 * time.Second)
+	if registration.Expires != 600 || registration.isExpired(c.Now()) {
+		t.Errorf("Expires %d, expected Expires of REGISTER", registration.Expires)
+	}
+
+	invite := &sip.Request{Method: sip.INVITE}
+	invite.Headers.Expires = &sip.IntegerHeader{Value: 10}
+	registration.authorize(c.Now(), invite)
+	if registration.Expires != 600 {
+		t.Errorf("Expires %d taken from INVITE", registration.Expires)
+	}
+}
@@ -35,6 +35,7 @@ type UASEvent int
 
 const (
 	UAS_READY UASEvent = iota
+	UAS_CANCEL
 	UAS_END
 )
 
@@ -42,6 +43,7 @@ type UACEvent int
 
 const (
 	UAC_RINGING UACEvent = iota
+	UAC_PROGRESS
 	UAC_READY
 	UAC_END
 )
@@ -25,3 +25,35 @@ func TestDecodeResponse(t *testing.T) {
 		t.Log(s.Origin)
 	}
 }
+
+var SDP_HOLD = `v=0
+o=alice 2890844526 2890844527 IN IP4 192.0.2.4
+s=-
+c=IN IP4 192.0.2.4
+t=0 0
+m=audio 49170 RTP/AVP 8 0
+a=rtpmap:8 PCMA/8000
+a=sendonly`
+
+func TestMode(t *testing.T) {
+	if s, err := sdp.DecodeSDP(SDP); err != nil {
+		t.Fatal(err)
+	} else if mode := s.Mode(); mode != sdp.Recvonly {
+		t.Errorf("Session level mode %s, expected recvonly", mode)
+	}
+
+	if s, err := sdp.DecodeSDP(SDP_HOLD); err != nil {
+		t.Fatal(err)
+	} else if mode := s.Mode(); mode != sdp.Sendonly {
+		t.Errorf("Mode %s, expected sendonly", mode)
+	} else if answer := mode.Answer(); answer != sdp.Recvonly {
+		t.Errorf("Answer %s, expected recvonly", answer)
+	} else {
+		s.MediaDescriptions[0].SetMode(answer)
+		if decoded, err := sdp.DecodeSDP(s.Encode()); err != nil {
+			t.Fatal(err)
+		} else if mode := decoded.Mode(); mode != sdp.Recvonly {
+			t.Errorf("Encoded mode %s, expected recvonly", mode)
+		}
+	}
+}
@@ -81,7 +81,7 @@ type ConnectionData struct {
 
 func (c *ConnectionData) String() string {
 	// c=<nettype> <addrtype> <connection-address>
-	return fmt.Sprintf("%s %s %s", string(c.Nettype), string(c.Addrtype))
+	return fmt.Sprintf("%s %s %s", string(c.Nettype), string(c.Addrtype), c.ConnectionAddress.String())
 }
 
 type Bandwidth struct {
@@ -126,7 +126,7 @@ type Attribute struct {
 }
 
 func (a *Attribute) String() string {
-	if a.Value != "" {
+	if a.Value == "" {
 		return a.Name
 	} else {
 		return fmt.Sprintf("%s:%s", a.Name, a.Value)
@@ -181,11 +181,13 @@ type MediaDescription struct {
 	NumberOfPorts int
 	Proto         string
 	Fmt           int
+	Fmts          []int
 
 	Ptime     *int                    // a=ptime:<packet time>
 	Maxptime  *int                    // a=maxptime:<maximum packet time>
 	RTPmaps   map[int]RTPmap          // a=rtpmap:<payload type> <encoding name>/<clock rate> [/<encoding parameters>]
 	Sendrecv  *bool                   // a=sendrecv
+	Recvonly  *bool                   // a=recvonly
 	Sendonly  *bool                   // a=sendonly
 	Inactive  *bool                   // a=inactive
 	Orient    *MediaDescriptionOrient // a=orient:<orientation>
@@ -197,17 +199,112 @@ type MediaDescription struct {
 }
 
 func (md *MediaDescription) String() string {
+	fmts := md.formats()
+	rawFmts := make([]string, 0, len(fmts))
+	for _, f := range fmts {
+		rawFmts = append(rawFmts, strconv.Itoa(f))
+	}
 	if md.NumberOfPorts != 0 {
 		// m=<media> <port>/<number of ports> <proto> <fmt>
-		return fmt.Sprintf("%s %d/%d %s %d", md.Media, md.Port, md.NumberOfPorts, md.Proto, md.Fmt)
+		return fmt.Sprintf("%s %d/%d %s %s", md.Media, md.Port, md.NumberOfPorts, md.Proto, strings.Join(rawFmts, " "))
 	} else {
 		// m=<media> <port> <proto> <fmt>
-		return fmt.Sprintf("%s %d %s %d", md.Media, md.Port, md.Proto, md.Fmt)
+		return fmt.Sprintf("%s %d %s %s", md.Media, md.Port, md.Proto, strings.Join(rawFmts, " "))
+	}
+}
+
+func (md *MediaDescription) formats() []int {
+	if len(md.Fmts) != 0 {
+		return md.Fmts
 	}
+	return []int{md.Fmt}
 }
 
 func (md *MediaDescription) PtimeString() string {
-	return fmt.Sprintf("ptime:%d", md.Ptime)
+	return fmt.Sprintf("ptime:%d", *md.Ptime)
+}
+
+// AttributesStrings returns media level attributes in encoding order
+func (md *MediaDescription) AttributesStrings() []string {
+	attributes := make([]string, 0)
+	for _, f := range md.formats() {
+		if rtpmap, ok := md.RTPmaps[f]; ok {
+			// a=rtpmap:<payload type> <encoding name>/<clock rate> [/<encoding parameters>]
+			a := fmt.Sprintf("rtpmap:%d %s/%d", f, rtpmap.EncodingName, rtpmap.ClockRate)
+			for _, p := range rtpmap.Parameters {
+				a += fmt.Sprintf("/%d", p)
+			}
+			attributes = append(attributes, a)
+		}
+		if fmtp, ok := md.Fmtp[f]; ok {
+			// a=fmtp:<format> <format specific parameters>
+			attributes = append(attributes, fmt.Sprintf("fmtp:%d %s", f, fmtp))
+		}
+	}
+	if md.Ptime != nil {
+		attributes = append(attributes, md.PtimeString())
+	}
+	if md.Maxptime != nil {
+		attributes = append(attributes, fmt.Sprintf("maxptime:%d", *md.Maxptime))
+	}
+	if md.Sendrecv != nil && *md.Sendrecv {
+		attributes = append(attributes, string(Sendrecv))
+	}
+	if md.Recvonly != nil && *md.Recvonly {
+		attributes = append(attributes, string(Recvonly))
+	}
+	if md.Sendonly != nil && *md.Sendonly {
+		attributes = append(attributes, string(Sendonly))
+	}
+	if md.Inactive != nil && *md.Inactive {
+		attributes = append(attributes, string(Inactive))
+	}
+	return attributes
+}
+
+// Mode is direction of the media, explicit attribute or empty when it
+// is not set
+func (md *MediaDescription) Mode() MediaDescriptionMode {
+	if md.Inactive != nil && *md.Inactive {
+		return Inactive
+	} else if md.Sendonly != nil && *md.Sendonly {
+		return Sendonly
+	} else if md.Recvonly != nil && *md.Recvonly {
+		return Recvonly
+	} else if md.Sendrecv != nil && *md.Sendrecv {
+		return Sendrecv
+	}
+	return ""
+}
+
+// SetMode leaves the only direction attribute of mode
+func (md *MediaDescription) SetMode(mode MediaDescriptionMode) {
+	md.Sendrecv, md.Recvonly, md.Sendonly, md.Inactive = nil, nil, nil, nil
+	set := true
+	switch mode {
+	case Sendrecv:
+		md.Sendrecv = &set
+	case Recvonly:
+		md.Recvonly = &set
+	case Sendonly:
+		md.Sendonly = &set
+	case Inactive:
+		md.Inactive = &set
+	}
+}
+
+// Answer is direction of answer to offer of the mode (RFC 3264 6.1)
+func (mode MediaDescriptionMode) Answer() MediaDescriptionMode {
+	switch mode {
+	case Sendonly:
+		return Recvonly
+	case Recvonly:
+		return Sendonly
+	case Inactive:
+		return Inactive
+	default:
+		return Sendrecv
+	}
 }
 
 // func (md *MediaDescription) MaxptimeString() string {}
@@ -255,67 +352,84 @@ type SDP struct {
 	MediaDescriptions []MediaDescription // m=
 }
 
+// Mode is direction of the first media, session level attribute is used
+// when media has none, sendrecv is default (RFC 4566 6)
+func (sdp *SDP) Mode() MediaDescriptionMode {
+	if len(sdp.MediaDescriptions) > 0 {
+		if mode := sdp.MediaDescriptions[0].Mode(); mode != "" {
+			return mode
+		}
+	}
+	for _, a := range sdp.Attributes {
+		switch mode := MediaDescriptionMode(a.Name); mode {
+		case Sendrecv, Recvonly, Sendonly, Inactive:
+			return mode
+		}
+	}
+	return Sendrecv
+}
+
 func (sdp *SDP) Encode() string {
 	var builder strings.Builder
-	builder.WriteString("v=0\n")
+	builder.WriteString("v=0\r\n")
 
 	// o=<username> <sess-id> <sess-version> <nettype> <addrtype> <unicast-address>
 	if sdp.Origin != nil {
-		o := fmt.Sprintf("o=%s\n", sdp.Origin.String())
+		o := fmt.Sprintf("o=%s\r\n", sdp.Origin.String())
 		builder.WriteString(o)
 	}
 
 	// s=<session name>
 	if sdp.SessionName != nil {
-		s := fmt.Sprintf("s=%s\n", *sdp.SessionName)
+		s := fmt.Sprintf("s=%s\r\n", *sdp.SessionName)
 		builder.WriteString(s)
 	}
 
 	// i=<session description>
 	if sdp.SessionInformation != nil {
-		i := fmt.Sprintf("i=%s\n", *sdp.SessionInformation)
+		i := fmt.Sprintf("i=%s\r\n", *sdp.SessionInformation)
 		builder.WriteString(i)
 	}
 
 	// u=<uri>
 	if sdp.URI != nil {
-		u := fmt.Sprintf("u=%s\n", *sdp.URI)
+		u := fmt.Sprintf("u=%s\r\n", *sdp.URI)
 		builder.WriteString(u)
 	}
 
 	// e=<email-address>
 	if sdp.EmailAddress != nil {
-		e := fmt.Sprintf("e=%s\n", *sdp.EmailAddress)
+		e := fmt.Sprintf("e=%s\r\n", *sdp.EmailAddress)
 		builder.WriteString(e)
 	}
 
 	// p=<phone-number>
 	if sdp.PhoneNumber != nil {
-		p := fmt.Sprintf("p=%s\n", *sdp.PhoneNumber)
+		p := fmt.Sprintf("p=%s\r\n", *sdp.PhoneNumber)
 		builder.WriteString(p)
 	}
 
 	// c=<nettype> <addrtype> <connection-address>
 	if sdp.ConnectionData != nil {
-		c := fmt.Sprintf("c=%s\n", sdp.ConnectionData.String())
+		c := fmt.Sprintf("c=%s\r\n", sdp.ConnectionData.String())
 		builder.WriteString(c)
 	}
 
 	// b=<bwtype>:<bandwidth>
 	if sdp.Bandwidth != nil {
-		b := fmt.Sprintf("b=%d:%d\n", sdp.Bandwidth.Bwtype, sdp.Bandwidth.Bandwidth)
+		b := fmt.Sprintf("b=%s:%d\r\n", sdp.Bandwidth.Bwtype, sdp.Bandwidth.Bandwidth)
 		builder.WriteString(b)
 	}
 
 	// t=<start-time> <stop-time>
 	if sdp.Timing != nil {
-		t := fmt.Sprintf("t=%s\n", sdp.Timing.String())
+		t := fmt.Sprintf("t=%s\r\n", sdp.Timing.String())
 		builder.WriteString(t)
 	}
 
 	// r=<repeat interval> <active duration> <offsets from start-time>
 	if sdp.RepeatTimes != nil {
-		r := fmt.Sprintf("r=%s\n", sdp.RepeatTimes.String())
+		r := fmt.Sprintf("r=%s\r\n", sdp.RepeatTimes.String())
 		builder.WriteString(r)
 	}
 
@@ -333,14 +447,17 @@ func (sdp *SDP) Encode() string {
 	// a=<attribute>
 	// a=<attribute>:<value>
 	for _, item := range sdp.Attributes {
-		a := fmt.Sprintf("r=%s\n", item.String())
+		a := fmt.Sprintf("a=%s\r\n", item.String())
 		builder.WriteString(a)
 	}
 
 	// m=<media> <port> <proto> <fmt>
 	for _, item := range sdp.MediaDescriptions {
-		m := fmt.Sprintf("m=%s\n", item.String())
+		m := fmt.Sprintf("m=%s\r\n", item.String())
 		builder.WriteString(m)
+		for _, attribute := range item.AttributesStrings() {
+			builder.WriteString(fmt.Sprintf("a=%s\r\n", attribute))
+		}
 	}
 
 	return builder.String()
@@ -353,12 +470,14 @@ func DecodeSDP(raw string) (*SDP, error) {
 		Attributes:        make([]Attribute, 0),
 		MediaDescriptions: make([]MediaDescription, 0),
 	}
-	lines := strings.Split(raw, "\n")
 	currentMediaDescription := -1
-	for _, line := range lines {
-		parts := strings.Split(line, "=")
-		key := parts[0]
-		value := parts[0]
+	for more := true; more; {
+		var line string
+		line, raw, more = strings.Cut(raw, "\n")
+		if line = strings.TrimSuffix(line, "\r"); line == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
 		if value == "" {
 			return nil, NewSDPParseError(key, "EMPTY")
 		} else {
@@ -374,7 +493,7 @@ func DecodeSDP(raw string) (*SDP, error) {
 				if valueParts := strings.Split(value, " "); len(valueParts) != 6 {
 					return nil, NewSDPParseError(key, value)
 				} else {
-					*sdp.Origin = Origin{
+					sdp.Origin = &Origin{
 						Username:       valueParts[0],
 						SessID:         valueParts[1],
 						SessVersion:    valueParts[2],
@@ -385,19 +504,19 @@ func DecodeSDP(raw string) (*SDP, error) {
 				}
 			case "s":
 				// s=<session name>
-				*sdp.SessionName = value
+				sdp.SessionName = &value
 			case "i":
 				// i=<session description>
-				*sdp.SessionInformation = value
+				sdp.SessionInformation = &value
 			case "u":
 				// u=<uri>
-				*sdp.URI = value
+				sdp.URI = &value
 			case "e":
 				// e=<email-address>
-				*sdp.EmailAddress = value
+				sdp.EmailAddress = &value
 			case "p":
 				// p=<phone-number>
-				*sdp.PhoneNumber = value
+				sdp.PhoneNumber = &value
 			case "c":
 				// c=<nettype> <addrtype> <connection-address>
 				// c=IN IP4 224.2.1.1/127/3
@@ -411,15 +530,20 @@ func DecodeSDP(raw string) (*SDP, error) {
 
 					if len(connAddrParts) > 1 {
 						if ttl, err := strconv.Atoi(connAddrParts[1]); err != nil {
+							return nil, NewSDPParseError(key, value)
+						} else {
 							condAddr.TTL = &ttl
-						} else if len(connAddrParts) > 2 {
-							if noa, err := strconv.Atoi(connAddrParts[3]); err != nil {
+						}
+						if len(connAddrParts) > 2 {
+							if noa, err := strconv.Atoi(connAddrParts[2]); err != nil {
+								return nil, NewSDPParseError(key, value)
+							} else {
 								condAddr.NumberOfAddresses = &noa
 							}
 						}
 					}
 
-					*sdp.ConnectionData = ConnectionData{
+					sdp.ConnectionData = &ConnectionData{
 						Nettype:           Nettype(valueParts[0]),
 						Addrtype:          Addrtype(valueParts[1]),
 						ConnectionAddress: condAddr,
@@ -433,7 +557,7 @@ func DecodeSDP(raw string) (*SDP, error) {
 				} else if bandwidth, err := strconv.Atoi(valueParts[1]); err != nil {
 					return nil, NewSDPParseError(key, value)
 				} else {
-					*sdp.Bandwidth = Bandwidth{
+					sdp.Bandwidth = &Bandwidth{
 						Bwtype:    valueParts[0],
 						Bandwidth: bandwidth,
 					}
@@ -456,7 +580,7 @@ func DecodeSDP(raw string) (*SDP, error) {
 				} else if stop, err := strconv.Atoi(valueParts[1]); err != nil {
 					return nil, NewSDPParseError(key, value)
 				} else {
-					*sdp.Timing = Timing{
+					sdp.Timing = &Timing{
 						StartTime: start,
 						StopTime:  stop,
 					}
@@ -473,21 +597,25 @@ func DecodeSDP(raw string) (*SDP, error) {
 				// m=<media> <port> <proto> <fmt> ...
 				// m=<media> <port>/<number of ports> <proto> <fmt> ...
 				// m=video 49170/2 RTP/AVP 31
-				if valueParts := strings.Split(value, " "); len(valueParts) != 4 {
+				if valueParts := strings.Split(value, " "); len(valueParts) < 4 {
 					return nil, NewSDPParseError(key, value)
 				} else {
 					mediaDescription := MediaDescription{
 						Media:   valueParts[0],
 						Proto:   valueParts[2],
+						Fmts:    make([]int, 0, len(valueParts)-3),
 						RTPmaps: make(map[int]RTPmap),
 						Fmtp:    make(map[int]string),
 					}
 
-					if fmt, err := strconv.Atoi(valueParts[3]); err != nil {
-						return nil, NewSDPParseError(key, value)
-					} else {
-						mediaDescription.Fmt = fmt
+					for _, rawFmt := range valueParts[3:] {
+						if fmt, err := strconv.Atoi(rawFmt); err != nil {
+							return nil, NewSDPParseError(key, value)
+						} else {
+							mediaDescription.Fmts = append(mediaDescription.Fmts, fmt)
+						}
 					}
+					mediaDescription.Fmt = mediaDescription.Fmts[0]
 
 					if portParts := strings.Split(valueParts[1], "/"); len(portParts) > 1 {
 						if port, err := strconv.Atoi(portParts[0]); err != nil {
@@ -510,7 +638,7 @@ func DecodeSDP(raw string) (*SDP, error) {
 			case "a":
 				// a=<attribute>
 				// a=<attribute>:<value>
-				valueParts := strings.Split(value, ":")
+				valueParts := strings.SplitN(value, ":", 2)
 				attribute := valueParts[0]
 				var valueAttribute string
 				if len(valueParts) == 2 {
@@ -546,25 +674,30 @@ func DecodeSDP(raw string) (*SDP, error) {
 						})
 					}
 				default:
-					if currentMediaDescription != -1 {
+					if currentMediaDescription == -1 {
+						sdp.Attributes = append(sdp.Attributes, Attribute{
+							Name:  attribute,
+							Value: valueAttribute,
+						})
+					} else {
 						switch attribute {
 						case "ptime":
 							// a=ptime:<packet time>
 							if ptimeValue, err := strconv.Atoi(valueAttribute); err != nil {
 								return nil, NewSDPParseError(key, value)
 							} else {
-								*sdp.MediaDescriptions[currentMediaDescription].Ptime = ptimeValue
+								sdp.MediaDescriptions[currentMediaDescription].Ptime = &ptimeValue
 							}
 						case "maxptime":
 							// a=maxptime:<maximum packet time>
 							if maxptimeValue, err := strconv.Atoi(valueAttribute); err != nil {
 								return nil, NewSDPParseError(key, value)
 							} else {
-								*sdp.MediaDescriptions[currentMediaDescription].Maxptime = maxptimeValue
+								sdp.MediaDescriptions[currentMediaDescription].Maxptime = &maxptimeValue
 							}
 						case "rtpmap":
 							// a=rtpmap:<payload type> <encoding name>/<clock rate> [/<encoding parameters>]
-							if attributeValueParts := strings.Split(valueAttribute, " "); len(attributeValueParts) != 2 {
+							if attributeValueParts := strings.SplitN(valueAttribute, " ", 2); len(attributeValueParts) != 2 {
 								return nil, NewSDPParseError(key, value)
 							} else if payloadType, err := strconv.Atoi(attributeValueParts[0]); err != nil {
 								return nil, NewSDPParseError(key, value)
@@ -591,33 +724,41 @@ func DecodeSDP(raw string) (*SDP, error) {
 							}
 						case "sendrecv":
 							// a=sendrecv
-							*sdp.MediaDescriptions[currentMediaDescription].Sendrecv = true
+							sendrecv := true
+							sdp.MediaDescriptions[currentMediaDescription].Sendrecv = &sendrecv
+						case "recvonly":
+							// a=recvonly
+							recvonly := true
+							sdp.MediaDescriptions[currentMediaDescription].Recvonly = &recvonly
 						case "sendonly":
 							// a=sendonly
-							*sdp.MediaDescriptions[currentMediaDescription].Sendonly = true
+							sendonly := true
+							sdp.MediaDescriptions[currentMediaDescription].Sendonly = &sendonly
 						case "inactive":
 							// a=inactive
-							*sdp.MediaDescriptions[currentMediaDescription].Inactive = true
+							inactive := true
+							sdp.MediaDescriptions[currentMediaDescription].Inactive = &inactive
 						case "orient":
 							// a=orient:<orientation>
-							*sdp.MediaDescriptions[currentMediaDescription].Orient = MediaDescriptionOrient(valueAttribute)
+							orient := MediaDescriptionOrient(valueAttribute)
+							sdp.MediaDescriptions[currentMediaDescription].Orient = &orient
 						case "framerate":
 							// a=framerate:<frame rate>
 							if framerate, err := strconv.ParseFloat(valueAttribute, 64); err != nil {
 								return nil, NewSDPParseError(key, value)
 							} else {
-								*sdp.MediaDescriptions[currentMediaDescription].Framerate = framerate
+								sdp.MediaDescriptions[currentMediaDescription].Framerate = &framerate
 							}
 						case "quality":
 							// a=quality:<quality>
 							if quality, err := strconv.Atoi(valueAttribute); err != nil {
 								return nil, NewSDPParseError(key, value)
 							} else {
-								*sdp.MediaDescriptions[currentMediaDescription].Quality = quality
+								sdp.MediaDescriptions[currentMediaDescription].Quality = &quality
 							}
 						case "fmtp":
 							// a=fmtp:<format> <format specific parameters>
-							if attributeValueParts := strings.Split(valueAttribute, " "); len(attributeValueParts) != 2 {
+							if attributeValueParts := strings.SplitN(valueAttribute, " ", 2); len(attributeValueParts) != 2 {
 								return nil, NewSDPParseError(key, value)
 							} else if format, err := strconv.Atoi(attributeValueParts[0]); err != nil {
 								return nil, NewSDPParseError(key, value)
@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"signal/clock"
 	"signal/db"
+	"signal/transaction"
 	"signal/transport"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,15 +21,20 @@ import (
 type UserAgent interface {
 	handleRequest(context.Context, string, *sip.Request) error
 	handleResponse(context.Context, string, *sip.Response) error
+	handleTimeout(context.Context, string, transaction.Timeout) error
 }
 
 type Server struct {
 	timeout       int
+	clock         clock.Clock
 	db            db.DB
 	transport     transport.Transport
 	messages      chan sip.Message
+	tasks         chan func(context.Context)
+	transactions  *transaction.Layer
 	register      *Register
 	userAgentPool map[string]UserAgent
+	optionTags    map[sip.OptionTag]bool
 }
 
 var ErrWrongRequest = errors.New("wrong request")
@@ -36,11 +44,17 @@ func (s *Server) handleRequest(ctx context.Context, cid string, req sip.Request)
 		Str("Method", string(req.Method)).
 		Str("RURI", req.URI.String()).
 		Msg("Handle request")
+	req.PreprocessRoute(s.isLocalURI)
+	if unsupported := req.UnsupportedOptions(s.supportedOptionTags()); len(unsupported) != 0 {
+		return s.rejectBadExtension(cid, &req, unsupported)
+	}
 	switch req.Method {
 	case sip.REGISTER:
 		s.onRegister(ctx, cid, &req)
 	case sip.INVITE:
 		s.onInvite(ctx, cid, &req)
+	case sip.CANCEL:
+		return s.onCancel(ctx, cid, &req)
 	case sip.OPTIONS:
 	case sip.INFO:
 	default:
@@ -65,12 +79,148 @@ func (s *Server) handleRequest(ctx context.Context, cid string, req sip.Request)
 
 var ErrUnknownUserAgent = errors.New("unknown user agent")
 
+// ALLOWED_METHODS are listed in Allow of dialog creating messages, so
+// the peer knows UPDATE and PRACK may be sent (RFC 3311 5.1, RFC 3262 3)
+var ALLOWED_METHODS = []sip.Allow{
+	sip.Allow(sip.INVITE),
+	sip.Allow(sip.ACK),
+	sip.Allow(sip.CANCEL),
+	sip.Allow(sip.BYE),
+	sip.Allow(sip.OPTIONS),
+	sip.Allow(sip.UPDATE),
+	sip.Allow(sip.PRACK),
+}
+
+// supportOptionTag registers extension implemented by the server
+func (s *Server) supportOptionTag(tag sip.OptionTag) {
+	s.optionTags[tag] = true
+}
+
+func (s *Server) supportedOptionTags() []sip.OptionTag {
+	tags := make([]sip.OptionTag, 0, len(s.optionTags))
+	for tag := range s.optionTags {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i] < tags[j]
+	})
+	return tags
+}
+
+// rejectBadExtension answers 420 listing extensions required by req
+// that the server does not implement (RFC 3261 8.2.2.3)
+func (s *Server) rejectBadExtension(cid string, req *sip.Request, unsupported []sip.OptionTag) error {
+	log.Info().Str("Call-ID", cid).
+		Str("where", "Server.rejectBadExtension").
+		Interface("unsupported", unsupported).
+		Msg("Request requires unsupported extension")
+	if resp, err := req.MakeResponse(sip.BadExtension); err != nil {
+		return err
+	} else {
+		resp.Headers.Unsupported = unsupported
+		return s.transport.SendSIP(resp)
+	}
+}
+
+func (s *Server) getHost() string {
+	return fmt.Sprintf("%s:%d", viper.GetString("server.host"), viper.GetInt("server.port"))
+}
+
+func (s *Server) isLocalURI(uri sip.URI) bool {
+	if uri.Host == s.getHost() {
+		return true
+	}
+	return uri.Host == viper.GetString("server.host") && viper.GetInt("server.port") == 5060
+}
+
+// contact of local user agent for login
+// contact of the server, it asks for TCP when the server runs over it
+// (RFC 3261 19.1.1)
+func (s *Server) contact(login string) sip.Contact {
+	uri := sip.URI{
+		Host:  s.getHost(),
+		Login: login,
+	}
+	if viper.GetString("server.transport") == "TCP" {
+		uri.Transport = "tcp"
+	}
+	return sip.Contact{
+		Address: sip.Address{
+			URI: uri,
+		},
+	}
+}
+
+// via of request sent by the server with a new branch
+func (s *Server) via() sip.Via {
+	return sip.Via{
+		Transport: viper.GetString("server.transport"),
+		Host:      s.getHost(),
+		Branch:    sip.NewBranch(),
+	}
+}
+
+// recordRoute keeps the server on the route of dialogs created by req,
+// enabled by server.record_route
+func (s *Server) recordRoute(req *sip.Request) {
+	if viper.GetBool("server.record_route") {
+		req.Headers.PushRecordRoute(sip.Route{
+			Address: sip.Address{
+				URI: sip.URI{
+					Host: s.getHost(),
+					LR:   true,
+				},
+			},
+		})
+	}
+}
+
+var ErrTooManyHops = errors.New("too many hops")
+
+// Warning code for free text explanation (RFC 3261 20.43)
+const MISC_WARNING = 399
+
+// validateRequest answers malformed requests with 400 explaining the
+// problem in Warning and requests out of hops with 483, the rest get
+// Max-Forwards decremented. ACK is never answered.
+func (s *Server) validateRequest(req *sip.Request) error {
+	if err := req.Validate(); err != nil {
+		if req.Method != sip.ACK {
+			resp := req.MakeErrorResponse(sip.BadRequest)
+			resp.Headers.AddWarning(MISC_WARNING, s.getHost(), err.Error())
+			if err := s.transport.SendSIP(resp); err != nil {
+				log.Error().Err(err).
+					Str("where", "Server.validateRequest").
+					Msg("While send response")
+			}
+		}
+		return err
+	} else if mf := req.Headers.MaxForwards; mf != nil && mf.Value == 0 && !req.Method.IncludeIn(sip.ACK, sip.OPTIONS) {
+		if err := s.transport.SendSIP(req.MakeErrorResponse(sip.TooManyHops)); err != nil {
+			log.Error().Err(err).
+				Str("where", "Server.validateRequest").
+				Msg("While send response")
+		}
+		return ErrTooManyHops
+	}
+	req.DecrementMaxForwards()
+	return nil
+}
+
 func (s *Server) handleResponse(ctx context.Context, cid string, resp sip.Response) error {
 	log.Info().Str("Call-ID", cid).
 		Str("Code", fmt.Sprint(resp.Code)).
-		Str("Text", sip.ResponseCodes[int(resp.Code)]).
+		Str("Text", resp.GetReason()).
 		Msg("Handle response")
 
+	if !resp.Code.IsKnown() {
+		log.Warn().Str("Call-ID", cid).
+			Str("Code", fmt.Sprint(resp.Code)).
+			Str("Text", resp.GetReason()).
+			Str("Class", fmt.Sprint(resp.Code.Class())).
+			Msgf("Unknown response code handled as %d", resp.Code.Equivalent())
+	}
+
 	if ua, ok := s.userAgentPool[cid]; ok {
 		return ua.handleResponse(ctx, cid, &resp)
 	} else {
@@ -80,6 +230,31 @@ func (s *Server) handleResponse(ctx context.Context, cid string, resp sip.Respon
 	}
 }
 
+// handleTimeout tells user agent that its transaction got no final
+// response or no ACK (RFC 3261 8.1.3.1, 13.3.1.4)
+func (s *Server) handleTimeout(ctx context.Context, t transaction.Timeout) error {
+	cid, _ := t.Request.GetHeaders().GetCallID()
+	log.Info().Err(t.Err).Str("Call-ID", cid).
+		Str("Method", string(t.Request.Method)).
+		Msg("Handle transaction timeout")
+
+	if ua, ok := s.userAgentPool[cid]; ok {
+		return ua.handleTimeout(ctx, cid, t)
+	} else {
+		log.Error().Str("Call-ID", cid).
+			Msg("Not found UA for handle timeout")
+		return ErrUnknownUserAgent
+	}
+}
+
+// later runs f by serve after d of the clock, so timers of calls do not
+// race with messages
+func (s *Server) later(d time.Duration, f func(context.Context)) clock.Timer {
+	return s.clock.AfterFunc(d, func() {
+		s.tasks <- f
+	})
+}
+
 func (s *Server) serve() {
 	for {
 		select {
@@ -99,12 +274,22 @@ func (s *Server) serve() {
 			// 	}
 			// }
 
+			if req, ok := m.(sip.Request); ok {
+				if err := s.validateRequest(&req); err != nil {
+					log.Error().Err(err).
+						Str("body", m.GetRawBody()).
+						Msg("Invalid request")
+					continue
+				}
+				m = req
+			}
+
 			if cid, err := m.GetHeaders().GetCallID(); err != nil {
 				log.Error().Err(err).
 					Str("body", m.GetRawBody()).
 					Msg("Wrong message")
 			} else {
-				ctx, cencel := context.WithDeadline(context.Background(), time.Now().Add(time.Duration(s.timeout)*time.Second))
+				ctx, cencel := clock.WithTimeout(context.Background(), s.clock, time.Duration(s.timeout)*time.Second)
 				switch m.(type) {
 				case sip.Request:
 					if err := s.handleRequest(ctx, cid, m.(sip.Request)); err != nil {
@@ -122,6 +307,19 @@ func (s *Server) serve() {
 				}
 				cencel()
 			}
+
+		case f := <-s.tasks:
+			ctx, cencel := clock.WithTimeout(context.Background(), s.clock, time.Duration(s.timeout)*time.Second)
+			f(ctx)
+			cencel()
+
+		case t := <-s.transactions.Timeouts():
+			ctx, cencel := clock.WithTimeout(context.Background(), s.clock, time.Duration(s.timeout)*time.Second)
+			if err := s.handleTimeout(ctx, t); err != nil {
+				log.Error().Err(err).
+					Msg("Error while transaction timeout")
+			}
+			cencel()
 		}
 	}
 }
@@ -148,17 +346,27 @@ func NewServer() (*Server, error) {
 		switch transportType {
 		case "UDP":
 			t = transport.NewUDPTransport(host, port)
+		case "TCP":
+			t = transport.NewTCPTransport(host, port, clock.REAL)
 		}
 
+		transactions := transaction.NewLayer(t, clock.REAL)
+
 		s := &Server{
 			timeout:       viper.GetInt("server.timeout"),
+			clock:         clock.REAL,
 			messages:      messages,
-			transport:     t,
+			tasks:         make(chan func(context.Context)),
+			transactions:  transactions,
+			transport:     transactions,
 			db:            db,
 			userAgentPool: make(map[string]UserAgent),
+			optionTags:    make(map[sip.OptionTag]bool),
 		}
 
 		s.register = NewRegister(s)
+		s.supportOptionTag(sip.OPTION_100REL)
+		s.supportOptionTag(sip.OPTION_TIMER)
 
 		return s, nil
 	}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/rand"
+	"signal/media"
+	"signal/sdp"
+	"signal/sip"
+	"time"
+)
+
+// answerSession sets SDP of 2xx for req, answer to its offer or offer of
+// the current mode when req has none (RFC 3261 13.2.1, RFC 3264)
+func answerSession(mc *media.MediaChanal, req *sip.Request) (func(sip.Response) sip.Response, error) {
+	if req.SDP.Origin == nil {
+		return withSession(mc.Offer(mc.Mode())), nil
+	} else if answer, err := mc.Answer(&req.SDP); err != nil {
+		return nil, err
+	} else {
+		return withSession(answer), nil
+	}
+}
+
+// withSession sets SDP s to response
+func withSession(s *sdp.SDP) func(sip.Response) sip.Response {
+	return func(resp sip.Response) sip.Response {
+		resp.SDP = *s
+		return resp
+	}
+}
+
+// offerSession sets SDP offer of mode to INVITE or UPDATE
+func offerSession(mc *media.MediaChanal, mode sdp.MediaDescriptionMode) func(sip.Request) sip.Request {
+	return func(req sip.Request) sip.Request {
+		req.SDP = *mc.Offer(mode)
+		return req
+	}
+}
+
+// glareDelay is wait before re-INVITE is sent again after 491, owner of
+// Call-ID waits 2.1-4 s, the other side 0-2 s (RFC 3261 14.1)
+func glareDelay(owner bool) time.Duration {
+	if owner {
+		return 2100*time.Millisecond + time.Duration(rand.Intn(191))*10*time.Millisecond
+	}
+	return time.Duration(rand.Intn(201)) * 10 * time.Millisecond
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"signal/clock"
+	"signal/sip"
+	"time"
+)
+
+// SESSION_EXPIRES is session interval asked by the server and MIN_SE
+// the shortest one it accepts, in seconds (RFC 4028 4, 5)
+var SESSION_EXPIRES = 1800
+var MIN_SE = 90
+
+// sessionTimer of a leg, the refresher sends re-INVITE or UPDATE at half
+// of the interval and the session ends when no refresh comes before it
+// expires (RFC 4028 10)
+type sessionTimer struct {
+	interval  int
+	refresher bool
+	timer     clock.Timer
+	gen       int
+}
+
+// start timer once 2xx of INVITE or UPDATE set the interval, refresh is
+// sent by the refresher and expire ends the session
+func (st *sessionTimer) start(s *Server, refresh func() error, expire func(context.Context)) {
+	st.stop()
+	gen := st.gen
+	interval := time.Duration(st.interval) * time.Second
+	margin := interval / 3
+	if margin > 32*time.Second {
+		margin = 32 * time.Second
+	}
+	onExpire := func(ctx context.Context) {
+		if st.gen == gen {
+			st.timer = nil
+			expire(ctx)
+		}
+	}
+	if st.refresher {
+		st.timer = s.later(interval/2, func(ctx context.Context) {
+			if st.gen == gen {
+				st.timer = s.later(interval/2-margin, onExpire)
+				refresh()
+			}
+		})
+	} else {
+		st.timer = s.later(interval-margin, onExpire)
+	}
+}
+
+// stop timer, task of the clock already queued to serve is skipped
+func (st *sessionTimer) stop() {
+	st.gen++
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+}
+
+// request asks for the interval in INVITE or UPDATE, the refresher keeps
+// its role (RFC 4028 7.4)
+func (st *sessionTimer) request(req sip.Request) sip.Request {
+	se := sip.SessionExpires{
+		Delta: st.interval,
+	}
+	if st.timer != nil && st.refresher {
+		se.Refresher = sip.REFRESHER_UAC
+	} else if st.timer != nil {
+		se.Refresher = sip.REFRESHER_UAS
+	}
+	req.Headers.SessionExpires = &se
+	req.Headers.MinSE = &sip.IntegerHeader{
+		Value: MIN_SE,
+	}
+	return req
+}
+
+// received takes interval and refresher of 2xx for request sent here,
+// false when 2xx has no Session-Expires as the session does not expire
+// then (RFC 4028 7.2)
+func (st *sessionTimer) received(resp *sip.Response) bool {
+	if se := resp.Headers.SessionExpires; se == nil {
+		return false
+	} else {
+		st.interval = se.Delta
+		st.refresher = se.Refresher != sip.REFRESHER_UAS
+		return true
+	}
+}
+
+// tooSmall raises the interval to Min-SE of 422 so the request can be
+// sent again, false when 422 gives no larger one (RFC 4028 7.3)
+func (st *sessionTimer) tooSmall(resp *sip.Response) bool {
+	if resp.Headers.MinSE == nil || resp.Headers.MinSE.Value <= st.interval {
+		return false
+	}
+	st.interval = resp.Headers.MinSE.Value
+	return true
+}
+
+// answer sets interval of 2xx for INVITE or UPDATE received here, the
+// caller refreshes when it supports the timer and has not chosen, the
+// session is refreshed here otherwise (RFC 4028 9)
+func (st *sessionTimer) answer(req *sip.Request, resp sip.Response) sip.Response {
+	se := sip.SessionExpires{
+		Delta: SESSION_EXPIRES,
+	}
+	if req.Headers.SessionExpires != nil {
+		se = *req.Headers.SessionExpires
+	}
+	if se.Refresher == "" && req.Headers.IsSupported(sip.OPTION_TIMER) {
+		se.Refresher = sip.REFRESHER_UAC
+	} else if se.Refresher == "" {
+		se.Refresher = sip.REFRESHER_UAS
+	}
+	if se.Refresher == sip.REFRESHER_UAC {
+		resp.Headers.Require = append(resp.Headers.Require, sip.OPTION_TIMER)
+	}
+	resp.Headers.SessionExpires = &se
+	st.interval = se.Delta
+	st.refresher = se.Refresher == sip.REFRESHER_UAS
+	return resp
+}
+
+// intervalTooSmall of request which asks for less than MIN_SE, it is
+// answered 422 (RFC 4028 8.1)
+func intervalTooSmall(req *sip.Request) bool {
+	return req.Headers.SessionExpires != nil && req.Headers.SessionExpires.Delta < MIN_SE
+}
+
+// withMinSE sets the shortest interval accepted here to 422
+func withMinSE(resp sip.Response) sip.Response {
+	resp.Headers.MinSE = &sip.IntegerHeader{
+		Value: MIN_SE,
+	}
+	return resp
+}
+
+func newSessionTimer() sessionTimer {
+	return sessionTimer{
+		interval: SESSION_EXPIRES,
+	}
+}
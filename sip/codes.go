@@ -2,6 +2,45 @@ package sip
 
 type ResponseCode int
 
+// ResponseClass is the first digit of response code (RFC 3261 21)
+type ResponseClass int
+
+const (
+	Provisional   ResponseClass = 1
+	Success       ResponseClass = 2
+	Redirection   ResponseClass = 3
+	ClientError   ResponseClass = 4
+	ServerError   ResponseClass = 5
+	GlobalFailure ResponseClass = 6
+)
+
+func (c ResponseCode) Class() ResponseClass {
+	return ResponseClass(c / 100)
+}
+
+func (c ResponseCode) IsValid() bool {
+	return c >= 100 && c <= 699
+}
+
+func (c ResponseCode) IsKnown() bool {
+	_, ok := ResponseCodes[int(c)]
+	return ok
+}
+
+// Equivalent returns x00 code of the class for unknown codes, they are
+// handled the same way (RFC 3261 8.1.3.2)
+func (c ResponseCode) Equivalent() ResponseCode {
+	if c.IsKnown() {
+		return c
+	}
+	return ResponseCode(c.Class() * 100)
+}
+
+// Reason phrase from ResponseCodes, empty for unknown codes
+func (c ResponseCode) Reason() string {
+	return ResponseCodes[int(c)]
+}
+
 const (
 	Ok ResponseCode = 200
 
@@ -33,6 +72,7 @@ const (
 	UnsupportedURIScheme        ResponseCode = 416 //Unsupported URI Scheme
 	BadExtension                ResponseCode = 420 //Bad Extension
 	ExtensionRequired           ResponseCode = 421 //Extension Required
+	SessionIntervalTooSmall     ResponseCode = 422 //Session Interval Too Small
 	IntervalTooBrief            ResponseCode = 423 //Interval Too Brief
 	TemporarilyNotAvailable     ResponseCode = 480 //Temporarily not available
 	CallLegDoesNotExist         ResponseCode = 481 //Call Leg/Transaction Does Not Exist
@@ -90,6 +130,7 @@ var ResponseCodes map[int]string = map[int]string{
 	416: "Unsupported URI Scheme",
 	420: "Bad Extension",
 	421: "Extension Required",
+	422: "Session Interval Too Small",
 	423: "Interval Too Brief",
 	480: "Temporarily not available",
 	481: "Call Leg/Transaction Does Not Exist",
@@ -0,0 +1,185 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+)
+
+type DialogState int
+
+const (
+	DialogEarly DialogState = iota
+	DialogConfirmed
+)
+
+var ErrDialogNotExists = errors.New("dialog not exists")
+var ErrCSeqOutOfOrder = errors.New("cseq out of order")
+
+// Dialog is peer-to-peer relationship of two user agents (RFC 3261 12),
+// local side is the agent which keeps it. RemoteCSeq is -1 until the
+// remote side sends request within the dialog.
+type Dialog struct {
+	State        DialogState
+	CallID       string
+	LocalTag     string
+	RemoteTag    string
+	LocalURI     URI
+	RemoteURI    URI
+	RemoteTarget URI
+	RouteSet     []Route
+	LocalCSeq    int
+	RemoteCSeq   int
+}
+
+// ID identifies dialog by Call-ID and both tags
+func (d *Dialog) ID() string {
+	return fmt.Sprintf("%s:%s:%s", d.CallID, d.LocalTag, d.RemoteTag)
+}
+
+// NewRequest builds request within the dialog (RFC 3261 12.2.1.1), ACK
+// and CANCEL do not take new CSeq. Via is up to the caller.
+func (d *Dialog) NewRequest(m MethodType) Request {
+	if m != ACK && m != CANCEL {
+		d.LocalCSeq++
+	}
+	h := NewHeaders()
+	h.CallID = &PlainHeader{
+		Value: d.CallID,
+	}
+	h.From = &Destination{
+		Address: Address{URI: d.LocalURI},
+		Tag:     d.LocalTag,
+	}
+	h.To = &Destination{
+		Address: Address{URI: d.RemoteURI},
+		Tag:     d.RemoteTag,
+	}
+	h.CSeq = &CSeq{
+		Value:  d.LocalCSeq,
+		Method: m,
+	}
+	req := NewRequest(m, "", d.RemoteTarget, h)
+	req.SetRouteSet(d.RouteSet, d.RemoteTarget)
+	return req
+}
+
+// NewAck builds ACK for 2xx to INVITE with CSeq number cseq
+func (d *Dialog) NewAck(cseq int) Request {
+	ack := d.NewRequest(ACK)
+	ack.Headers.CSeq.Value = cseq
+	return ack
+}
+
+// ReceiveRequest checks CSeq of request within the dialog and takes
+// remote target of target refresh request (RFC 3261 12.2.2, RFC 3311 5.2)
+func (d *Dialog) ReceiveRequest(req Request) error {
+	if cseq, err := req.GetHeaders().GetCSeq(); err != nil {
+		return err
+	} else if req.Method != ACK && req.Method != CANCEL {
+		if d.RemoteCSeq != -1 && cseq.Value <= d.RemoteCSeq {
+			return ErrCSeqOutOfOrder
+		}
+		d.RemoteCSeq = cseq.Value
+	}
+	if (req.Method == INVITE || req.Method == UPDATE) && len(req.Headers.Contacts) > 0 {
+		d.RemoteTarget = req.Headers.Contacts[0].Address.URI
+	}
+	return nil
+}
+
+// ReceiveResponse confirms early dialog by 2xx to INVITE, which also
+// gives its route set, and takes remote target of 1xx and 2xx (RFC 3261
+// 12.1.2, 12.2.1.2, RFC 3311 5.1)
+func (d *Dialog) ReceiveResponse(resp Response) {
+	invite := resp.Headers.CSeq != nil && resp.Headers.CSeq.Method == INVITE
+	if resp.Code.Class() == Success && d.State == DialogEarly && invite {
+		d.State = DialogConfirmed
+		d.RouteSet = resp.RouteSet()
+	}
+	if resp.Code.Class() <= Success && len(resp.Headers.Contacts) > 0 {
+		d.RemoteTarget = resp.Headers.Contacts[0].Address.URI
+	}
+}
+
+// Confirm dialog of UAS once 2xx is sent
+func (d *Dialog) Confirm() {
+	d.State = DialogConfirmed
+}
+
+// DropLocalRoutes removes entries of this element from the route set,
+// Record-Route it inserted comes back in the dialog it stays in and
+// requests of the dialog must not be routed to itself (RFC 3261 16.6)
+func (d *Dialog) DropLocalRoutes(isLocal func(URI) bool) {
+	routes := make([]Route, 0, len(d.RouteSet))
+	for _, r := range d.RouteSet {
+		if !isLocal(r.Address.URI) {
+			routes = append(routes, r)
+		}
+	}
+	d.RouteSet = routes
+}
+
+func newDialog(req Request, resp Response) (*Dialog, error) {
+	if cid, err := req.GetHeaders().GetCallID(); err != nil {
+		return nil, err
+	} else if _, err := req.GetHeaders().GetFrom(); err != nil {
+		return nil, err
+	} else if to, err := resp.GetHeaders().GetTo(); err != nil {
+		return nil, err
+	} else if to.Tag == "" {
+		return nil, ErrDialogNotExists
+	} else if _, err := req.GetHeaders().GetCSeq(); err != nil {
+		return nil, err
+	} else {
+		d := &Dialog{
+			CallID:     cid,
+			RemoteCSeq: -1,
+		}
+		if resp.Code.Class() == Success {
+			d.State = DialogConfirmed
+		}
+		return d, nil
+	}
+}
+
+// NewUASDialog is created by response with To tag sent for req
+// (RFC 3261 12.1.1)
+func NewUASDialog(req Request, resp Response) (*Dialog, error) {
+	if d, err := newDialog(req, resp); err != nil {
+		return nil, err
+	} else {
+		d.LocalTag = resp.Headers.To.Tag
+		d.RemoteTag = req.Headers.From.Tag
+		d.LocalURI = req.Headers.To.Address.URI
+		d.RemoteURI = req.Headers.From.Address.URI
+		d.RemoteCSeq = req.Headers.CSeq.Value
+		d.RouteSet = req.RouteSet()
+		if len(req.Headers.Contacts) > 0 {
+			d.RemoteTarget = req.Headers.Contacts[0].Address.URI
+		} else {
+			d.RemoteTarget = d.RemoteURI
+		}
+		return d, nil
+	}
+}
+
+// NewUACDialog is created by response with To tag received for req
+// (RFC 3261 12.1.2)
+func NewUACDialog(req Request, resp Response) (*Dialog, error) {
+	if d, err := newDialog(req, resp); err != nil {
+		return nil, err
+	} else {
+		d.LocalTag = req.Headers.From.Tag
+		d.RemoteTag = resp.Headers.To.Tag
+		d.LocalURI = req.Headers.From.Address.URI
+		d.RemoteURI = req.Headers.To.Address.URI
+		d.LocalCSeq = req.Headers.CSeq.Value
+		d.RouteSet = resp.RouteSet()
+		if len(resp.Headers.Contacts) > 0 {
+			d.RemoteTarget = resp.Headers.Contacts[0].Address.URI
+		} else {
+			d.RemoteTarget = d.RemoteURI
+		}
+		return d, nil
+	}
+}
@@ -0,0 +1,190 @@
+package sip_test
+
+import (
+	"errors"
+	"signal/sip"
+	"testing"
+)
+
+var SIP_DIALOG_INVITE = `INVITE sip:bob@10.0.0.1:5080 SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.4:5060;branch=z9hG4bK74bf9
+Record-Route: <sip:p2.foo.com;lr>
+Record-Route: <sip:p1.foo.com;lr>
+Max-Forwards: 70
+From: "Alice" <sip:alice@foo.com>;tag=9fxced76sl
+To: <sip:bob@foo.com>
+Call-ID: 3848276298220188511@foo.com
+CSeq: 314159 INVITE
+Contact: <sip:alice@192.0.2.4:5060>
+Content-Length: 0
+
+`
+
+func TestUASDialog(t *testing.T) {
+	if invite, err := decodeRequest(SIP_DIALOG_INVITE); err != nil {
+		t.Fatal(err)
+	} else if resp, err := invite.MakeResponse(sip.Ringing); err != nil {
+		t.Fatal(err)
+	} else if _, err := sip.NewUASDialog(invite, resp); !errors.Is(err, sip.ErrDialogNotExists) {
+		t.Errorf("Dialog without To tag: %v", err)
+	} else {
+		resp.Headers.To.Tag = "314abc"
+		if d, err := sip.NewUASDialog(invite, resp); err != nil {
+			t.Fatal(err)
+		} else if d.State != sip.DialogEarly || d.LocalTag != "314abc" || d.RemoteTag != "9fxced76sl" {
+			t.Errorf("Dialog %+v", d)
+		} else if d.RemoteTarget.Host != "192.0.2.4:5060" || d.RemoteCSeq != 314159 || d.LocalCSeq != 0 {
+			t.Errorf("Dialog %+v", d)
+		} else {
+			d.Confirm()
+			bye := d.NewRequest(sip.BYE)
+			if bye.Headers.From.Tag != "314abc" || bye.Headers.From.Address.URI.Login != "bob" {
+				t.Errorf("From %s is not local", bye.Headers.From)
+			} else if bye.Headers.To.Tag != "9fxced76sl" || bye.Headers.To.Address.URI.Login != "alice" {
+				t.Errorf("To %s is not remote", bye.Headers.To)
+			} else if bye.URI.Host != "192.0.2.4:5060" || len(bye.Headers.Routes) != 2 || bye.Headers.Routes[0].Address.URI.Host != "p2.foo.com" {
+				t.Errorf("BYE is not routed: %s %v", bye.URI, bye.Headers.Routes)
+			} else if bye.Headers.CSeq.Value != 1 {
+				t.Errorf("CSeq %d, expected 1", bye.Headers.CSeq.Value)
+			}
+
+			reinvite := invite
+			reinvite.Headers.CSeq = &sip.CSeq{Value: 314159, Method: sip.INVITE}
+			if err := d.ReceiveRequest(reinvite); !errors.Is(err, sip.ErrCSeqOutOfOrder) {
+				t.Errorf("Request with old CSeq: %v", err)
+			}
+			reinvite.Headers.CSeq = &sip.CSeq{Value: 314160, Method: sip.INVITE}
+			reinvite.Headers.Contacts = []sip.Contact{{Address: sip.Address{URI: sip.URI{Login: "alice", Host: "192.0.2.5"}}}}
+			if err := d.ReceiveRequest(reinvite); err != nil {
+				t.Error(err)
+			} else if d.RemoteTarget.Host != "192.0.2.5" || d.RemoteCSeq != 314160 {
+				t.Errorf("Target refresh not applied: %+v", d)
+			}
+		}
+	}
+}
+
+func TestDialogLocalRoute(t *testing.T) {
+	invite, err := decodeRequest(SIP_DIALOG_INVITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := sip.URI{Host: "10.0.0.1:5080", LR: true}
+	invite.Headers.PushRecordRoute(sip.Route{Address: sip.Address{URI: local}})
+	resp, err := invite.MakeResponse(sip.Ok)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(resp.Headers.RecordRoutes) != 3 || resp.Headers.RecordRoutes[0].Address.URI.Host != local.Host {
+		t.Errorf("Own Record-Route not in response: %v", resp.Headers.RecordRoutes)
+	}
+
+	resp.Headers.To.Tag = "314abc"
+	if d, err := sip.NewUASDialog(invite, resp); err != nil {
+		t.Fatal(err)
+	} else {
+		d.DropLocalRoutes(func(uri sip.URI) bool {
+			return uri.Host == local.Host
+		})
+		if bye := d.NewRequest(sip.BYE); len(bye.Headers.Routes) != 2 || bye.Headers.Routes[0].Address.URI.Host != "p2.foo.com" {
+			t.Errorf("BYE routed to the element itself: %v", bye.Headers.Routes)
+		}
+	}
+}
+
+func TestUACDialog(t *testing.T) {
+	if invite, err := decodeRequest(SIP_DIALOG_INVITE); err != nil {
+		t.Fatal(err)
+	} else if resp, err := invite.MakeResponse(sip.Ok); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Headers.To.Tag = "314abc"
+		resp.Headers.Contacts = []sip.Contact{{Address: sip.Address{URI: sip.URI{Login: "bob", Host: "192.0.2.10"}}}}
+		if d, err := sip.NewUACDialog(invite, resp); err != nil {
+			t.Fatal(err)
+		} else if d.State != sip.DialogConfirmed || d.LocalTag != "9fxced76sl" || d.RemoteTag != "314abc" {
+			t.Errorf("Dialog %+v", d)
+		} else if d.LocalCSeq != 314159 || d.RemoteCSeq != -1 {
+			t.Errorf("Dialog %+v", d)
+		} else {
+			ack := d.NewAck(314159)
+			if ack.Headers.CSeq.Value != 314159 || ack.Headers.CSeq.Method != sip.ACK {
+				t.Errorf("ACK CSeq %s", ack.Headers.CSeq)
+			} else if ack.URI.Host != "192.0.2.10" || len(ack.Headers.Routes) != 2 || ack.Headers.Routes[0].Address.URI.Host != "p1.foo.com" {
+				t.Errorf("ACK is not routed: %s %v", ack.URI, ack.Headers.Routes)
+			}
+
+			bye := d.NewRequest(sip.BYE)
+			if bye.Headers.CSeq.Value != 314160 {
+				t.Errorf("CSeq %d, expected 314160", bye.Headers.CSeq.Value)
+			} else if bye.Headers.From.Tag != "9fxced76sl" || bye.Headers.To.Tag != "314abc" {
+				t.Errorf("BYE %s -> %s", bye.Headers.From, bye.Headers.To)
+			}
+		}
+	}
+}
+
+func TestForkedDialogs(t *testing.T) {
+	invite, err := decodeRequest(SIP_DIALOG_INVITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialogs := make(map[string]*sip.Dialog)
+	for _, tag := range []string{"314abc", "271xyz"} {
+		if resp, err := invite.MakeResponse(sip.Ringing); err != nil {
+			t.Fatal(err)
+		} else {
+			resp.Headers.To.Tag = tag
+			if d, err := sip.NewUACDialog(invite, resp); err != nil {
+				t.Fatal(err)
+			} else if d.State != sip.DialogEarly || d.RemoteTag != tag {
+				t.Errorf("Dialog %+v", d)
+			} else {
+				dialogs[tag] = d
+			}
+		}
+	}
+	if len(dialogs) != 2 || dialogs["314abc"].ID() == dialogs["271xyz"].ID() {
+		t.Fatalf("Forks share dialog: %v", dialogs)
+	}
+
+	if resp, err := invite.MakeResponse(sip.Ok); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Headers.To.Tag = "271xyz"
+		dialogs["271xyz"].ReceiveResponse(resp)
+	}
+	if dialogs["271xyz"].State != sip.DialogConfirmed {
+		t.Errorf("2xx does not confirm its fork: %+v", dialogs["271xyz"])
+	} else if dialogs["314abc"].State != sip.DialogEarly {
+		t.Errorf("2xx of another fork confirms: %+v", dialogs["314abc"])
+	}
+}
+
+func TestDialogUpdate(t *testing.T) {
+	if invite, err := decodeRequest(SIP_DIALOG_INVITE); err != nil {
+		t.Fatal(err)
+	} else if resp, err := invite.MakeResponse(sip.SessionProgress); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Headers.To.Tag = "314abc"
+		if d, err := sip.NewUACDialog(invite, resp); err != nil {
+			t.Fatal(err)
+		} else {
+			update := d.NewRequest(sip.UPDATE)
+			update.Headers.PushVia(sip.Via{Host: "192.0.2.4:5060", Branch: sip.NewBranch()})
+			if update.Headers.CSeq.Value != 314160 || update.Method != sip.UPDATE {
+				t.Errorf("UPDATE %s %s", update.Method, update.Headers.CSeq)
+			} else if ok, err := update.MakeResponse(sip.Ok); err != nil {
+				t.Fatal(err)
+			} else {
+				ok.Headers.Contacts = []sip.Contact{{Address: sip.Address{URI: sip.URI{Login: "bob", Host: "192.0.2.11"}}}}
+				d.ReceiveResponse(ok)
+				if d.State != sip.DialogEarly {
+					t.Errorf("2xx to UPDATE confirms early dialog")
+				} else if d.RemoteTarget.Host != "192.0.2.11" {
+					t.Errorf("Target refresh by UPDATE not applied: %s", d.RemoteTarget)
+				}
+			}
+		}
+	}
+}
@@ -2,10 +2,15 @@ package sip
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/google/uuid"
 )
 
 type RawHeader struct {
@@ -13,122 +18,288 @@ type RawHeader struct {
 	Properties map[string]string
 }
 
-func prepareHeader(line string) (string, []RawHeader) {
-	keyBuffer := make([]string, 0)
-	i := 0
-
-	for ii, r := range line {
-		s := string(r)
-		if s != ":" {
-			keyBuffer = append(keyBuffer, s)
-		} else {
-			i = ii + 1
-			break
-		}
-	}
-
-	key := strings.TrimSpace(strings.Join(keyBuffer, ""))
-	value := strings.TrimSpace(line[i:])
+type URIParameter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
 
-	rhs := make([]RawHeader, 0)
+// sip:alice:secretword@atlanta.com;transport=tcp
+// sips:alice@atlanta.com?subject=project%20x&priority=urgent
+// sip:+1-212-555-1212:1234@gateway.com;user=phone
+// sip:alice@[2001:db8::10]:5070;maddr=239.255.255.1;ttl=15
+// tel:+1-201-555-0123;phone-context=example.com
+type URI struct {
+	Scheme     string         `json:"scheme"`
+	Login      string         `json:"login"`
+	Password   string         `json:"password"`
+	Host       string         `json:"host"`
+	Transport  string         `json:"target"`
+	User       string         `json:"user"`
+	Maddr      string         `json:"maddr"`
+	LR         bool           `json:"lr"`
+	OB         bool           `json:"ob"`
+	Parameters []URIParameter `json:"parameters"`
+	Headers    []URIParameter `json:"headers"`
+}
 
-	// Authorization: Digest username="Alice", realm="atlanta.com", nonce="84a4cc6f3082121f32b42a2187831a9e", response="7587245234b3434cc3412213e5f113a5432"
-	// WWW-Authenticate: Digest realm="atlanta.com", nonce="f84f1cec41e6cbe5aea9c8e88d359", algorithm=MD5
-	if key == "Authorization" || key == "WWW-Authenticate" {
-		rawValues := strings.Split(value, "Digest ")
-		parts := strings.Split(rawValues[0], ",")
-		props := make(map[string]string)
-		for _, part := range parts {
-			propParts := strings.Split(part, "=")
-			propKey := propParts[0]
-			propValue := propParts[1]
-			props[propKey] = strings.Trim(propValue, "\" ")
-		}
-		rhs = append(rhs, RawHeader{
-			Properties: props,
-		})
-		return key, rhs
-	} else {
-		parts := strings.Split(value, ",")
-		for _, part := range parts {
-			rawl := strings.Split(part, ";")
-			rh := RawHeader{
-				Value: rawl[0],
-			}
-			if len(rawl[1:]) > 0 {
-				props := make(map[string]string)
-				for _, prop := range rawl[1:] {
-					if strings.Count(prop, "=") > 0 {
-						propParts := strings.Split(prop, "=")
-						propKey := propParts[0]
-						propValue := strings.Trim(propParts[1], " \"")
-						props[propKey] = propValue
-					} else {
-						props[prop] = ""
-					}
-				}
-				rh.Properties = props
-			}
-			rhs = append(rhs, rh)
-		}
+const (
+	SIP_SCHEME  = "sip"
+	SIPS_SCHEME = "sips"
+	TEL_SCHEME  = "tel"
+)
 
-		return key, rhs
+func (uri URI) GetScheme() string {
+	if uri.Scheme == "" {
+		return SIP_SCHEME
 	}
-}
-
-type URI struct {
-	Login     string `json:"login"`
-	Host      string `json:"host"`
-	Transport string `json:"target"`
-	LR        bool   `json:"lr"`
+	return uri.Scheme
 }
 
 func (uri URI) String() string {
 	var builder strings.Builder
-	builder.WriteString("sip:")
+	builder.WriteString(uri.GetScheme())
+	builder.WriteString(":")
+	if uri.GetScheme() == TEL_SCHEME {
+		builder.WriteString(escapeURI(uri.Login, isParamUnreserved))
+		writeURIParameters(&builder, uri.Parameters)
+		return builder.String()
+	}
+
 	if uri.Login != "" {
-		builder.WriteString(uri.Login)
+		builder.WriteString(escapeURI(uri.Login, isUserUnreserved))
+		if uri.Password != "" {
+			builder.WriteString(":")
+			builder.WriteString(escapeURI(uri.Password, isPasswordUnreserved))
+		}
 		builder.WriteString("@")
 	}
 	builder.WriteString(uri.Host)
+	if uri.Transport != "" {
+		builder.WriteString(fmt.Sprintf(";transport=%s", uri.Transport))
+	}
+	if uri.User != "" {
+		builder.WriteString(fmt.Sprintf(";user=%s", uri.User))
+	}
+	if uri.Maddr != "" {
+		builder.WriteString(fmt.Sprintf(";maddr=%s", uri.Maddr))
+	}
 	if uri.LR {
 		builder.WriteString(";lr")
 	}
-	if uri.Transport != "" {
-		builder.WriteString(fmt.Sprintf(";transport=%s", uri.Transport))
+	if uri.OB {
+		builder.WriteString(";ob")
+	}
+	writeURIParameters(&builder, uri.Parameters)
+
+	for i, h := range uri.Headers {
+		if i == 0 {
+			builder.WriteString("?")
+		} else {
+			builder.WriteString("&")
+		}
+		builder.WriteString(escapeURI(h.Name, isHeaderUnreserved))
+		builder.WriteString("=")
+		builder.WriteString(escapeURI(h.Value, isHeaderUnreserved))
 	}
 	return builder.String()
 }
 
+func writeURIParameters(builder *strings.Builder, params []URIParameter) {
+	for _, p := range params {
+		builder.WriteString(";")
+		builder.WriteString(escapeURI(p.Name, isParamUnreserved))
+		if p.Value != "" {
+			builder.WriteString("=")
+			builder.WriteString(escapeURI(p.Value, isParamUnreserved))
+		}
+	}
+}
+
+// Hostname returns host without port and IPv6 brackets
+func (uri URI) Hostname() string {
+	if host, _, err := net.SplitHostPort(uri.Host); err == nil {
+		return host
+	}
+	return strings.Trim(uri.Host, "[]")
+}
+
+// Port returns port of the URI or 0 when it is not set
+func (uri URI) Port() int {
+	if _, rawPort, err := net.SplitHostPort(uri.Host); err != nil {
+		return 0
+	} else if port, err := strconv.Atoi(rawPort); err != nil {
+		return 0
+	} else {
+		return port
+	}
+}
+
 func (uri URI) GetAddr() net.Addr {
 	return &net.UDPAddr{}
 }
 
+// RFC 3261 25.1
+func isUnreserved(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("-_.!~*'()", c) != -1
+}
+
+func isUserUnreserved(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("&=+$,;?/", c) != -1
+}
+
+func isPasswordUnreserved(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("&=+$,", c) != -1
+}
+
+func isParamUnreserved(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("[]/:&+$", c) != -1
+}
+
+func isHeaderUnreserved(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("[]/?:+$", c) != -1
+}
+
+func escapeURI(v string, allowed func(byte) bool) string {
+	var builder strings.Builder
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; allowed(c) {
+			builder.WriteByte(c)
+		} else {
+			builder.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return builder.String()
+}
+
+var ErrCantParseURI = errors.New("cant parse uri")
+var ErrUnsupportedURIScheme = errors.New("unsupported uri scheme")
+
+func decodeURIParameters(raw string) ([]URIParameter, error) {
+	params := make([]URIParameter, 0)
+	for more := true; more; {
+		var rawParam string
+		if rawParam, raw, more = strings.Cut(raw, ";"); rawParam == "" {
+			continue
+		}
+		rawName, rawValue, _ := strings.Cut(rawParam, "=")
+		p := URIParameter{}
+		if name, err := url.PathUnescape(rawName); err != nil {
+			return nil, ErrCantParseURI
+		} else {
+			p.Name = name
+		}
+		if value, err := url.PathUnescape(rawValue); err != nil {
+			return nil, ErrCantParseURI
+		} else {
+			p.Value = value
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
 func DecodeURI(v string) (URI, error) {
 	uri := URI{
 		LR: false,
 	}
 
-	raw := strings.Trim(v, "<>")
-	raw = strings.TrimLeft(raw, "sip:")
-	parts := strings.Split(raw, ";")
-	rawURI := parts[0]
-	if strings.Index(rawURI, "@") != -1 {
-		rawURIParts := strings.Split(rawURI, "@")
-		uri.Login = rawURIParts[0]
-		uri.Host = rawURIParts[1]
-	} else {
-		uri.Host = rawURI
+	raw := strings.TrimSpace(v)
+	raw = strings.TrimSuffix(strings.TrimPrefix(raw, "<"), ">")
+
+	i := strings.Index(raw, ":")
+	if i == -1 {
+		return URI{}, ErrUnsupportedURIScheme
+	}
+	switch scheme := strings.ToLower(raw[:i]); scheme {
+	case SIP_SCHEME, SIPS_SCHEME, TEL_SCHEME:
+		uri.Scheme = scheme
+	default:
+		return URI{}, ErrUnsupportedURIScheme
+	}
+	raw = raw[i+1:]
+
+	if uri.Scheme == TEL_SCHEME {
+		// tel:+1-201-555-0123;phone-context=example.com
+		rawNumber, rawParams, hasParams := strings.Cut(raw, ";")
+		if number, err := url.PathUnescape(rawNumber); err != nil || number == "" {
+			return URI{}, ErrCantParseURI
+		} else {
+			uri.Login = number
+		}
+		if hasParams {
+			if params, err := decodeURIParameters(rawParams); err != nil {
+				return URI{}, err
+			} else if len(params) != 0 {
+				uri.Parameters = params
+			}
+		}
+		return uri, nil
+	}
+
+	// userinfo can contain ';' and '?', but never unescaped '@'
+	if at := strings.LastIndex(raw, "@"); at != -1 {
+		rawLogin, rawPassword, hasPassword := strings.Cut(raw[:at], ":")
+		if login, err := url.PathUnescape(rawLogin); err != nil {
+			return URI{}, ErrCantParseURI
+		} else {
+			uri.Login = login
+		}
+		if hasPassword {
+			if password, err := url.PathUnescape(rawPassword); err != nil {
+				return URI{}, ErrCantParseURI
+			} else {
+				uri.Password = password
+			}
+		}
+		raw = raw[at+1:]
+	}
+
+	if q := strings.Index(raw, "?"); q != -1 {
+		for rawHeaders, more := raw[q+1:], true; more; {
+			var rawHeader string
+			rawHeader, rawHeaders, more = strings.Cut(rawHeaders, "&")
+			if rawName, rawValue, ok := strings.Cut(rawHeader, "="); !ok {
+				return URI{}, ErrCantParseURI
+			} else if name, err := url.PathUnescape(rawName); err != nil {
+				return URI{}, ErrCantParseURI
+			} else if value, err := url.PathUnescape(rawValue); err != nil {
+				return URI{}, ErrCantParseURI
+			} else {
+				uri.Headers = append(uri.Headers, URIParameter{name, value})
+			}
+		}
+		raw = raw[:q]
 	}
 
-	for _, p := range parts[1:] {
-		if strings.Index(p, "=") != -1 {
-			kv := strings.Split(p, "=")
-			if kv[0] == "transport" {
-				uri.Transport = kv[1]
+	host, rawParams, hasParams := strings.Cut(raw, ";")
+	uri.Host = host
+	if uri.Host == "" {
+		return URI{}, ErrCantParseURI
+	} else if strings.HasPrefix(uri.Host, "[") && strings.Index(uri.Host, "]") == -1 {
+		return URI{}, ErrCantParseURI
+	}
+
+	if hasParams {
+		if params, err := decodeURIParameters(rawParams); err != nil {
+			return URI{}, err
+		} else {
+			for _, p := range params {
+				switch strings.ToLower(p.Name) {
+				case "transport":
+					uri.Transport = p.Value
+				case "user":
+					uri.User = p.Value
+				case "maddr":
+					uri.Maddr = p.Value
+				case "lr":
+					uri.LR = true
+				case "ob":
+					uri.OB = true
+				default:
+					uri.Parameters = append(uri.Parameters, p)
+				}
 			}
-		} else if p == "lr" {
-			uri.LR = true
 		}
 	}
 
@@ -136,15 +307,14 @@ func DecodeURI(v string) (URI, error) {
 }
 
 type Address struct {
-	Name string `json"name"`
+	Name string `json:"name"`
 	URI  URI    `json:"uri"`
 }
 
 func (t Address) String() string {
 	var builder strings.Builder
 	if t.Name != "" {
-		v := fmt.Sprintf("\"%s\"", t.Name)
-		builder.WriteString(fmt.Sprintf("%s ", v))
+		builder.WriteString(fmt.Sprintf("%s ", quote(t.Name)))
 	}
 	builder.WriteString(fmt.Sprintf("<%s>", t.URI))
 	return builder.String()
@@ -157,16 +327,10 @@ func (t Address) String() string {
 // Anonymous <sip:c8oqz84zk7z@privacy.org>
 func DecodeTarget(v string) (Address, error) {
 	var address Address
-	i := strings.Index(v, "<sip:")
-	if i == -1 {
-		i = strings.Index(v, "sip:")
-	}
-	var rawURI string
+	rawURI := strings.TrimSpace(v)
 
-	if i == 0 {
-		rawURI = v
-	} else if i != -1 {
-		address.Name = strings.Trim(v[:i-1], " \"")
+	if i := indexOutsideQuotes(v, '<'); i != -1 {
+		address.Name = unquote(strings.TrimSpace(v[:i]))
 		rawURI = v[i:]
 	}
 
@@ -185,7 +349,42 @@ type PlainHeader struct {
 }
 
 func (ph PlainHeader) String() string {
-	return string(ph.Value)
+	var builder strings.Builder
+	builder.WriteString(ph.Value)
+	writeProperties(&builder, ph.Properties)
+	return builder.String()
+}
+
+func writeProperties(builder *strings.Builder, props map[string]string) {
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		builder.WriteString(";")
+		builder.WriteString(key)
+		if value := props[key]; value != "" {
+			builder.WriteString("=")
+			builder.WriteString(quoteParameter(value))
+		}
+	}
+}
+
+// otherProperties of props without the known ones, which have typed
+// fields, nil when nothing is left
+func otherProperties(props map[string]string, known ...string) map[string]string {
+	other := make(map[string]string, len(props))
+	for key, value := range props {
+		other[key] = value
+	}
+	for _, key := range known {
+		delete(other, key)
+	}
+	if len(other) == 0 {
+		return nil
+	}
+	return other
 }
 
 func decodePlainHeader(rh RawHeader) (PlainHeader, error) {
@@ -210,8 +409,9 @@ func decodeIntegerHeader(rh RawHeader) (IntegerHeader, error) {
 }
 
 type Destination struct {
-	Address Address `json:"addres"`
-	Tag     string
+	Address    Address `json:"addres"`
+	Tag        string
+	Properties map[string]string
 }
 
 func (d Destination) String() string {
@@ -220,6 +420,7 @@ func (d Destination) String() string {
 	if d.Tag != "" {
 		builder.WriteString(fmt.Sprintf(";tag=%s", d.Tag))
 	}
+	writeProperties(&builder, d.Properties)
 	return builder.String()
 }
 
@@ -228,37 +429,71 @@ func decodeDestinations(rh RawHeader) (Destination, error) {
 		return Destination{}, err
 	} else {
 		return Destination{
-			Address: t,
-			Tag:     rh.Properties["tag"],
+			Address:    t,
+			Tag:        rh.Properties["tag"],
+			Properties: otherProperties(rh.Properties, "tag"),
 		}, nil
 	}
 }
 
+// Branch of RFC 3261 compliant elements starts with the magic cookie
+const BRANCH_MAGIC_COOKIE = "z9hG4bK"
+
+// NewBranch returns unique branch for Via of new transaction
+func NewBranch() string {
+	return BRANCH_MAGIC_COOKIE + uuid.NewString()
+}
+
+// Via with rport of RFC 3581, RportValue is the source port filled in
+// by the server that received the request
 type Via struct {
-	Host     string
-	Branch   string
-	Received string
-	Rport    bool
+	Transport  string
+	Host       string
+	Branch     string
+	Received   string
+	Rport      bool
+	RportValue string
+	Properties map[string]string
+}
+
+func (via Via) GetTransport() string {
+	if via.Transport == "" {
+		return "UDP"
+	}
+	return via.Transport
 }
 
 func (via Via) String() string {
 	var builder strings.Builder
-	builder.WriteString(fmt.Sprintf("SIP/2.0/UDP %s", via.Host))
+	builder.WriteString(fmt.Sprintf("%s/%s %s", VERSION, via.GetTransport(), via.Host))
 	if via.Branch != "" {
 		builder.WriteString(fmt.Sprintf(";branch=%s", via.Branch))
 	}
 	if via.Received != "" {
 		builder.WriteString(fmt.Sprintf(";received=%s", via.Received))
 	}
-	if via.Rport {
-		builder.WriteString(";rpotr")
+	if via.Rport && via.RportValue != "" {
+		builder.WriteString(fmt.Sprintf(";rport=%s", via.RportValue))
+	} else if via.Rport {
+		builder.WriteString(";rport")
 	}
+	writeProperties(&builder, via.Properties)
 	return builder.String()
 }
 
+var ErrCantParseVia = errors.New("cant parse via")
+
+// Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds
 func decodeVia(rh RawHeader) (Via, error) {
+	protocol, host, _ := strings.Cut(rh.Value, " ")
+	host = strings.TrimSpace(host)
+	i := strings.LastIndexByte(protocol, '/')
+	if i == -1 || protocol[:i] != VERSION || host == "" || strings.ContainsAny(host, " \t") {
+		return Via{}, ErrCantParseVia
+	}
 	via := Via{
-		Host: strings.TrimLeft(rh.Value, "Via: SIP/2.0/UDP "),
+		Transport: strings.ToUpper(protocol[i+1:]),
+		Host:      host,
 	}
 
 	if branch, ok := rh.Properties["branch"]; ok {
@@ -269,46 +504,94 @@ func decodeVia(rh RawHeader) (Via, error) {
 		via.Received = received
 	}
 
-	if _, ok := rh.Properties["rport"]; ok {
+	if rport, ok := rh.Properties["rport"]; ok {
 		via.Rport = true
+		via.RportValue = rport
 	}
 
+	via.Properties = otherProperties(rh.Properties, "branch", "received", "rport")
 	return via, nil
 }
 
+// Route and Record-Route value
+// Record-Route: <sip:p1.example.com;lr>, <sip:p2.domain.com;lr>
+type Route struct {
+	Address    Address
+	Properties map[string]string
+}
+
+func (r Route) String() string {
+	var builder strings.Builder
+	builder.WriteString(r.Address.String())
+	writeProperties(&builder, r.Properties)
+	return builder.String()
+}
+
+func decodeRoute(rh RawHeader) (Route, error) {
+	if address, err := DecodeTarget(rh.Value); err != nil {
+		return Route{}, err
+	} else {
+		return Route{
+			Address:    address,
+			Properties: rh.Properties,
+		}, nil
+	}
+}
+
+// Contact of target, Wildcard is "*" of REGISTER removing every binding
+// (RFC 3261 10.2.2)
 type Contact struct {
-	Address Address
-	Q       float64
-	Expires int
+	Address    Address
+	Q          float64
+	Expires    int
+	Wildcard   bool
+	Properties map[string]string
 }
 
 func (c Contact) String() string {
 	var builder strings.Builder
-	builder.WriteString(c.Address.String())
+	if c.Wildcard {
+		builder.WriteString("*")
+	} else {
+		builder.WriteString(c.Address.String())
+	}
 	if c.Q != 0 {
-		builder.WriteString(fmt.Sprintf("%f", c.Q))
+		builder.WriteString(";q=")
+		builder.WriteString(strconv.FormatFloat(c.Q, 'f', -1, 64))
 	}
 	if c.Expires != 0 {
+		builder.WriteString(";expires=")
 		builder.WriteString(strconv.Itoa(c.Expires))
 	}
+	writeProperties(&builder, c.Properties)
 	return builder.String()
 }
 
 // Contact: "Mr. Watson" <sip:watson@worcester.bell-telephone.com>;q=0.7; expires=3600
 func decodeContact(rh RawHeader) (Contact, error) {
 	var contact Contact
-	if address, err := DecodeTarget(rh.Value); err != nil {
+	if rh.Value == "*" {
+		contact.Wildcard = true
+	} else if address, err := DecodeTarget(rh.Value); err != nil {
 		return Contact{}, err
 	} else {
 		contact.Address = address
 	}
 	if rawQ, ok := rh.Properties["q"]; ok {
-		if q, err := strconv.ParseFloat(rawQ, 32); err != nil {
+		if q, err := strconv.ParseFloat(rawQ, 64); err != nil {
 			return Contact{}, err
 		} else {
 			contact.Q = q
 		}
 	}
+	if rawExpires, ok := rh.Properties["expires"]; ok {
+		if expires, err := strconv.Atoi(rawExpires); err != nil {
+			return Contact{}, err
+		} else {
+			contact.Expires = expires
+		}
+	}
+	contact.Properties = otherProperties(rh.Properties, "q", "expires")
 	return contact, nil
 }
 
@@ -325,14 +608,80 @@ func (cseq CSeq) String() string {
 	return builder.String()
 }
 
+var ErrCantParseCSeq = errors.New("cant parse cseq")
+
 func decodeCSeq(rh RawHeader) (CSeq, error) {
-	parts := strings.Split(rh.Value, " ")
-	if v, err := strconv.Atoi(parts[0]); err != nil {
+	rawValue, method, _ := strings.Cut(rh.Value, " ")
+	if method = strings.TrimSpace(method); method == "" || strings.ContainsAny(method, " \t") {
+		return CSeq{}, ErrCantParseCSeq
+	} else if v, err := strconv.Atoi(rawValue); err != nil {
 		return CSeq{}, err
 	} else {
 		return CSeq{
 			Value:  v,
-			Method: MethodType(parts[1]),
+			Method: MethodType(method),
+		}, nil
+	}
+}
+
+// RAck acknowledges reliable provisional response by its RSeq and
+// CSeq of the request (RFC 3262 7.2)
+type RAck struct {
+	RSeq   int
+	CSeq   int
+	Method MethodType
+}
+
+func (ra RAck) String() string {
+	return fmt.Sprintf("%d %d %s", ra.RSeq, ra.CSeq, ra.Method)
+}
+
+var ErrCantParseRAck = errors.New("cant parse rack")
+
+// RAck: 776656 1 INVITE
+func decodeRAck(rh RawHeader) (RAck, error) {
+	if parts := strings.Fields(rh.Value); len(parts) != 3 {
+		return RAck{}, ErrCantParseRAck
+	} else if rseq, err := strconv.Atoi(parts[0]); err != nil {
+		return RAck{}, err
+	} else if cseq, err := strconv.Atoi(parts[1]); err != nil {
+		return RAck{}, err
+	} else {
+		return RAck{
+			RSeq:   rseq,
+			CSeq:   cseq,
+			Method: MethodType(parts[2]),
+		}, nil
+	}
+}
+
+const (
+	REFRESHER_UAC = "uac"
+	REFRESHER_UAS = "uas"
+)
+
+// SessionExpires is interval of the session in seconds and side of the
+// transaction which refreshes it (RFC 4028 4)
+type SessionExpires struct {
+	Delta     int
+	Refresher string
+}
+
+func (se SessionExpires) String() string {
+	if se.Refresher == "" {
+		return strconv.Itoa(se.Delta)
+	}
+	return fmt.Sprintf("%d;refresher=%s", se.Delta, se.Refresher)
+}
+
+// Session-Expires: 4000;refresher=uac
+func decodeSessionExpires(rh RawHeader) (SessionExpires, error) {
+	if delta, err := strconv.Atoi(rh.Value); err != nil {
+		return SessionExpires{}, err
+	} else {
+		return SessionExpires{
+			Delta:     delta,
+			Refresher: rh.Properties["refresher"],
 		}, nil
 	}
 }
@@ -349,30 +698,135 @@ func decodeAllow(rh RawHeader) (Allow, error) {
 	return Allow(v), nil
 }
 
+// IsSupported reports whether tag is in Supported or Require
+func (hs *Headers) IsSupported(tag OptionTag) bool {
+	return hs.IsRequired(tag) || containsOptionTag(hs.Supported, tag)
+}
+
+// IsRequired reports whether tag is in Require
+func (hs *Headers) IsRequired(tag OptionTag) bool {
+	return containsOptionTag(hs.Require, tag)
+}
+
+func containsOptionTag(tags []OptionTag, tag OptionTag) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowed reports whether Allow of the headers lists m
+func (hs *Headers) IsAllowed(m MethodType) bool {
+	for _, a := range hs.Allows {
+		if MethodType(a) == m {
+			return true
+		}
+	}
+	return false
+}
+
+// OptionTag of Supported, Require, Proxy-Require and Unsupported (RFC 3261 19.2)
+type OptionTag string
+
+const (
+	OPTION_100REL   OptionTag = "100rel"
+	OPTION_TIMER    OptionTag = "timer"
+	OPTION_REPLACES OptionTag = "replaces"
+)
+
+func (ot OptionTag) String() string {
+	return string(ot)
+}
+
+// Supported: 100rel, timer
+func decodeOptionTag(rh RawHeader) (OptionTag, error) {
+	return OptionTag(strings.TrimSpace(rh.Value)), nil
+}
+
+func writeOptionTags(buffer *bytes.Buffer, name string, tags []OptionTag) {
+	if len(tags) == 0 {
+		return
+	}
+	rawTags := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		rawTags = append(rawTags, tag.String())
+	}
+	buffer.WriteString(name)
+	buffer.WriteString(": ")
+	buffer.WriteString(strings.Join(rawTags, ", "))
+	buffer.WriteString("\r\n")
+}
+
+// Authorization of digest, QOP, NC and CNonce are set when the challenge
+// offered qop (RFC 2617 3.2.2)
 type Authorization struct {
-	Username string
-	Realm    string
-	Nonce    string
-	Response string
+	Username   string
+	Realm      string
+	Nonce      string
+	URI        string
+	Response   string
+	Algorithm  string
+	CNonce     string
+	Opaque     string
+	QOP        string
+	NC         string
+	Properties map[string]string
 }
 
 func (a *Authorization) String() string {
 	var builder strings.Builder
 	builder.WriteString("Digest ")
-	builder.WriteString(fmt.Sprintf("username=%s", a.Username))
-	builder.WriteString(fmt.Sprintf("realm=%s", a.Realm))
-	builder.WriteString(fmt.Sprintf("nonce=%s", a.Nonce))
-	builder.WriteString(fmt.Sprintf("response=%s", a.Response))
+	builder.WriteString(fmt.Sprintf("username=\"%s\"", a.Username))
+	builder.WriteString(fmt.Sprintf(", realm=\"%s\"", a.Realm))
+	builder.WriteString(fmt.Sprintf(", nonce=\"%s\"", a.Nonce))
+	if a.URI != "" {
+		builder.WriteString(fmt.Sprintf(", uri=\"%s\"", a.URI))
+	}
+	builder.WriteString(fmt.Sprintf(", response=\"%s\"", a.Response))
+	if a.Algorithm != "" {
+		builder.WriteString(fmt.Sprintf(", algorithm=%s", a.Algorithm))
+	}
+	if a.CNonce != "" {
+		builder.WriteString(fmt.Sprintf(", cnonce=\"%s\"", a.CNonce))
+	}
+	if a.Opaque != "" {
+		builder.WriteString(fmt.Sprintf(", opaque=\"%s\"", a.Opaque))
+	}
+	if a.QOP != "" {
+		builder.WriteString(fmt.Sprintf(", qop=%s", a.QOP))
+	}
+	if a.NC != "" {
+		builder.WriteString(fmt.Sprintf(", nc=%s", a.NC))
+	}
+	keys := make([]string, 0, len(a.Properties))
+	for key := range a.Properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		builder.WriteString(fmt.Sprintf(", %s=%s", key, quote(a.Properties[key])))
+	}
 	return builder.String()
 }
 
 // Authorization: Digest username="Alice", realm="atlanta.com", nonce="84a4cc6f3082121f32b42a2187831a9e", response="7587245234b3434cc3412213e5f113a5432"
 func decodeAuthorization(rh RawHeader) (Authorization, error) {
 	return Authorization{
-		Username: rh.Properties["username"],
-		Realm:    rh.Properties["realm"],
-		Nonce:    rh.Properties["nonce"],
-		Response: rh.Properties["response"],
+		Username:  rh.Properties["username"],
+		Realm:     rh.Properties["realm"],
+		Nonce:     rh.Properties["nonce"],
+		URI:       rh.Properties["uri"],
+		Response:  rh.Properties["response"],
+		Algorithm: rh.Properties["algorithm"],
+		CNonce:    rh.Properties["cnonce"],
+		Opaque:    rh.Properties["opaque"],
+		QOP:       rh.Properties["qop"],
+		NC:        rh.Properties["nc"],
+		Properties: otherProperties(rh.Properties,
+			"username", "realm", "nonce", "uri", "response",
+			"algorithm", "cnonce", "opaque", "qop", "nc"),
 	}, nil
 }
 
@@ -383,7 +837,7 @@ type WWWAuthenticate struct {
 }
 
 func (a *WWWAuthenticate) String() string {
-	return fmt.Sprintf("Digest realm=\"%s\", nonce=\"%s\", algorithm=\"%s\"", a.Realm, a.Nonce, a.Algorithm)
+	return fmt.Sprintf("Digest realm=\"%s\", nonce=\"%s\", algorithm=%s", a.Realm, a.Nonce, a.Algorithm)
 }
 
 // WWW-Authenticate: Digest realm="atlanta.com", nonce="f84f1cec41e6cbe5aea9c8e88d359", algorithm=MD5
@@ -395,18 +849,208 @@ func decodeWWWAuthenticate(rh RawHeader) (WWWAuthenticate, error) {
 	}, nil
 }
 
+// ExtensionHeader keeps a header that has no typed field in Headers
+// exactly as it was received, so it can be relayed untouched.
+type ExtensionHeader struct {
+	Name  string
+	Value string
+}
+
+func (eh ExtensionHeader) String() string {
+	return eh.Value
+}
+
+// Headers decoded into typed fields, everything else goes to Extensions
+var TYPED_HEADERS = map[string]bool{
+	"Via":              true,
+	"Route":            true,
+	"Record-Route":     true,
+	"From":             true,
+	"To":               true,
+	"Call-ID":          true,
+	"Contact":          true,
+	"CSeq":             true,
+	"RSeq":             true,
+	"RAck":             true,
+	"Session-Expires":  true,
+	"Min-SE":           true,
+	"Expires":          true,
+	"Allow":            true,
+	"Supported":        true,
+	"Require":          true,
+	"Proxy-Require":    true,
+	"Unsupported":      true,
+	"Max-Forwards":     true,
+	"WWW-Authenticate": true,
+	"Authorization":    true,
+	"Content-Type":     true,
+	"Content-Length":   true,
+}
+
 type Headers struct {
 	Vias            []Via
+	Routes          []Route
+	RecordRoutes    []Route
 	From            *Destination
 	To              *Destination
 	CallID          *PlainHeader
 	Contacts        []Contact
 	CSeq            *CSeq
+	RSeq            *IntegerHeader
+	RAck            *RAck
+	SessionExpires  *SessionExpires
+	MinSE           *IntegerHeader
+	Expires         *IntegerHeader
 	Allows          []Allow
+	Supported       []OptionTag
+	Require         []OptionTag
+	ProxyRequire    []OptionTag
+	Unsupported     []OptionTag
 	MaxForwards     *IntegerHeader
 	WWWAuthenticate *WWWAuthenticate
 	Authorization   *Authorization
+	ContentType     *PlainHeader
 	ContentLength   *IntegerHeader
+	Extensions      []ExtensionHeader
+}
+
+var ErrHeaderNotExists = errors.New("header not exists")
+
+func (hs *Headers) PushVia(v Via) {
+	hs.Vias = append([]Via{v}, hs.Vias...)
+}
+
+func (hs *Headers) PushRoute(r Route) {
+	hs.Routes = append([]Route{r}, hs.Routes...)
+}
+
+func (hs *Headers) PushRecordRoute(r Route) {
+	hs.RecordRoutes = append([]Route{r}, hs.RecordRoutes...)
+}
+
+func (hs *Headers) GetVias() ([]Via, error) {
+	if len(hs.Vias) == 0 {
+		return nil, ErrHeaderNotExists
+	}
+	return hs.Vias, nil
+}
+
+func (hs *Headers) GetFrom() (Destination, error) {
+	if hs.From == nil {
+		return Destination{}, ErrHeaderNotExists
+	}
+	return *hs.From, nil
+}
+
+func (hs *Headers) GetTo() (Destination, error) {
+	if hs.To == nil {
+		return Destination{}, ErrHeaderNotExists
+	}
+	return *hs.To, nil
+}
+
+func (hs *Headers) GetCallID() (string, error) {
+	if hs.CallID == nil {
+		return "", ErrHeaderNotExists
+	}
+	return hs.CallID.Value, nil
+}
+
+func (hs *Headers) GetContacts() ([]Contact, error) {
+	if len(hs.Contacts) == 0 {
+		return nil, ErrHeaderNotExists
+	}
+	return hs.Contacts, nil
+}
+
+func (hs *Headers) GetCSeq() (CSeq, error) {
+	if hs.CSeq == nil {
+		return CSeq{}, ErrHeaderNotExists
+	}
+	return *hs.CSeq, nil
+}
+
+func (hs *Headers) GetMaxForwards() (IntegerHeader, error) {
+	if hs.MaxForwards == nil {
+		return IntegerHeader{}, ErrHeaderNotExists
+	}
+	return *hs.MaxForwards, nil
+}
+
+func (hs *Headers) GetAuthorization() (Authorization, error) {
+	if hs.Authorization == nil {
+		return Authorization{}, ErrHeaderNotExists
+	}
+	return *hs.Authorization, nil
+}
+
+// GetHostLoginByFrom returns host and login of the From URI
+func (hs *Headers) GetHostLoginByFrom() (string, string, error) {
+	if hs.From == nil {
+		return "", "", ErrHeaderNotExists
+	}
+	return hs.From.Address.URI.Host, hs.From.Address.URI.Login, nil
+}
+
+// AddWarning appends Warning with quoted text (RFC 3261 20.43)
+// Warning: 399 atlanta.com "Missing mandatory header: CSeq"
+func (hs *Headers) AddWarning(code int, agent, text string) {
+	hs.Append("Warning", fmt.Sprintf("%d %s %s", code, agent, quote(text)))
+}
+
+// Get returns values of all extension headers with the name in received order
+func (hs *Headers) Get(name string) []string {
+	name = CanonicalHeaderName(name)
+	values := make([]string, 0)
+	for _, eh := range hs.Extensions {
+		if strings.EqualFold(eh.Name, name) {
+			values = append(values, eh.Value)
+		}
+	}
+	return values
+}
+
+func (hs *Headers) GetFirst(name string) (string, error) {
+	if values := hs.Get(name); len(values) == 0 {
+		return "", ErrHeaderNotExists
+	} else {
+		return values[0], nil
+	}
+}
+
+// Set replaces all extension headers with the name by single value,
+// keeping position of the first one.
+func (hs *Headers) Set(name, value string) {
+	name = CanonicalHeaderName(name)
+	for i, eh := range hs.Extensions {
+		if strings.EqualFold(eh.Name, name) {
+			hs.Extensions[i].Value = value
+			hs.removeFrom(name, i+1)
+			return
+		}
+	}
+	hs.Append(name, value)
+}
+
+func (hs *Headers) Append(name, value string) {
+	hs.Extensions = append(hs.Extensions, ExtensionHeader{
+		Name:  CanonicalHeaderName(name),
+		Value: value,
+	})
+}
+
+func (hs *Headers) Remove(name string) {
+	hs.removeFrom(CanonicalHeaderName(name), 0)
+}
+
+func (hs *Headers) removeFrom(name string, from int) {
+	extensions := hs.Extensions[:from]
+	for _, eh := range hs.Extensions[from:] {
+		if !strings.EqualFold(eh.Name, name) {
+			extensions = append(extensions, eh)
+		}
+	}
+	hs.Extensions = extensions
 }
 
 func (hs *Headers) Encode() []byte {
@@ -420,6 +1064,18 @@ func (hs *Headers) Encode() []byte {
 		}
 	}
 
+	for _, route := range hs.Routes {
+		buffer.WriteString("Route: ")
+		buffer.WriteString(route.String())
+		buffer.WriteString("\r\n")
+	}
+
+	for _, route := range hs.RecordRoutes {
+		buffer.WriteString("Record-Route: ")
+		buffer.WriteString(route.String())
+		buffer.WriteString("\r\n")
+	}
+
 	if hs.From != nil {
 		buffer.WriteString("From: ")
 		buffer.WriteString(hs.From.String())
@@ -452,6 +1108,30 @@ func (hs *Headers) Encode() []byte {
 		buffer.WriteString("\r\n")
 	}
 
+	if hs.RSeq != nil {
+		buffer.WriteString("RSeq: ")
+		buffer.WriteString(hs.RSeq.String())
+		buffer.WriteString("\r\n")
+	}
+
+	if hs.RAck != nil {
+		buffer.WriteString("RAck: ")
+		buffer.WriteString(hs.RAck.String())
+		buffer.WriteString("\r\n")
+	}
+
+	if hs.SessionExpires != nil {
+		buffer.WriteString("Session-Expires: ")
+		buffer.WriteString(hs.SessionExpires.String())
+		buffer.WriteString("\r\n")
+	}
+
+	if hs.MinSE != nil {
+		buffer.WriteString("Min-SE: ")
+		buffer.WriteString(hs.MinSE.String())
+		buffer.WriteString("\r\n")
+	}
+
 	if hs.Allows != nil {
 		rawAllows := make([]string, 0)
 		for _, allow := range hs.Allows {
@@ -462,12 +1142,23 @@ func (hs *Headers) Encode() []byte {
 		buffer.WriteString("\r\n")
 	}
 
+	writeOptionTags(&buffer, "Supported", hs.Supported)
+	writeOptionTags(&buffer, "Require", hs.Require)
+	writeOptionTags(&buffer, "Proxy-Require", hs.ProxyRequire)
+	writeOptionTags(&buffer, "Unsupported", hs.Unsupported)
+
 	if hs.MaxForwards != nil {
 		buffer.WriteString("Max-Forwards: ")
 		buffer.WriteString(hs.MaxForwards.String())
 		buffer.WriteString("\r\n")
 	}
 
+	if hs.Expires != nil {
+		buffer.WriteString("Expires: ")
+		buffer.WriteString(hs.Expires.String())
+		buffer.WriteString("\r\n")
+	}
+
 	if hs.WWWAuthenticate != nil {
 		buffer.WriteString("WWW-Authenticate: ")
 		buffer.WriteString(hs.WWWAuthenticate.String())
@@ -480,8 +1171,23 @@ func (hs *Headers) Encode() []byte {
 		buffer.WriteString("\r\n")
 	}
 
-	hs.ContentLength = &IntegerHeader{
-		Value: 0,
+	for _, eh := range hs.Extensions {
+		buffer.WriteString(eh.Name)
+		buffer.WriteString(": ")
+		buffer.WriteString(eh.String())
+		buffer.WriteString("\r\n")
+	}
+
+	if hs.ContentType != nil {
+		buffer.WriteString("Content-Type: ")
+		buffer.WriteString(hs.ContentType.String())
+		buffer.WriteString("\r\n")
+	}
+
+	if hs.ContentLength == nil {
+		hs.ContentLength = &IntegerHeader{
+			Value: 0,
+		}
 	}
 	buffer.WriteString("Content-Length: ")
 	buffer.WriteString(hs.ContentLength.String())
@@ -490,78 +1196,176 @@ func (hs *Headers) Encode() []byte {
 	return buffer.Bytes()
 }
 
+// MANDATORY_HEADERS are needed to process any request, malformed one is
+// answered 400 and the others are ignored (RFC 3261 8.1.1, 8.2.2)
+var MANDATORY_HEADERS = map[string]bool{
+	"Via":            true,
+	"From":           true,
+	"To":             true,
+	"Call-ID":        true,
+	"CSeq":           true,
+	"Max-Forwards":   true,
+	"Content-Length": true,
+}
+
+// DecodeHeaders decodes every header it can, the first malformed one is
+// returned as HeaderParseError along with the rest, one of
+// MANDATORY_HEADERS before the others (RFC 3261 21.4.1)
 func DecodeHeaders(lines []string) (*Headers, error) {
 	hs := &Headers{
 		Vias: make([]Via, 0),
 	}
-	for _, line := range lines {
-		key, rhs := prepareHeader(line)
+	var first, mandatory error
+	for _, line := range unfoldLines(lines) {
+		key, value := separateHeaderLine(line)
+		if key == "" {
+			continue
+		} else if !TYPED_HEADERS[key] {
+			hs.Append(key, strings.TrimSpace(value))
+			continue
+		}
+
+		rhs, err := tokenizeHeader(key, strings.TrimSpace(value))
 		for _, rh := range rhs {
+			if decodeErr := hs.decodeHeader(key, rh); decodeErr != nil && err == nil {
+				err = &HeaderParseError{key, strings.TrimSpace(value), decodeErr}
+			}
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+		if err != nil && mandatory == nil && MANDATORY_HEADERS[key] {
+			mandatory = err
+		}
+	}
+	if mandatory != nil {
+		return hs, mandatory
+	}
+	return hs, first
+}
+
+// decodeHeader sets typed field of key by rh
+func (hs *Headers) decodeHeader(key string, rh RawHeader) error {
+	switch key {
+	case "Via":
+		if via, err := decodeVia(rh); err != nil {
+			return err
+		} else {
+			hs.Vias = append(hs.Vias, via)
+		}
+	case "Route", "Record-Route":
+		if route, err := decodeRoute(rh); err != nil {
+			return err
+		} else {
+			switch key {
+			case "Route":
+				hs.Routes = append(hs.Routes, route)
+			case "Record-Route":
+				hs.RecordRoutes = append(hs.RecordRoutes, route)
+			}
+		}
+	case "From", "To":
+		if dist, err := decodeDestinations(rh); err != nil {
+			return err
+		} else {
+			switch key {
+			case "From":
+				hs.From = &dist
+			case "To":
+				hs.To = &dist
+			}
+		}
+	case "Max-Forwards", "Content-Length", "RSeq", "Min-SE", "Expires":
+		if h, err := decodeIntegerHeader(rh); err != nil {
+			return err
+		} else {
+			switch key {
+			case "Max-Forwards":
+				hs.MaxForwards = &h
+			case "Content-Length":
+				hs.ContentLength = &h
+			case "RSeq":
+				hs.RSeq = &h
+			case "Min-SE":
+				hs.MinSE = &h
+			case "Expires":
+				hs.Expires = &h
+			}
+		}
+	case "Call-ID", "Content-Type":
+		if h, err := decodePlainHeader(rh); err != nil {
+			return err
+		} else {
 			switch key {
-			case "Via":
-				if via, err := decodeVia(rh); err != nil {
-					hs.Vias = append(hs.Vias, via)
-				}
-			case "From", "To":
-				if dist, err := decodeDestinations(rh); err != nil {
-					return nil, err
-				} else {
-					switch key {
-					case "From":
-						hs.From = &dist
-					case "To":
-						hs.To = &dist
-					}
-				}
-			case "Max-Forwards", "Content-Length":
-				if h, err := decodeIntegerHeader(rh); err != nil {
-					return nil, err
-				} else {
-					switch key {
-					case "Max-Forwards":
-						hs.MaxForwards = &h
-					case "Content-Length":
-						hs.ContentLength = &h
-					}
-				}
 			case "Call-ID":
-				if h, err := decodePlainHeader(rh); err != nil {
-					return nil, err
-				} else {
-					hs.CallID = &h
-				}
-			case "Contact":
-				if contact, err := decodeContact(rh); err != nil {
-					return nil, err
-				} else {
-					hs.Contacts = append(hs.Contacts, contact)
-				}
-			case "CSeq":
-				if cseq, err := decodeCSeq(rh); err != nil {
-					return nil, err
-				} else {
-					hs.CSeq = &cseq
-				}
-			case "Allow":
-				if allow, err := decodeAllow(rh); err != nil {
-					return nil, err
-				} else {
-					hs.Allows = append(hs.Allows, allow)
-				}
-			case "Authorization":
-				if auth, err := decodeAuthorization(rh); err != nil {
-					return nil, err
-				} else {
-					hs.Authorization = &auth
-				}
-			case "WWW-Authenticate":
-				if wwwauth, err := decodeWWWAuthenticate(rh); err != nil {
-					return nil, err
-				} else {
-					hs.WWWAuthenticate = &wwwauth
-				}
+				hs.CallID = &h
+			case "Content-Type":
+				hs.ContentType = &h
 			}
 		}
+	case "Contact":
+		if contact, err := decodeContact(rh); err != nil {
+			return err
+		} else {
+			hs.Contacts = append(hs.Contacts, contact)
+		}
+	case "CSeq":
+		if cseq, err := decodeCSeq(rh); err != nil {
+			return err
+		} else {
+			hs.CSeq = &cseq
+		}
+	case "RAck":
+		if rack, err := decodeRAck(rh); err != nil {
+			return err
+		} else {
+			hs.RAck = &rack
+		}
+	case "Session-Expires":
+		if se, err := decodeSessionExpires(rh); err != nil {
+			return err
+		} else {
+			hs.SessionExpires = &se
+		}
+	case "Allow":
+		if allow, err := decodeAllow(rh); err != nil {
+			return err
+		} else {
+			hs.Allows = append(hs.Allows, allow)
+		}
+	case "Supported", "Require", "Proxy-Require", "Unsupported":
+		if tag, err := decodeOptionTag(rh); err != nil {
+			return err
+		} else {
+			switch key {
+			case "Supported":
+				hs.Supported = append(hs.Supported, tag)
+			case "Require":
+				hs.Require = append(hs.Require, tag)
+			case "Proxy-Require":
+				hs.ProxyRequire = append(hs.ProxyRequire, tag)
+			case "Unsupported":
+				hs.Unsupported = append(hs.Unsupported, tag)
+			}
+		}
+	case "Authorization":
+		if auth, err := decodeAuthorization(rh); err != nil {
+			return err
+		} else {
+			hs.Authorization = &auth
+		}
+	case "WWW-Authenticate":
+		if wwwauth, err := decodeWWWAuthenticate(rh); err != nil {
+			return err
+		} else {
+			hs.WWWAuthenticate = &wwwauth
+		}
+	}
+	return nil
+}
+
+func NewHeaders() Headers {
+	return Headers{
+		Vias: make([]Via, 0),
 	}
-	return hs, nil
 }
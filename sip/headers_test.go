@@ -0,0 +1,205 @@
+package sip_test
+
+import (
+	"errors"
+	"signal/sip"
+	"strings"
+	"testing"
+)
+
+var URIS = []string{
+	"sip:alice@atlanta.com",
+	"sip:alice:secretword@atlanta.com;transport=tcp",
+	"sips:alice@atlanta.com?subject=project%20x&priority=urgent",
+	"sip:+1-212-555-1212:1234@gateway.com;user=phone",
+	"sips:1212@gateway.com",
+	"sip:alice@192.0.2.4",
+	"sip:atlanta.com;method=REGISTER?to=alice%40atlanta.com",
+	"sip:alice;day=tuesday@atlanta.com",
+	"sip:alice@[2001:db8::10]:5070;maddr=239.255.255.1;ttl=15",
+	"sip:p1.example.com;lr",
+	"sip:user@10.0.0.1:5060;transport=tcp;ob",
+	"tel:+1-201-555-0123",
+	"tel:7042;phone-context=example.com",
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestURI$ signal/sip
+func TestURI(t *testing.T) {
+	for _, raw := range URIS {
+		if uri, err := sip.DecodeURI(raw); err != nil {
+			t.Errorf("%s: %s", raw, err)
+		} else if uri.String() != raw {
+			t.Errorf("%s != %s", uri.String(), raw)
+		}
+	}
+
+	if uri, err := sip.DecodeURI("sip:alice%20smith:pass@[2001:db8::10]:5070;user=phone;lr?subject=a%26b"); err != nil {
+		t.Error(err)
+	} else if uri.Login != "alice smith" || uri.Password != "pass" {
+		t.Errorf("Userinfo not unescaped: %s %s", uri.Login, uri.Password)
+	} else if uri.Hostname() != "2001:db8::10" || uri.Port() != 5070 {
+		t.Errorf("IPv6 host not decoded: %s %d", uri.Hostname(), uri.Port())
+	} else if uri.User != "phone" || !uri.LR {
+		t.Error("Parameters not decoded")
+	} else if len(uri.Headers) != 1 || uri.Headers[0].Value != "a&b" {
+		t.Errorf("Headers not decoded: %v", uri.Headers)
+	}
+
+	if uri, err := sip.DecodeURI("tel:+1-201-555-0123;phone-context=example.com"); err != nil {
+		t.Error(err)
+	} else if uri.Scheme != sip.TEL_SCHEME || uri.Login != "+1-201-555-0123" {
+		t.Errorf("tel URI not decoded: %s %s", uri.Scheme, uri.Login)
+	}
+
+	if _, err := sip.DecodeURI("http://example.com"); err != sip.ErrUnsupportedURIScheme {
+		t.Error("http URI accepted")
+	}
+
+	if address, err := sip.DecodeTarget("\"Bob\" <sips:bob@biloxi.com;user=phone>"); err != nil {
+		t.Error(err)
+	} else if address.Name != "Bob" || address.URI.Scheme != sip.SIPS_SCHEME || address.URI.User != "phone" {
+		t.Errorf("Address not decoded: %s", address)
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestTokenizer$ signal/sip
+func TestTokenizer(t *testing.T) {
+	lines := []string{
+		`From: "Doe, John; Jr." <sip:john@foo.bar.com;transport=udp>;tag=a48s`,
+		`Contact: "Mr. \"Watson\"" <sip:watson@worcester.com>;q=0.7, <sip:watson@bell.com>;description="a=b;c"`,
+		`Authorization: Digest username="Alice", realm="atlanta.com", nonce="84a4cc6f", uri="sip:bob@biloxi.com;transport=udp", response="7587245234b"`,
+	}
+	if hs, err := sip.DecodeHeaders(lines); err != nil {
+		t.Error(err)
+	} else {
+		if hs.From.Address.Name != "Doe, John; Jr." || hs.From.Tag != "a48s" {
+			t.Errorf("From not decoded: %s", hs.From)
+		} else if hs.From.Address.URI.Transport != "udp" {
+			t.Error("From URI transport != udp")
+		}
+
+		if len(hs.Contacts) != 2 {
+			t.Errorf("Contacts count %d != 2", len(hs.Contacts))
+		} else if hs.Contacts[0].Address.Name != "Mr. \"Watson\"" || hs.Contacts[0].Q != 0.7 {
+			t.Errorf("Contact not decoded: %s", hs.Contacts[0])
+		}
+
+		if hs.Authorization == nil {
+			t.Error("Authorization not decoded")
+		} else if hs.Authorization.URI != "sip:bob@biloxi.com;transport=udp" || hs.Authorization.Response != "7587245234b" {
+			t.Errorf("Authorization not decoded: %v", *hs.Authorization)
+		}
+	}
+
+	var perr *sip.HeaderParseError
+	if _, err := sip.DecodeHeaders([]string{`To: "Bob <sip:bob@biloxi.com>`}); !errors.As(err, &perr) || perr.Header != "To" || perr.Err != sip.ErrUnclosedQuote {
+		t.Errorf("Unclosed quote not reported: %v", err)
+	}
+	if _, err := sip.DecodeHeaders([]string{`Authorization: username="Alice"`}); !errors.As(err, &perr) || perr.Err != sip.ErrMissingAuthScheme {
+		t.Errorf("Missing auth scheme not reported: %v", err)
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestOptionTags$ signal/sip
+func TestOptionTags(t *testing.T) {
+	lines := []string{
+		"CSeq: 1 INVITE",
+		"k: 100rel, timer",
+		"Require: 100rel",
+		"Proxy-Require: foo",
+	}
+	if hs, err := sip.DecodeHeaders(lines); err != nil {
+		t.Error(err)
+	} else if len(hs.Supported) != 2 || hs.Supported[1] != sip.OPTION_TIMER {
+		t.Errorf("Supported not decoded: %v", hs.Supported)
+	} else {
+		req := sip.NewRequest(sip.INVITE, "", sip.URI{}, *hs)
+		if unsupported := req.UnsupportedOptions([]sip.OptionTag{sip.OPTION_100REL}); len(unsupported) != 1 || unsupported[0] != "foo" {
+			t.Errorf("Unsupported != [foo], got %v", unsupported)
+		}
+
+		req.Method = sip.CANCEL
+		if unsupported := req.UnsupportedOptions(nil); len(unsupported) != 0 {
+			t.Errorf("CANCEL rejected for extensions: %v", unsupported)
+		}
+
+		hs.Unsupported = []sip.OptionTag{"foo"}
+		if encoded := string(hs.Encode()); !strings.Contains(encoded, "Supported: 100rel, timer\r\nRequire: 100rel\r\nProxy-Require: foo\r\nUnsupported: foo\r\n") {
+			t.Errorf("Option tags not encoded: %s", encoded)
+		}
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestReliableProvisional$ signal/sip
+func TestReliableProvisional(t *testing.T) {
+	lines := []string{
+		"CSeq: 2 PRACK",
+		"RSeq: 988789",
+		"RAck: 776656 1 INVITE",
+		"Require: 100rel",
+	}
+	if hs, err := sip.DecodeHeaders(lines); err != nil {
+		t.Error(err)
+	} else if hs.RSeq == nil || hs.RSeq.Value != 988789 {
+		t.Errorf("RSeq not decoded: %v", hs.RSeq)
+	} else if hs.RAck == nil || *hs.RAck != (sip.RAck{RSeq: 776656, CSeq: 1, Method: sip.INVITE}) {
+		t.Errorf("RAck not decoded: %v", hs.RAck)
+	} else if !hs.IsRequired(sip.OPTION_100REL) || !hs.IsSupported(sip.OPTION_100REL) || hs.IsSupported(sip.OPTION_TIMER) {
+		t.Errorf("Option tags %v %v", hs.Supported, hs.Require)
+	} else if encoded := string(hs.Encode()); !strings.Contains(encoded, "RSeq: 988789\r\nRAck: 776656 1 INVITE\r\n") {
+		t.Errorf("RSeq and RAck not encoded: %s", encoded)
+	}
+
+	if _, err := sip.DecodeHeaders([]string{"RAck: 776656 INVITE"}); err == nil {
+		t.Errorf("RAck without CSeq decoded")
+	}
+
+	// header names are case-insensitive (RFC 3261 7.3.1)
+	if hs, err := sip.DecodeHeaders([]string{"rseq: 988790", "RACK: 988789 1 INVITE"}); err != nil {
+		t.Error(err)
+	} else if hs.RSeq == nil || hs.RSeq.Value != 988790 || hs.RAck == nil || hs.RAck.RSeq != 988789 {
+		t.Errorf("Lowercase RSeq and RAck not decoded: %v %v", hs.RSeq, hs.RAck)
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestSessionTimer$ signal/sip
+func TestSessionTimer(t *testing.T) {
+	lines := []string{
+		"CSeq: 1 INVITE",
+		"x: 1800;refresher=uas",
+		"Min-SE: 90",
+	}
+	if hs, err := sip.DecodeHeaders(lines); err != nil {
+		t.Error(err)
+	} else if hs.SessionExpires == nil || *hs.SessionExpires != (sip.SessionExpires{Delta: 1800, Refresher: sip.REFRESHER_UAS}) {
+		t.Errorf("Session-Expires not decoded: %v", hs.SessionExpires)
+	} else if hs.MinSE == nil || hs.MinSE.Value != 90 {
+		t.Errorf("Min-SE not decoded: %v", hs.MinSE)
+	} else if encoded := string(hs.Encode()); !strings.Contains(encoded, "Session-Expires: 1800;refresher=uas\r\nMin-SE: 90\r\n") {
+		t.Errorf("Session timer not encoded: %s", encoded)
+	}
+
+	if hs, err := sip.DecodeHeaders([]string{"Session-Expires: 4000"}); err != nil {
+		t.Error(err)
+	} else if hs.SessionExpires.Refresher != "" || hs.SessionExpires.String() != "4000" {
+		t.Errorf("Session-Expires without refresher %v", hs.SessionExpires)
+	}
+
+	if hs, err := sip.DecodeHeaders([]string{"min-se: 120"}); err != nil {
+		t.Error(err)
+	} else if hs.MinSE == nil || hs.MinSE.Value != 120 {
+		t.Errorf("Lowercase Min-SE not decoded: %v", hs.MinSE)
+	}
+}
+
+// go test -fuzz=FuzzDecodeURI -fuzztime 60s -run ^$ signal/sip
+func FuzzDecodeURI(f *testing.F) {
+	for _, raw := range URIS {
+		f.Add(raw)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		if uri, err := sip.DecodeURI(raw); err == nil {
+			_ = uri.String()
+		}
+	})
+}
@@ -2,6 +2,7 @@ package sip
 
 import (
 	"net"
+	"signal/sdp"
 
 	"github.com/spf13/viper"
 )
@@ -14,6 +15,8 @@ func init() {
 	PROTOCOL = viper.GetString("server.transport")
 }
 
+const SDP_CONTENT_TYPE = "application/sdp"
+
 type Message interface {
 	GetRawBody() string
 	Data() []byte
@@ -22,21 +25,75 @@ type Message interface {
 	GetRecipientAddrs() []string
 }
 
-func NewMessage(p *Parser, addr net.Addr) (Message, error) {
-	if m, err := p.Parse(); err != nil {
+func NewMessage(b []byte, addr net.Addr) (Message, error) {
+	m, err := Decode(b)
+	switch r := m.(type) {
+	case Request:
+		r.SourceAddres = addr
+		return r, err
+	case Response:
+		r.SourceAddres = addr
+		return r, err
+	default:
 		return nil, err
+	}
+}
+
+func isSDP(hs *Headers) bool {
+	return isSDPPart(hs.ContentType)
+}
+
+// decodeBody fills SDP from application/sdp body or from the first
+// application/sdp part of multipart body.
+func decodeBody(hs *Headers, body []byte) (sdp.SDP, []BodyPart, error) {
+	var parts []BodyPart
+	if len(body) == 0 {
+		return sdp.SDP{}, nil, nil
+	} else if isMultipart(hs.ContentType) {
+		if decoded, err := decodeMultipart(hs.ContentType, body); err != nil {
+			return sdp.SDP{}, nil, err
+		} else {
+			parts = decoded
+			body = findSDPPart(parts)
+		}
+	} else if !isSDP(hs) {
+		return sdp.SDP{}, nil, nil
+	}
+
+	if len(body) == 0 {
+		return sdp.SDP{}, parts, nil
+	} else if s, err := sdp.DecodeSDP(string(body)); err != nil {
+		return sdp.SDP{}, nil, err
 	} else {
-		switch m.(type) {
-		case Request:
-			r := m.(Request)
-			r.SourceAddres = addr
-			return r, nil
-		case Response:
-			r := m.(Response)
-			r.SourceAddres = addr
-			return r, nil
-		default:
-			return nil, nil
+		return *s, parts, nil
+	}
+}
+
+// encodeBody returns body to send and sets Content-Type and Content-Length
+// to match it. Parts and SDP are encoded only when no raw body was set,
+// SDP goes to empty application/sdp part when there are parts.
+func encodeBody(hs *Headers, body []byte, s *sdp.SDP, parts []BodyPart) []byte {
+	if len(body) == 0 && len(parts) != 0 {
+		var sdpBody []byte
+		if s.Origin != nil {
+			sdpBody = []byte(s.Encode())
 		}
+		ct := PlainHeader{
+			Value: MULTIPART_MIXED,
+		}
+		if isMultipart(hs.ContentType) {
+			ct = *hs.ContentType
+		}
+		ct, body = encodeMultipart(ct, parts, sdpBody)
+		hs.ContentType = &ct
+	} else if len(body) == 0 && s.Origin != nil {
+		body = []byte(s.Encode())
+		hs.ContentType = &PlainHeader{
+			Value: SDP_CONTENT_TYPE,
+		}
+	}
+	hs.ContentLength = &IntegerHeader{
+		Value: len(body),
 	}
+	return body
 }
@@ -0,0 +1,197 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	MULTIPART_MIXED       = "multipart/mixed"
+	MULTIPART_ALTERNATIVE = "multipart/alternative"
+)
+
+var ErrMissingBoundary = errors.New("multipart boundary missing")
+var ErrUnclosedMultipart = errors.New("multipart body is not closed")
+
+// BodyPart of multipart body (RFC 5621), nested multipart parts are
+// decoded into Parts.
+// Content-Type: application/sdp
+// Content-Disposition: session;handling=required
+// Content-ID: <sdp@atlanta.com>
+type BodyPart struct {
+	ContentType        *PlainHeader
+	ContentDisposition *PlainHeader
+	ContentID          string
+	Extensions         []ExtensionHeader
+	Body               []byte
+	Parts              []BodyPart
+}
+
+func (bp BodyPart) Encode() []byte {
+	var buffer bytes.Buffer
+	if bp.ContentType != nil {
+		buffer.WriteString("Content-Type: ")
+		buffer.WriteString(bp.ContentType.String())
+		buffer.WriteString("\r\n")
+	}
+	if bp.ContentDisposition != nil {
+		buffer.WriteString("Content-Disposition: ")
+		buffer.WriteString(bp.ContentDisposition.String())
+		buffer.WriteString("\r\n")
+	}
+	if bp.ContentID != "" {
+		buffer.WriteString("Content-ID: ")
+		buffer.WriteString(bp.ContentID)
+		buffer.WriteString("\r\n")
+	}
+	for _, eh := range bp.Extensions {
+		buffer.WriteString(eh.Name)
+		buffer.WriteString(": ")
+		buffer.WriteString(eh.String())
+		buffer.WriteString("\r\n")
+	}
+	buffer.WriteString("\r\n")
+	buffer.Write(bp.Body)
+	return buffer.Bytes()
+}
+
+func isMultipart(ct *PlainHeader) bool {
+	return ct != nil && strings.HasPrefix(strings.ToLower(strings.TrimSpace(ct.Value)), "multipart/")
+}
+
+func isSDPPart(ct *PlainHeader) bool {
+	return ct != nil && strings.EqualFold(strings.TrimSpace(ct.Value), SDP_CONTENT_TYPE)
+}
+
+// findSDPPart returns body of the first application/sdp part, nested parts included
+func findSDPPart(parts []BodyPart) []byte {
+	for _, part := range parts {
+		if isSDPPart(part.ContentType) {
+			return part.Body
+		} else if b := findSDPPart(part.Parts); b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+func decodeBodyPart(b []byte) (BodyPart, error) {
+	var part BodyPart
+	var lines []string
+	if bytes.HasPrefix(b, []byte("\r\n")) {
+		part.Body = b[2:]
+	} else if bytes.HasPrefix(b, []byte("\n")) {
+		part.Body = b[1:]
+	} else {
+		lines, part.Body = splitMessage(b)
+	}
+
+	if hs, err := DecodeHeaders(lines); err != nil {
+		return BodyPart{}, err
+	} else {
+		part.ContentType = hs.ContentType
+		for _, eh := range hs.Extensions {
+			switch {
+			case strings.EqualFold(eh.Name, "Content-Disposition"):
+				if rhs, err := tokenizeHeader(eh.Name, eh.Value); err != nil {
+					return BodyPart{}, err
+				} else if len(rhs) > 0 {
+					disposition := PlainHeader(rhs[0])
+					part.ContentDisposition = &disposition
+				}
+			case strings.EqualFold(eh.Name, "Content-ID"):
+				part.ContentID = eh.Value
+			default:
+				part.Extensions = append(part.Extensions, eh)
+			}
+		}
+	}
+
+	if isMultipart(part.ContentType) {
+		if parts, err := decodeMultipart(part.ContentType, part.Body); err != nil {
+			return BodyPart{}, err
+		} else {
+			part.Parts = parts
+		}
+	}
+	return part, nil
+}
+
+// decodeMultipart splits body by boundary of Content-Type (RFC 2046 5.1.1),
+// preamble and epilogue are dropped.
+func decodeMultipart(ct *PlainHeader, body []byte) ([]BodyPart, error) {
+	boundary := ct.Properties["boundary"]
+	if boundary == "" {
+		return nil, ErrMissingBoundary
+	}
+	delimiter := []byte("--" + boundary)
+
+	i := bytes.Index(body, delimiter)
+	if i == -1 {
+		return nil, ErrUnclosedMultipart
+	}
+	body = body[i+len(delimiter):]
+
+	parts := make([]BodyPart, 0)
+	for !bytes.HasPrefix(body, []byte("--")) {
+		// transport padding after the delimiter
+		if j := bytes.IndexByte(body, '\n'); j == -1 {
+			return nil, ErrUnclosedMultipart
+		} else {
+			body = body[j+1:]
+		}
+
+		j := bytes.Index(body, append([]byte("\n"), delimiter...))
+		if j == -1 {
+			return nil, ErrUnclosedMultipart
+		}
+		content := body[:j]
+		content = bytes.TrimSuffix(content, []byte("\r"))
+		body = body[j+1+len(delimiter):]
+
+		if part, err := decodeBodyPart(content); err != nil {
+			return nil, err
+		} else {
+			parts = append(parts, part)
+		}
+	}
+	return parts, nil
+}
+
+// encodeMultipart writes parts with boundary of Content-Type and returns
+// Content-Type with generated boundary when it had none. Empty
+// application/sdp parts get sdpBody.
+func encodeMultipart(ct PlainHeader, parts []BodyPart, sdpBody []byte) (PlainHeader, []byte) {
+	boundary := ct.Properties["boundary"]
+	if boundary == "" {
+		boundary = uuid.NewString()
+		props := map[string]string{"boundary": boundary}
+		for key, value := range ct.Properties {
+			props[key] = value
+		}
+		ct.Properties = props
+	}
+
+	var buffer bytes.Buffer
+	for _, part := range parts {
+		if len(part.Body) == 0 && isSDPPart(part.ContentType) {
+			part.Body = sdpBody
+		} else if len(part.Body) == 0 && isMultipart(part.ContentType) {
+			var partCT PlainHeader
+			partCT, part.Body = encodeMultipart(*part.ContentType, part.Parts, sdpBody)
+			part.ContentType = &partCT
+		}
+		buffer.WriteString("--")
+		buffer.WriteString(boundary)
+		buffer.WriteString("\r\n")
+		buffer.Write(part.Encode())
+		buffer.WriteString("\r\n")
+	}
+	buffer.WriteString("--")
+	buffer.WriteString(boundary)
+	buffer.WriteString("--\r\n")
+	return ct, buffer.Bytes()
+}
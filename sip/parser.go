@@ -1,7 +1,9 @@
 package sip
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -12,170 +14,480 @@ var HEADERS_ORDER = []string{
 	"Via",
 }
 
-type Line struct {
-	Value      string
-	Properties map[string]string
+// RFC 3261 7.3.3 and extensions registered with IANA
+var COMPACT_HEADERS = map[string]string{
+	"a": "Accept-Contact",
+	"b": "Referred-By",
+	"c": "Content-Type",
+	"d": "Request-Disposition",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"j": "Reject-Contact",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"n": "Identity-Info",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"t": "To",
+	"u": "Allow-Events",
+	"v": "Via",
+	"x": "Session-Expires",
+	"y": "Identity",
 }
 
-func ParseLine(v string) []Line {
-	lines := make([]Line, 0)
+var KNOWN_HEADERS = []string{
+	"Accept",
+	"Accept-Contact",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Alert-Info",
+	"Allow",
+	"Allow-Events",
+	"Authentication-Info",
+	"Authorization",
+	"Call-ID",
+	"Call-Info",
+	"Contact",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-ID",
+	"Content-Language",
+	"Content-Length",
+	"Content-Type",
+	"CSeq",
+	"Date",
+	"Error-Info",
+	"Event",
+	"Expires",
+	"From",
+	"Identity",
+	"Identity-Info",
+	"In-Reply-To",
+	"Max-Forwards",
+	"Min-Expires",
+	"Min-SE",
+	"MIME-Version",
+	"Organization",
+	"Priority",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Require",
+	"Record-Route",
+	"Refer-To",
+	"Referred-By",
+	"Reject-Contact",
+	"Reply-To",
+	"Request-Disposition",
+	"Require",
+	"Retry-After",
+	"RAck",
+	"Route",
+	"RSeq",
+	"Server",
+	"Session-Expires",
+	"Subject",
+	"Supported",
+	"Timestamp",
+	"To",
+	"Unsupported",
+	"User-Agent",
+	"Via",
+	"Warning",
+	"WWW-Authenticate",
+}
 
-	parts := strings.Split(v, ",")
-	for _, p := range parts {
-		rawl := strings.Split(p, ";")
-		l := Line{
-			Value: rawl[0],
-		}
-		if len(rawl[1:]) > 0 {
-			props := make(map[string]string)
-			for _, prop := range rawl[1:] {
-				if strings.Count(prop, "=") > 0 {
-					propParts := strings.Split(prop, "=")
-					propKey := propParts[0]
-					propValue := strings.Trim(propParts[1], " \"")
-					props[propKey] = propValue
-				} else {
-					props[prop] = ""
-				}
+var knownHeaders = make(map[string]string)
+var canonicalHeaders = make(map[string]bool)
+
+func init() {
+	for _, name := range KNOWN_HEADERS {
+		knownHeaders[strings.ToLower(name)] = name
+		canonicalHeaders[name] = true
+	}
+}
+
+// CanonicalHeaderName maps compact and case-insensitive header names
+// to the long form used by Headers. Unknown names are returned as is.
+func CanonicalHeaderName(name string) string {
+	name = strings.TrimSpace(name)
+	if canonicalHeaders[name] {
+		return name
+	}
+	lower := strings.ToLower(name)
+	if long, ok := COMPACT_HEADERS[lower]; ok {
+		return long
+	} else if known, ok := knownHeaders[lower]; ok {
+		return known
+	}
+	return name
+}
+
+// unfoldLines joins header lines continued with leading whitespace
+// (RFC 3261 7.3.1). Lines after the first empty one belong to the body
+// and are left untouched.
+func unfoldLines(lines []string) []string {
+	if !hasFoldedLines(lines) {
+		return lines
+	}
+	unfolded := make([]string, 0, len(lines))
+	inBody := false
+	for _, line := range lines {
+		if n := len(unfolded); !inBody && n > 0 && isFoldedLine(line) {
+			unfolded[n-1] = strings.TrimRight(unfolded[n-1], " \t") + " " + strings.TrimLeft(line, " \t")
+		} else {
+			if line == "" {
+				inBody = true
 			}
-			l.Properties = props
+			unfolded = append(unfolded, line)
 		}
-		lines = append(lines, l)
 	}
-	return lines
+	return unfolded
 }
 
-func ParseAuthorizationLine(v string) []Line {
-	value := strings.Split(v, "Digest")
-	parts := strings.Split(value[1], ",")
-	props := make(map[string]string)
-	l := Line{
-		Value: "",
-	}
-	for _, p := range parts {
-		if strings.Count(p, "=") > 0 {
-			propParts := strings.Split(p, "=")
-			propKey := propParts[0]
-			propValue := strings.Trim(propParts[1], " \"")
-			props[propKey] = propValue
+func isFoldedLine(line string) bool {
+	return line != "" && (line[0] == ' ' || line[0] == '\t')
+}
+
+func hasFoldedLines(lines []string) bool {
+	for i, line := range lines {
+		if line == "" {
+			return false
+		} else if i > 0 && isFoldedLine(line) {
+			return true
 		}
-		l.Properties = props
+	}
+	return false
+}
 
+func separateHeaderLine(line string) (string, string) {
+	i := strings.Index(line, ":")
+	if i == -1 {
+		return "", line
 	}
-	return []Line{l}
+	return CanonicalHeaderName(line[:i]), line[i+1:]
 }
 
-type Parser struct {
-	rawBody  string
-	rawLines []string
+// HeaderParseError reports malformed header value
+type HeaderParseError struct {
+	Header string
+	Value  string
+	Err    error
 }
 
-func (p *Parser) getFirstLine() string {
-	return p.rawLines[0]
+func (e *HeaderParseError) Error() string {
+	return fmt.Sprintf("header \"%s\" parse error: %s. header value is: %s", e.Header, e.Err, e.Value)
 }
 
-func (p *Parser) IsRequest() bool {
-	parts := strings.Split(p.getFirstLine(), " ")
-	return parts[0] != "SIP/2.0"
+func (e *HeaderParseError) Unwrap() error {
+	return e.Err
 }
 
-func (p *Parser) parseRequestLine() (MethodType, URI, error) {
-	fl := p.getFirstLine()
-	parts := strings.Split(fl, " ")
-	if len(parts) != 3 {
-		return INVITE, URI{}, ErrCantParseMessage
+var ErrUnclosedQuote = errors.New("unclosed quoted string")
+var ErrUnclosedBracket = errors.New("unclosed angle bracket")
+var ErrMissingAuthScheme = errors.New("missing auth scheme")
+
+// indexSeparator returns index of sep outside of quoted strings and <...>,
+// quoted-pair escapes are skipped (RFC 3261 25.1).
+func indexSeparator(v string, sep byte) (int, error) {
+	quoted, bracket := false, false
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"' && !bracket:
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			bracket = true
+		case c == '>':
+			bracket = false
+		case c == sep && !bracket:
+			return i, nil
+		}
 	}
-	m := strings.TrimSpace(parts[0])
-	rawURI := strings.TrimSpace(parts[1])
-	if uri, err := ParseURI(rawURI); err != nil {
-		return INVITE, URI{}, err
+	if quoted {
+		return -1, ErrUnclosedQuote
+	} else if bracket {
+		return -1, ErrUnclosedBracket
+	}
+	return -1, nil
+}
+
+// cutHeaderValue slices v around the first sep found by indexSeparator
+// without allocating, found is false when v is the last part.
+func cutHeaderValue(v string, sep byte) (string, string, bool, error) {
+	if i, err := indexSeparator(v, sep); err != nil {
+		return "", "", false, err
+	} else if i == -1 {
+		return v, "", false, nil
 	} else {
-		return MethodType(m), uri, nil
+		return v[:i], v[i+1:], true, nil
 	}
 }
 
-func (p *Parser) PrepareFields() map[string][]Line {
-	fields := make(map[string][]Line)
-	for _, rawLine := range p.rawLines[1:] {
-		if rawLine != "" && strings.Index(rawLine, "\n") == -1 {
-			lineKey, value := separateHeaderLine(rawLine)
+// indexOutsideQuotes returns index of the first c that is not in quoted string
+func indexOutsideQuotes(v string, c byte) int {
+	quoted := false
+	for i := 0; i < len(v); i++ {
+		switch {
+		case quoted && v[i] == '\\':
+			i++
+		case v[i] == '"':
+			quoted = !quoted
+		case !quoted && v[i] == c:
+			return i
+		}
+	}
+	return -1
+}
 
-			var lines = make([]Line, 0)
-			if lineKey != "Authorization" && lineKey != "WWW-Authenticate" {
-				lines = ParseLine(strings.TrimSpace(value))
-			} else {
-				lines = ParseAuthorizationLine(strings.TrimSpace(value))
-			}
+// unquote removes surrounding quotes and resolves quoted-pair escapes
+func unquote(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	v = v[1 : len(v)-1]
+	if strings.IndexByte(v, '\\') == -1 {
+		return v
+	}
+	var builder strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			i++
+		}
+		builder.WriteByte(v[i])
+	}
+	return builder.String()
+}
 
-			if len(lines) > 0 {
-				if fields[lineKey] == nil {
-					fields[lineKey] = lines
-				} else {
-					fields[lineKey] = append(fields[lineKey], lines...)
-				}
-			}
+func quote(v string) string {
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for i := 0; i < len(v); i++ {
+		if v[i] == '"' || v[i] == '\\' {
+			builder.WriteByte('\\')
 		}
+		builder.WriteByte(v[i])
 	}
+	builder.WriteByte('"')
+	return builder.String()
+}
 
-	return fields
+// token characters (RFC 3261 25.1) and IPv6 reference of gen-value
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("-.!%*_+`'~[]:", c) != -1
 }
 
-var ErrIsNotRequest = errors.New("is not request")
+// quoteParameter quotes parameter value that is not a token or host
+func quoteParameter(v string) string {
+	for i := 0; i < len(v); i++ {
+		if !isTokenChar(v[i]) {
+			return quote(v)
+		}
+	}
+	return v
+}
 
-func (p *Parser) ParseRequest() (Request, error) {
-	if !p.IsRequest() {
-		return Request{}, ErrIsNotRequest
+// parseParameters decodes sep separated key=value pairs, keys are
+// lowercased and quoted values unquoted. nil when there are none.
+func parseParameters(raw string, sep byte) (map[string]string, error) {
+	var props map[string]string
+	for more := raw != ""; more; {
+		var param string
+		var err error
+		if param, raw, more, err = cutHeaderValue(raw, sep); err != nil {
+			return nil, err
+		}
+		key, value, hasValue := strings.Cut(param, "=")
+		if key = strings.ToLower(strings.TrimSpace(key)); key == "" {
+			continue
+		} else if props == nil {
+			props = make(map[string]string)
+		}
+		if hasValue {
+			props[key] = unquote(strings.TrimSpace(value))
+		} else {
+			props[key] = ""
+		}
 	}
+	return props, nil
+}
 
-	if m, uri, err := p.parseRequestLine(); err != nil {
-		return Request{}, err
+// Authorization: Digest username="Alice", realm="atlanta.com", uri="sip:bob@biloxi.com;transport=udp"
+func tokenizeChallenge(key, value string) ([]RawHeader, error) {
+	scheme, rawParams := value, ""
+	if i := strings.IndexAny(value, " \t"); i != -1 {
+		scheme, rawParams = value[:i], value[i+1:]
+	}
+	if scheme == "" || strings.Contains(scheme, "=") {
+		return nil, &HeaderParseError{key, value, ErrMissingAuthScheme}
+	}
+	if props, err := parseParameters(rawParams, ','); err != nil {
+		return nil, &HeaderParseError{key, value, err}
 	} else {
-		r := NewRequest(m, p.rawBody, uri, NewHeaders(p))
-		return r, nil
+		return []RawHeader{{
+			Value:      scheme,
+			Properties: props,
+		}}, nil
 	}
 }
 
-var ErrIsNotResponse = errors.New("is not response")
+// tokenizeHeader splits comma separated header values and their
+// semicolon separated parameters, quoted parameter values are unquoted.
+func tokenizeHeader(key, value string) ([]RawHeader, error) {
+	switch key {
+	case "Authorization", "WWW-Authenticate", "Proxy-Authorization", "Proxy-Authenticate":
+		return tokenizeChallenge(key, value)
+	}
+
+	rhs := make([]RawHeader, 0, 1)
+	for rest, more := value, true; more; {
+		var part string
+		var err error
+		if part, rest, more, err = cutHeaderValue(rest, ','); err != nil {
+			return nil, &HeaderParseError{key, value, err}
+		} else if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+
+		if v, rawParams, _, err := cutHeaderValue(part, ';'); err != nil {
+			return nil, &HeaderParseError{key, value, err}
+		} else if props, err := parseParameters(rawParams, ';'); err != nil {
+			return nil, &HeaderParseError{key, value, err}
+		} else {
+			rhs = append(rhs, RawHeader{
+				Value:      strings.TrimSpace(v),
+				Properties: props,
+			})
+		}
+	}
+	return rhs, nil
+}
+
+var ErrWrongContentLength = errors.New("wrong content length")
 var ErrWrongResponseCode = errors.New("wrong response code")
+var ErrIsNotRequest = errors.New("is not request")
+var ErrIsNotResponse = errors.New("is not response")
 
-func (p *Parser) ParseResponse() (Response, error) {
-	if p.IsRequest() {
-		return Response{}, ErrIsNotResponse
+// splitMessage separates start line and header lines from the body,
+// both CRLF and bare LF line endings are accepted.
+func splitMessage(b []byte) ([]string, []byte) {
+	head, body := b, []byte(nil)
+	i, n := bytes.Index(b, []byte("\r\n\r\n")), 4
+	if j := bytes.Index(b, []byte("\n\n")); i == -1 || (j != -1 && j < i) {
+		i, n = j, 2
 	}
-	pfl := strings.Split(p.getFirstLine(), " ")
-	if c, err := strconv.Atoi(pfl[1]); err != nil {
-		return Response{}, ErrWrongResponseCode
-	} else if _, ok := ResponseCodes[c]; !ok {
-		return Response{}, ErrWrongResponseCode
-	} else {
-		r := NewResponse(ResponseCode(c), p.rawBody, NewHeaders(p))
-		return r, nil
+	if i != -1 {
+		head, body = b[:i], b[i+n:]
+	}
+
+	// lines are slices of a single string, no copy per line
+	rawHead := string(head)
+	lines := make([]string, 0, strings.Count(rawHead, "\n")+1)
+	for more := true; more; {
+		var line string
+		line, rawHead, more = strings.Cut(rawHead, "\n")
+		lines = append(lines, strings.TrimSuffix(line, "\r"))
 	}
+	return lines, body
 }
 
-func (p *Parser) Parse() (Message, error) {
-	if p.IsRequest() {
-		return p.ParseRequest()
+// limitBody cuts body by Content-Length. Datagram shorter than
+// Content-Length is an error (RFC 3261 18.3).
+func limitBody(hs *Headers, body []byte) ([]byte, error) {
+	if hs.ContentLength == nil {
+		return body, nil
+	} else if l := hs.ContentLength.Value; l < 0 || l > len(body) {
+		return nil, ErrWrongContentLength
 	} else {
-		return p.ParseResponse()
+		return body[:l], nil
 	}
 }
 
-func NewParser(b string) *Parser {
-	return &Parser{
-		rawBody:  b,
-		rawLines: strings.Split(strings.ReplaceAll(b, "\r\n", "\n"), "\n"),
+// INVITE sip:bob@biloxi.com SIP/2.0
+func decodeRequestLine(line string) (MethodType, URI, error) {
+	m, rest, _ := strings.Cut(line, " ")
+	rawURI, version, _ := strings.Cut(rest, " ")
+	if m == "" || version != VERSION {
+		return "", URI{}, ErrCantParseMessage
+	} else if uri, err := DecodeURI(rawURI); err != nil {
+		return "", URI{}, err
+	} else {
+		return MethodType(m), uri, nil
 	}
 }
 
-func decodeFirseLine() {
+// SIP/2.0 180 Ringing
+// Any 3-digit code of 1xx-6xx is accepted, reason phrase may be empty.
+func decodeStatusLine(line string) (ResponseCode, string, error) {
+	_, rest, _ := strings.Cut(line, " ")
+	rawCode, reason, _ := strings.Cut(rest, " ")
+	if c, err := strconv.Atoi(rawCode); err != nil || len(rawCode) != 3 || !ResponseCode(c).IsValid() {
+		return 0, "", ErrWrongResponseCode
+	} else {
+		return ResponseCode(c), strings.TrimSpace(reason), nil
+	}
+}
 
+func isStatusLine(line string) bool {
+	return strings.HasPrefix(line, VERSION+" ")
 }
 
-func Decode(b string) {
-	b = strings.ReplaceAll(b, "\r\n", "\n")
-	parts := strings.Split(b, "\n\n")
-	lines := strings.Split(parts[0], "\n")
+// Decode parses request or response with typed headers and body.
+// Body keeps referencing b, so b must not be reused by the caller.
+// Message with malformed header of MANDATORY_HEADERS is returned with
+// the HeaderParseError, the request keeps it for Validate. Other
+// malformed headers are left out.
+func Decode(b []byte) (Message, error) {
+	lines, rawBody := splitMessage(b)
+	if lines[0] == "" {
+		return nil, ErrCantParseMessage
+	}
+
+	hs, headerErr := DecodeHeaders(lines[1:])
+	var perr *HeaderParseError
+	if errors.As(headerErr, &perr) && !MANDATORY_HEADERS[perr.Header] {
+		headerErr = nil
+	}
+	body, err := limitBody(hs, rawBody)
+	if err != nil {
+		return nil, err
+	}
+	s, parts, err := decodeBody(hs, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if isStatusLine(lines[0]) {
+		if c, reason, err := decodeStatusLine(lines[0]); err != nil {
+			return nil, err
+		} else {
+			r := NewResponse(c, "", *hs)
+			r.rawBody = b
+			r.Reason = reason
+			r.Body = body
+			r.SDP = s
+			r.Parts = parts
+			return r, headerErr
+		}
+	} else if m, uri, err := decodeRequestLine(lines[0]); err != nil {
+		return nil, err
+	} else {
+		r := NewRequest(m, "", uri, *hs)
+		r.rawBody = b
+		r.Body = body
+		r.SDP = s
+		r.Parts = parts
+		r.headerErr = headerErr
+		return r, headerErr
+	}
+}
 
-	// lines := strings.Split(strings.ReplaceAll(b, "\r\n", "\n"), "\n")
+// Encode is the counterpart of Decode
+func Encode(m Message) []byte {
+	return m.Data()
 }
@@ -1,8 +1,13 @@
 package sip_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"reflect"
 	"signal/sip"
+	"strings"
 	"testing"
 )
 
@@ -18,7 +23,7 @@ Allow: INVITE, ACK, CANCEL, BYE, NOTIFY, REFER, MESSAGE, OPTIONS, INFO, SUBSCRIB
 Content-Type: application/sdp
 User-Agent: Z 5.5.10 v2.10.17.3
 Allow-Events: presence, kpml, talk
-Content-Length: 333
+Content-Length: 306
 
 v=0
 o=Z 697308982 1 IN IP4 0.0.0.0
@@ -37,7 +42,7 @@ a=sendrecv
 
 var SIP_RESPONSE = `SIP/2.0 100 Trying
 Via: SIP/2.0/UDP 127.0.0.1:5080;branch=19048c29-9263-4d8f-b2b0-b53ee05331c2
-To: \"foo\" <sip:foo@127.0.0.1:5080>
+To: "foo" <sip:foo@127.0.0.1:5080>
 From: <sip:test@127.0.0.1:5080>;tag=d1712d60
 Call-ID: 577cf2e4-fed5-48d3-a25b-b56a5a5f24d4
 CSeq: 0 INVITE
@@ -46,9 +51,28 @@ Content-Length: 0
 
 `
 
+func decodeRequest(d string) (sip.Request, error) {
+	if m, err := sip.Decode([]byte(d)); err != nil {
+		return sip.Request{}, err
+	} else if r, ok := m.(sip.Request); !ok {
+		return sip.Request{}, sip.ErrIsNotRequest
+	} else {
+		return r, nil
+	}
+}
+
+func decodeResponse(d string) (sip.Response, error) {
+	if m, err := sip.Decode([]byte(d)); err != nil {
+		return sip.Response{}, err
+	} else if r, ok := m.(sip.Response); !ok {
+		return sip.Response{}, sip.ErrIsNotResponse
+	} else {
+		return r, nil
+	}
+}
+
 func TestParseResponse(t *testing.T) {
-	p := sip.NewParser(SIP_RESPONSE)
-	if m, err := p.Parse(); err != nil {
+	if m, err := sip.Decode([]byte(SIP_RESPONSE)); err != nil {
 		t.Error(err)
 	} else {
 		resp := m.(sip.Response)
@@ -62,96 +86,643 @@ func TestParseResponse(t *testing.T) {
 }
 
 func RequestTest(t testing.TB, d string) {
-	p := sip.NewParser(d)
-	if p.IsRequest() {
-		if r, err := p.ParseRequest(); err != nil {
+	if r, err := decodeRequest(d); err != nil {
+		t.Error(err)
+	} else {
+		// Request line
+		if t.Logf("Message INVITE login is %s", r.URI.Login); r.URI.Login != "test" {
+			t.Error("Login != test")
+		} else if t.Logf("Message INVITE host is %s", r.URI.Host); r.URI.Host != "foo.bar.com" {
+			t.Error("Host != foo.bar.com")
+		}
+
+		// Max-Forwards
+		if maxForwarders, err := r.Headers.GetMaxForwards(); err != nil {
 			t.Error(err)
 		} else {
-			// Request line
-			if t.Logf("Message INVITE login is %s", r.URI.Login); r.URI.Login != "test" {
-				t.Error("Login != test")
-			} else if t.Logf("Message INVITE host is %s", r.URI.Host); r.URI.Host != "foo.bar.com" {
-				t.Error("Host != foo.bar.com")
+			if t.Logf("Max-Forwards is %d", maxForwarders.Value); maxForwarders.Value != 70 {
+				t.Error("Max-Forwards != 70")
 			}
+		}
 
-			// Max-Forwards
-			if maxForwarders, err := r.Headers.GetMaxForwards(); err != nil {
-				t.Error(err)
-			} else {
-				if t.Logf("Max-Forwards is %d", maxForwarders.Value); maxForwarders.Value != 70 {
-					t.Error("Max-Forwards != 70")
-				}
+		// Via
+		if vias, err := r.Headers.GetVias(); err != nil {
+			t.Error(err)
+		} else {
+			via := vias[0]
+			if t.Logf("Via host is %s", via.Host); via.Host != "10.10.10.10:44444" {
+				t.Error("Via host != 10.10.10.10:44444")
+			} else if t.Logf("Via branch is %s", via.Branch); via.Branch != "z9hG4bK-524287-1---3c38414a643cc244" {
+				t.Error("Via branch != z9hG4bK-524287-1---3c38414a643cc244")
 			}
+		}
 
-			// Via
-			if vias, err := r.Headers.GetVias(); err != nil {
-				t.Error(err)
-			} else {
-				via := vias[0]
-				if t.Logf("Via host is %s", via.Host); via.Host != "10.10.10.10:44444" {
-					t.Error("Via host != 10.10.10.10:44444")
-				} else if t.Logf("Via branch is %s", via.Branch); via.Branch != "z9hG4bK-524287-1---3c38414a643cc244" {
-					t.Error("Via branch != z9hG4bK-524287-1---3c38414a643cc244")
-				}
-			}
+		// From
+		// if f, err := r.Headers.GetFirst("From"); err != nil {
+		// 	t.Error(err)
+		// } else if from, ok := f.(sip.Destination); !ok {
+		// 	t.Error("From cast error")
+		// } else if t.Logf("From login is %s", from.Address.URI.Login); from.Address.URI.Login != "user" {
+		// 	t.Error("From login != user")
+		// } else if t.Logf("From host is %s", from.Address.URI.Host); from.Address.URI.Host != "foo.bar.com" {
+		// 	t.Error("From host != foo.bar.com")
+		// } else if t.Logf("From tag is %s", from.Tag); from.Tag != "902cba13" {
+		// 	t.Error("From tag != 902cba13")
+		// }
+
+		// Call-Id
+		// if f, err := r.Headers.GetFirst("Call-ID"); err != nil {
+		// 	t.Error(err)
+		// } else if cid, ok := f.(sip.PlainHeader); !ok {
+		// 	t.Error("Call-ID cast error")
+		// } else if t.Logf("Call-id is %s", cid.Value); cid.Value != "gwQlUuwZxsFHSoh5XE8AOA" {
+		// 	t.Error("Call-ID != gwQlUuwZxsFHSoh5XE8AOA")
+		// }
 
-			// From
-			// if f, err := r.Headers.GetFirst("From"); err != nil {
-			// 	t.Error(err)
-			// } else if from, ok := f.(sip.Destination); !ok {
-			// 	t.Error("From cast error")
-			// } else if t.Logf("From login is %s", from.Address.URI.Login); from.Address.URI.Login != "user" {
-			// 	t.Error("From login != user")
-			// } else if t.Logf("From host is %s", from.Address.URI.Host); from.Address.URI.Host != "foo.bar.com" {
-			// 	t.Error("From host != foo.bar.com")
-			// } else if t.Logf("From tag is %s", from.Tag); from.Tag != "902cba13" {
-			// 	t.Error("From tag != 902cba13")
-			// }
-
-			// Call-Id
-			// if f, err := r.Headers.GetFirst("Call-ID"); err != nil {
-			// 	t.Error(err)
-			// } else if cid, ok := f.(sip.PlainHeader); !ok {
-			// 	t.Error("Call-ID cast error")
-			// } else if t.Logf("Call-id is %s", cid.Value); cid.Value != "gwQlUuwZxsFHSoh5XE8AOA" {
-			// 	t.Error("Call-ID != gwQlUuwZxsFHSoh5XE8AOA")
-			// }
-
-			// CSeq
-			// if f, err := r.Headers.GetFirst("CSeq"); err != nil {
-			// 	t.Error(err)
-			// } else if cseq, ok := f.(sip.CSeq); !ok {
-			// 	t.Error("CSeq cast error")
-			// } else if t.Logf("CSeq value is %d", cseq.Value); cseq.Value != 2 {
-			// 	t.Errorf("CSeq value != 2")
-			// }
-
-			// if fields, err := r.Headers.Get("Allow"); err != nil {
-			// 	t.Error(err)
-			// } else {
-			// 	for _, f := range fields {
-			// 		if a, ok := f.(sip.Allow); !ok {
-			// 			t.Error("Allow cast error")
-			// 		} else {
-			// 			t.Logf("Allow: %s", a.String())
-			// 		}
-			// 	}
-			// }
-		}
-	}
-}
-
-// go clean -testcache && /usr/local/go/bin/go test -parallel 1 -timeout 30s -run ^TestPerformanceParser$ signal/sip
-// go clean -testcache && go test -bench=. -parallel 1 -timeout 30s
+		// CSeq
+		// if f, err := r.Headers.GetFirst("CSeq"); err != nil {
+		// 	t.Error(err)
+		// } else if cseq, ok := f.(sip.CSeq); !ok {
+		// 	t.Error("CSeq cast error")
+		// } else if t.Logf("CSeq value is %d", cseq.Value); cseq.Value != 2 {
+		// 	t.Errorf("CSeq value != 2")
+		// }
+
+		// if fields, err := r.Headers.Get("Allow"); err != nil {
+		// 	t.Error(err)
+		// } else {
+		// 	for _, f := range fields {
+		// 		if a, ok := f.(sip.Allow); !ok {
+		// 			t.Error("Allow cast error")
+		// 		} else {
+		// 			t.Logf("Allow: %s", a.String())
+		// 		}
+		// 	}
+		// }
+	}
+}
+
+// go clean -testcache && go test -bench=. -benchmem -run ^$ signal/sip
 func BenchmarkPerformanceParser(b *testing.B) {
 	sip.PROTOCOL = "UDP"
-	for i := 0; i < 100000; i++ {
+	for i := 0; i < b.N; i++ {
 		RequestTest(b, SIP_REQUEST)
 	}
 }
 
+func BenchmarkDecodeRequest(b *testing.B) {
+	d := []byte(SIP_REQUEST)
+	b.SetBytes(int64(len(d)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := sip.Decode(d); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeResponse(b *testing.B) {
+	d := []byte(SIP_RESPONSE)
+	b.SetBytes(int64(len(d)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := sip.Decode(d); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeRequest(b *testing.B) {
+	m, err := sip.Decode([]byte(SIP_REQUEST))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sip.Encode(m)
+	}
+}
+
 // go clean -testcache && go test -bench=. -parallel 1 -timeout 30s -run ^TestParser$ signal/sip
 func TestParser(t *testing.T) {
 	sip.PROTOCOL = "UDP"
 	RequestTest(t, SIP_REQUEST)
 }
+
+var SIP_COMPACT_REQUEST = `INVITE sip:test@foo.bar.com SIP/2.0
+v: SIP/2.0/UDP 10.10.10.10:44444;branch=z9hG4bK-524287-1---3c38414a643cc244;rport
+MAX-FORWARDS: 70
+m: <sip:user@bar.foo.com:44444>
+t: <sip:test@foo.bar.com>
+f: <sip:user@foo.bar.com>
+ ;tag=902cba13
+i: gwQlUuwZxsFHSoh5XE8AOA
+cseq: 2
+	INVITE
+c: application/sdp
+l: 0
+
+`
+
+// go clean -testcache && go test -timeout 30s -run ^TestCompactHeaders$ signal/sip
+func TestCompactHeaders(t *testing.T) {
+	if r, err := decodeRequest(SIP_COMPACT_REQUEST); err != nil {
+		t.Error(err)
+	} else {
+		if vias, err := r.Headers.GetVias(); err != nil {
+			t.Error(err)
+		} else if t.Logf("Via host is %s", vias[0].Host); vias[0].Host != "10.10.10.10:44444" {
+			t.Error("Via host != 10.10.10.10:44444")
+		}
+
+		if maxForwards, err := r.Headers.GetMaxForwards(); err != nil {
+			t.Error(err)
+		} else if maxForwards.Value != 70 {
+			t.Error("Max-Forwards != 70")
+		}
+
+		if from, err := r.Headers.GetFrom(); err != nil {
+			t.Error(err)
+		} else if t.Logf("From tag is %s", from.Tag); from.Tag != "902cba13" {
+			t.Error("From tag != 902cba13")
+		}
+
+		if to, err := r.Headers.GetTo(); err != nil {
+			t.Error(err)
+		} else if to.Address.URI.Login != "test" {
+			t.Error("To login != test")
+		}
+
+		if cid, err := r.Headers.GetCallID(); err != nil {
+			t.Error(err)
+		} else if cid != "gwQlUuwZxsFHSoh5XE8AOA" {
+			t.Error("Call-ID != gwQlUuwZxsFHSoh5XE8AOA")
+		}
+
+		if contacts, err := r.Headers.GetContacts(); err != nil {
+			t.Error(err)
+		} else if contacts[0].Address.URI.Host != "bar.foo.com:44444" {
+			t.Error("Contact host != bar.foo.com:44444")
+		}
+
+		if cseq, err := r.Headers.GetCSeq(); err != nil {
+			t.Error(err)
+		} else if t.Logf("CSeq is %s", cseq); cseq.Value != 2 || cseq.Method != sip.INVITE {
+			t.Error("CSeq != 2 INVITE")
+		}
+	}
+
+	lines := strings.Split(SIP_COMPACT_REQUEST, "\n")
+	if hs, err := sip.DecodeHeaders(lines[1:]); err != nil {
+		t.Error(err)
+	} else if hs.From == nil || hs.From.Tag != "902cba13" {
+		t.Error("From tag != 902cba13")
+	} else if hs.CallID == nil || hs.CallID.Value != "gwQlUuwZxsFHSoh5XE8AOA" {
+		t.Error("Call-ID != gwQlUuwZxsFHSoh5XE8AOA")
+	} else if hs.ContentLength == nil || hs.ContentLength.Value != 0 {
+		t.Error("Content-Length != 0")
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestExtensionHeaders$ signal/sip
+func TestExtensionHeaders(t *testing.T) {
+	d := strings.Replace(SIP_REQUEST, "Content-Type:", "X-Account-ID: 42\nX-Account-ID: 43\nContent-Type:", 1)
+	if r, err := decodeRequest(d); err != nil {
+		t.Error(err)
+	} else {
+		if ua, err := r.Headers.GetFirst("user-agent"); err != nil {
+			t.Error(err)
+		} else if t.Logf("User-Agent is %s", ua); ua != "Z 5.5.10 v2.10.17.3" {
+			t.Error("User-Agent != Z 5.5.10 v2.10.17.3")
+		}
+
+		if values := r.Headers.Get("X-Account-ID"); len(values) != 2 || values[0] != "42" || values[1] != "43" {
+			t.Errorf("X-Account-ID != [42 43], got %v", values)
+		}
+
+		r.Headers.Set("X-Account-ID", "44")
+		r.Headers.Append("X-Trunk", "carrier")
+		r.Headers.Remove("Allow-Events")
+
+		encoded := string(r.Headers.Encode())
+		t.Log(encoded)
+		if !strings.Contains(encoded, "X-Account-ID: 44\r\nUser-Agent: Z 5.5.10 v2.10.17.3\r\n") {
+			t.Error("Extension headers not encoded in order")
+		} else if strings.Count(encoded, "X-Account-ID") != 1 {
+			t.Error("X-Account-ID not replaced")
+		} else if !strings.Contains(encoded, "X-Trunk: carrier\r\n") {
+			t.Error("X-Trunk not encoded")
+		} else if strings.Contains(encoded, "Allow-Events") {
+			t.Error("Allow-Events not removed")
+		}
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestBody$ signal/sip
+func TestBody(t *testing.T) {
+	if r, err := decodeRequest(SIP_REQUEST); err != nil {
+		t.Error(err)
+	} else if t.Logf("Body length is %d", len(r.Body)); len(r.Body) != 306 {
+		t.Error("Body length != 306")
+	} else if r.SDP.Origin == nil || r.SDP.Origin.Username != "Z" {
+		t.Error("SDP origin username != Z")
+	} else if len(r.SDP.MediaDescriptions) != 1 || r.SDP.MediaDescriptions[0].Port != 60417 {
+		t.Error("SDP media port != 60417")
+	} else if resp, err := r.MakeResponse(sip.Ok); err != nil {
+		t.Error(err)
+	} else {
+		resp.SDP = r.SDP
+		data := string(resp.Data())
+		t.Log(data)
+
+		if m, err := decodeResponse(data); err != nil {
+			t.Error(err)
+		} else if m.Headers.ContentType == nil || m.Headers.ContentType.Value != "application/sdp" {
+			t.Error("Content-Type != application/sdp")
+		} else if m.Headers.ContentLength == nil || m.Headers.ContentLength.Value != len(m.Body) {
+			t.Error("Content-Length != body length")
+		} else if len(m.SDP.MediaDescriptions) != 1 || m.SDP.MediaDescriptions[0].Port != 60417 {
+			t.Error("SDP media port != 60417")
+		} else if rtpmap := m.SDP.MediaDescriptions[0].RTPmaps[106]; rtpmap.EncodingName != "opus" {
+			t.Error("SDP rtpmap 106 != opus")
+		}
+	}
+
+	if _, err := decodeRequest(strings.Replace(SIP_REQUEST, "Content-Length: 306", "Content-Length: 400", 1)); err != sip.ErrWrongContentLength {
+		t.Error("Content-Length longer than body accepted")
+	}
+}
+
+var SIP_ROUTED_REQUEST = `BYE sip:test@10.0.0.1:5080 SIP/2.0
+Via: SIP/2.0/UDP 192.0.2.4:5060;branch=z9hG4bKnashds7
+Route: <sip:10.0.0.1:5080;lr>, <sip:edge.foo.com;lr>
+Record-Route: <sip:p2.foo.com;lr>
+Record-Route: <sip:p1.foo.com;lr>
+Max-Forwards: 70
+To: <sip:test@foo.bar.com>;tag=a6c85cf
+From: <sip:user@foo.bar.com>;tag=1928301774
+Call-ID: a84b4c76e66710
+CSeq: 231 BYE
+Content-Length: 0
+
+`
+
+// go clean -testcache && go test -timeout 30s -run ^TestRoutes$ signal/sip
+func TestRoutes(t *testing.T) {
+	if r, err := decodeRequest(SIP_ROUTED_REQUEST); err != nil {
+		t.Error(err)
+	} else if len(r.Headers.Routes) != 2 || !r.Headers.Routes[0].Address.URI.LR {
+		t.Errorf("Routes not decoded: %v", r.Headers.Routes)
+	} else if len(r.Headers.RecordRoutes) != 2 || r.Headers.RecordRoutes[1].Address.URI.Host != "p1.foo.com" {
+		t.Errorf("Record-Routes not decoded: %v", r.Headers.RecordRoutes)
+	} else {
+		r.PreprocessRoute(func(uri sip.URI) bool {
+			return uri.Host == "10.0.0.1:5080"
+		})
+		if len(r.Headers.Routes) != 1 || r.Headers.Routes[0].Address.URI.Host != "edge.foo.com" {
+			t.Errorf("Local Route not removed: %v", r.Headers.Routes)
+		}
+
+		if resp, err := r.MakeResponse(sip.Ok); err != nil {
+			t.Error(err)
+		} else if encoded := string(resp.Data()); !strings.Contains(encoded, "Record-Route: <sip:p2.foo.com;lr>\r\nRecord-Route: <sip:p1.foo.com;lr>\r\n") {
+			t.Errorf("Record-Route not copied to response: %s", encoded)
+		}
+
+		target := sip.URI{Login: "user", Host: "192.0.2.4"}
+		bye := sip.NewRequest(sip.BYE, "", sip.URI{}, sip.NewHeaders())
+		bye.SetRouteSet(r.RouteSet(), target)
+		if bye.URI.Host != "192.0.2.4" || len(bye.Headers.Routes) != 2 || bye.Headers.Routes[0].Address.URI.Host != "p2.foo.com" {
+			t.Errorf("Loose route set not applied: %s %v", bye.URI, bye.Headers.Routes)
+		}
+
+		strict := []sip.Route{{Address: sip.Address{URI: sip.URI{Host: "strict.foo.com"}}}}
+		bye.SetRouteSet(strict, target)
+		if bye.URI.Host != "strict.foo.com" || len(bye.Headers.Routes) != 1 || bye.Headers.Routes[0].Address.URI.Host != "192.0.2.4" {
+			t.Errorf("Strict route set not applied: %s %v", bye.URI, bye.Headers.Routes)
+		}
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestRoundTrip$ signal/sip
+func TestRoundTrip(t *testing.T) {
+	fixture, err := os.ReadFile("../fixtures/test.invite.sip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := [][]byte{
+		fixture,
+		[]byte(SIP_REQUEST),
+		[]byte(SIP_RESPONSE),
+		[]byte(SIP_COMPACT_REQUEST),
+		[]byte(SIP_ROUTED_REQUEST),
+		[]byte(strings.ReplaceAll(SIP_MULTIPART_REQUEST, "\n", "\r\n")),
+	}
+	for _, d := range messages {
+		first, err := sip.Decode(d)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		encoded := sip.Encode(first)
+		second, err := sip.Decode(encoded)
+		if err != nil {
+			t.Errorf("Encoded message not decoded: %s\n%s", err, encoded)
+			continue
+		}
+
+		if reencoded := sip.Encode(second); !bytes.Equal(encoded, reencoded) {
+			t.Errorf("Encoding is not stable:\n%s\n%s", encoded, reencoded)
+		}
+		if !reflect.DeepEqual(*first.GetHeaders(), *second.GetHeaders()) {
+			t.Errorf("Headers differ after round trip:\n%s", encoded)
+		}
+
+		switch first := first.(type) {
+		case sip.Request:
+			second := second.(sip.Request)
+			if first.Method != second.Method || first.URI.String() != second.URI.String() {
+				t.Errorf("Request line differs: %s %s", second.Method, second.URI)
+			} else if !bytes.Equal(first.Body, second.Body) || !reflect.DeepEqual(first.SDP, second.SDP) {
+				t.Errorf("Body differs after round trip:\n%s", encoded)
+			}
+		case sip.Response:
+			if second := second.(sip.Response); first.Code != second.Code {
+				t.Errorf("Response code %d != %d", second.Code, first.Code)
+			}
+		}
+	}
+
+	// messages in the order and spelling of Encode come back unchanged,
+	// parameters without typed field included
+	for _, d := range []string{SIP_CANONICAL_REGISTER, SIP_CANONICAL_UNREGISTER} {
+		if m, err := sip.Decode([]byte(d)); err != nil {
+			t.Error(err)
+		} else if encoded := string(sip.Encode(m)); encoded != d {
+			t.Errorf("Message changed by round trip:\n%s\n%s", d, encoded)
+		}
+	}
+
+	for _, d := range []string{"", "\r\n\r\n", "INVITE sip:a@b\r\n\r\n", "SIP/2.0 abc OK\r\n\r\n"} {
+		if _, err := sip.Decode([]byte(d)); err == nil {
+			t.Errorf("Malformed message decoded: %q", d)
+		}
+	}
+}
+
+var SIP_CANONICAL_REGISTER = "REGISTER sip:foo.bar.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 10.10.10.10:44444;branch=z9hG4bK776asdhds;received=192.0.2.1;rport=5060;alias\r\n" +
+	"From: \"user\" <sip:user@foo.bar.com>;tag=902cba13;epid=3c38414a\r\n" +
+	"To: <sip:user@foo.bar.com>;x-tenant=east\r\n" +
+	"Call-ID: gwQlUuwZxsFHSoh5XE8AOA\r\n" +
+	"Contact: <sip:user@10.10.10.10:44444;ob>;q=0.7;expires=3600;+sip.instance=\"<urn:uuid:00000000-0000-1000-8000-000A95A0E128>\";reg-id=1\r\n" +
+	"CSeq: 3 REGISTER\r\n" +
+	"Max-Forwards: 70\r\n" +
+	"Authorization: Digest username=\"user\", realm=\"foo.bar.com\", nonce=\"84a4cc6f\", uri=\"sip:foo.bar.com\", response=\"7587245234b\", algorithm=MD5, cnonce=\"0a4f113b\", opaque=\"5ccc069c\", qop=auth, nc=00000001\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+var SIP_CANONICAL_UNREGISTER = "REGISTER sip:foo.bar.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/TCP 10.10.10.10:44444;branch=z9hG4bK776asdhdt;rport\r\n" +
+	"From: <sip:user@foo.bar.com>;tag=902cba13\r\n" +
+	"To: <sip:user@foo.bar.com>\r\n" +
+	"Call-ID: gwQlUuwZxsFHSoh5XE8AOA\r\n" +
+	"Contact: *\r\n" +
+	"CSeq: 4 REGISTER\r\n" +
+	"Max-Forwards: 70\r\n" +
+	"Expires: 0\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+var SIP_MULTIPART_REQUEST = `INVITE sip:test@foo.bar.com SIP/2.0
+Via: SIP/2.0/UDP 10.10.10.10:44444;branch=z9hG4bK-524287-1---3c38414a643cc244
+Max-Forwards: 70
+To: <sip:test@foo.bar.com>
+From: <sip:user@foo.bar.com>;tag=902cba13
+Call-ID: gwQlUuwZxsFHSoh5XE8AOA
+CSeq: 2 INVITE
+Content-Type: multipart/mixed;boundary="=_boundary 42"
+Content-Length: 334
+
+preamble
+--=_boundary 42
+Content-Type: application/sdp
+Content-Disposition: session;handling=required
+
+v=0
+o=Z 697308982 1 IN IP4 0.0.0.0
+s=Z
+c=IN IP4 0.0.0.0
+t=0 0
+m=audio 60417 RTP/AVP 0 8
+a=sendrecv
+
+--=_boundary 42
+Content-Type: application/pidf+xml
+Content-ID: <loc@foo.bar.com>
+
+<presence/>
+--=_boundary 42--
+`
+
+// go clean -testcache && go test -timeout 30s -run ^TestMultipart$ signal/sip
+func TestMultipart(t *testing.T) {
+	d := strings.ReplaceAll(SIP_MULTIPART_REQUEST, "\n", "\r\n")
+	if r, err := decodeRequest(d); err != nil {
+		t.Error(err)
+	} else if len(r.Parts) != 2 {
+		t.Errorf("Parts count %d != 2", len(r.Parts))
+	} else if r.Parts[0].ContentDisposition == nil || r.Parts[0].ContentDisposition.Properties["handling"] != "required" {
+		t.Error("Content-Disposition handling != required")
+	} else if r.Parts[1].ContentID != "<loc@foo.bar.com>" || string(r.Parts[1].Body) != "<presence/>" {
+		t.Errorf("PIDF part not decoded: %s %q", r.Parts[1].ContentID, r.Parts[1].Body)
+	} else if len(r.SDP.MediaDescriptions) != 1 || r.SDP.MediaDescriptions[0].Port != 60417 {
+		t.Error("SDP not taken from application/sdp part")
+	} else if resp, err := r.MakeResponse(sip.Ok); err != nil {
+		t.Error(err)
+	} else {
+		resp.SDP = r.SDP
+		resp.Parts = []sip.BodyPart{
+			{ContentType: &sip.PlainHeader{Value: sip.SDP_CONTENT_TYPE}},
+			r.Parts[1],
+		}
+		data := string(resp.Data())
+		t.Log(data)
+
+		if m, err := decodeResponse(data); err != nil {
+			t.Error(err)
+		} else if m.Headers.ContentType == nil || m.Headers.ContentType.Value != sip.MULTIPART_MIXED {
+			t.Error("Content-Type != multipart/mixed")
+		} else if len(m.Parts) != 2 || string(m.Parts[1].Body) != "<presence/>" {
+			t.Errorf("Parts not encoded: %v", m.Parts)
+		} else if len(m.SDP.MediaDescriptions) != 1 || m.SDP.MediaDescriptions[0].Port != 60417 {
+			t.Error("SDP not encoded into application/sdp part")
+		}
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestResponseCodes$ signal/sip
+func TestResponseCodes(t *testing.T) {
+	for _, c := range []struct {
+		line       string
+		code       sip.ResponseCode
+		reason     string
+		equivalent sip.ResponseCode
+		encoded    string
+	}{
+		{"SIP/2.0 199 Early Dialog Terminated", 199, "Early Dialog Terminated", sip.Trying, "SIP/2.0 199 Early Dialog Terminated"},
+		{"SIP/2.0 437 Unsupported Certificate", 437, "Unsupported Certificate", sip.BadRequest, "SIP/2.0 437 Unsupported Certificate"},
+		{"SIP/2.0 580 Precondition Failure", 580, "Precondition Failure", sip.InternalServerError, "SIP/2.0 580 Precondition Failure"},
+		{"SIP/2.0 486 Busy, call back later", sip.BusyHere, "Busy, call back later", sip.BusyHere, "SIP/2.0 486 Busy, call back later"},
+		{"SIP/2.0 200", sip.Ok, "", sip.Ok, "SIP/2.0 200 OK"},
+	} {
+		d := strings.Replace(SIP_RESPONSE, "SIP/2.0 100 Trying", c.line, 1)
+		if resp, err := decodeResponse(d); err != nil {
+			t.Error(err)
+		} else if resp.Code != c.code || resp.Reason != c.reason || resp.Code.Equivalent() != c.equivalent {
+			t.Errorf("%s decoded as %d %s", c.line, resp.Code, resp.Reason)
+		} else if line := strings.SplitN(string(resp.Data()), "\r\n", 2)[0]; line != c.encoded {
+			t.Errorf("Status line %q not kept", line)
+		}
+	}
+
+	for _, line := range []string{"SIP/2.0 099 Low", "SIP/2.0 700 High", "SIP/2.0 2000 Long"} {
+		if _, err := decodeResponse(strings.Replace(SIP_RESPONSE, "SIP/2.0 100 Trying", line, 1)); err != sip.ErrWrongResponseCode {
+			t.Errorf("%s accepted", line)
+		}
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestValidate$ signal/sip
+func TestValidate(t *testing.T) {
+	if r, err := decodeRequest(SIP_ROUTED_REQUEST); err != nil {
+		t.Error(err)
+	} else if err := r.Validate(); err != nil {
+		t.Error(err)
+	} else {
+		r.DecrementMaxForwards()
+		if r.Headers.MaxForwards.Value != 69 {
+			t.Errorf("Max-Forwards %d != 69", r.Headers.MaxForwards.Value)
+		}
+	}
+
+	for _, c := range []struct {
+		from string
+		to   string
+		err  error
+	}{
+		{"CSeq: 231 BYE\n", "", sip.ErrMissingMandatoryHeader},
+		{"Call-ID: a84b4c76e66710\n", "", sip.ErrMissingMandatoryHeader},
+		{"CSeq: 231 BYE", "CSeq: 231 INVITE", sip.ErrCSeqMethodMismatch},
+		{"Max-Forwards: 70", "Max-Forwards: 256", sip.ErrWrongMaxForwards},
+	} {
+		if r, err := decodeRequest(strings.Replace(SIP_ROUTED_REQUEST, c.from, c.to, 1)); err != nil {
+			t.Error(err)
+		} else if err := r.Validate(); !errors.Is(err, c.err) {
+			t.Errorf("%q: %v != %v", c.from, err, c.err)
+		} else {
+			resp := r.MakeErrorResponse(sip.BadRequest)
+			resp.Headers.AddWarning(399, "10.0.0.1:5080", err.Error())
+			if warning, err := resp.Headers.GetFirst("Warning"); err != nil {
+				t.Error(err)
+			} else if !strings.HasPrefix(warning, "399 10.0.0.1:5080 \"") {
+				t.Errorf("Warning %s", warning)
+			} else if _, err := decodeResponse(string(resp.Data())); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	// malformed mandatory header, the request comes with the error so it
+	// can be answered 400
+	for _, c := range []struct {
+		from   string
+		to     string
+		header string
+	}{
+		{"CSeq: 231 BYE", "CSeq: abc BYE", "CSeq"},
+		{"Via: SIP/2.0/UDP 192.0.2.4:5060", "Via: SIP/2.0/UDP", "Via"},
+	} {
+		var perr *sip.HeaderParseError
+		m, err := sip.Decode([]byte(strings.Replace(SIP_ROUTED_REQUEST, c.from, c.to, 1)))
+		if !errors.As(err, &perr) || perr.Header != c.header {
+			t.Errorf("%q: %v", c.to, err)
+		} else if r, ok := m.(sip.Request); !ok {
+			t.Errorf("%q: request not returned with error", c.to)
+		} else if err := r.Validate(); !errors.As(err, &perr) || perr.Header != c.header {
+			t.Errorf("%q: Validate %v", c.to, err)
+		} else if r.Headers.CallID == nil || r.Headers.From == nil {
+			t.Errorf("%q: other headers not decoded", c.to)
+		}
+	}
+
+	// malformed optional header is ignored
+	broken := strings.Replace(SIP_ROUTED_REQUEST, "Max-Forwards: 70", "Max-Forwards: 70\nAuthorization: username=\"Alice\"\nRSeq: abc", 1)
+	if r, err := decodeRequest(broken); err != nil {
+		t.Error(err)
+	} else if err := r.Validate(); err != nil {
+		t.Errorf("Request with malformed optional header: %v", err)
+	} else if r.Headers.Authorization != nil || r.Headers.RSeq != nil {
+		t.Errorf("Malformed optional header decoded: %v %v", r.Headers.Authorization, r.Headers.RSeq)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	if r, err := decodeRequest(strings.ReplaceAll(SIP_ROUTED_REQUEST, "BYE", "INVITE")); err != nil {
+		t.Error(err)
+	} else {
+		r.Headers.PushVia(sip.Via{Host: "10.0.0.1:5080", Branch: sip.NewBranch()})
+		cancel := r.MakeCancel()
+		if err := cancel.Validate(); err != nil {
+			t.Error(err)
+		} else if len(cancel.Headers.Vias) != 1 || !reflect.DeepEqual(cancel.Headers.Vias[0], r.Headers.Vias[0]) {
+			t.Errorf("Top Via not copied: %v", cancel.Headers.Vias)
+		} else if cancel.URI.String() != r.URI.String() || cancel.Headers.CSeq.Value != r.Headers.CSeq.Value {
+			t.Errorf("CANCEL %s %d does not match %s %d", cancel.URI, cancel.Headers.CSeq.Value, r.URI, r.Headers.CSeq.Value)
+		} else if !reflect.DeepEqual(cancel.Headers.Routes, r.Headers.Routes) {
+			t.Errorf("Routes not copied: %v", cancel.Headers.Routes)
+		} else if _, err := decodeRequest(string(cancel.Data())); err != nil {
+			t.Error(err)
+		}
+
+		resp := r.MakeErrorResponse(sip.BusyHere)
+		to := *resp.Headers.To
+		to.Tag = "b7c3e1"
+		resp.Headers.To = &to
+		ack := r.MakeAck(resp)
+		if err := ack.Validate(); err != nil {
+			t.Error(err)
+		} else if ack.Headers.Vias[0].Branch != r.Headers.Vias[0].Branch || ack.Headers.To.Tag != "b7c3e1" {
+			t.Errorf("ACK is not in INVITE transaction: %s", ack.Data())
+		}
+	}
+}
+
+// go test -fuzz=FuzzDecode -fuzztime 60s -run ^$ signal/sip
+func FuzzDecode(f *testing.F) {
+	if fixture, err := os.ReadFile("../fixtures/test.invite.sip"); err == nil {
+		f.Add(fixture)
+	}
+	for _, d := range []string{
+		SIP_REQUEST,
+		SIP_RESPONSE,
+		SIP_COMPACT_REQUEST,
+		SIP_ROUTED_REQUEST,
+		SIP_MULTIPART_REQUEST,
+		"",
+		"\r\n\r\n",
+		"REGISTER sip:foo.bar.com SIP/2.0\r\nAuthorization: username=\"Alice\"\r\n\r\n",
+	} {
+		f.Add([]byte(d))
+	}
+
+	f.Fuzz(func(t *testing.T, d []byte) {
+		if m, err := sip.Decode(d); err == nil {
+			encoded := sip.Encode(m)
+			if _, err := sip.Decode(encoded); err != nil {
+				t.Errorf("Encoded message not decoded: %s\n%q", err, encoded)
+			}
+		}
+	})
+}
@@ -2,9 +2,11 @@ package sip
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"signal/sdp"
+	"strings"
 )
 
 type MethodType string
@@ -17,6 +19,8 @@ const (
 	REGISTER MethodType = "REGISTER"
 	OPTIONS  MethodType = "OPTIONS"
 	INFO     MethodType = "INFO"
+	UPDATE   MethodType = "UPDATE"
+	PRACK    MethodType = "PRACK"
 )
 
 func (mt *MethodType) IncludeIn(mts ...MethodType) bool {
@@ -33,8 +37,11 @@ type Request struct {
 	URI          URI
 	Headers      Headers
 	SDP          sdp.SDP
+	Body         []byte
+	Parts        []BodyPart
 	SourceAddres net.Addr
-	rawBody      string
+	rawBody      []byte
+	headerErr    error
 }
 
 func (req Request) GetHeaders() *Headers {
@@ -45,14 +52,16 @@ func (req Request) Data() []byte {
 	var buffer bytes.Buffer
 	buffer.WriteString(fmt.Sprintf("%s %s SIP/2.0", req.Method, req.URI.String()))
 	buffer.WriteString("\r\n")
-	buffer.Write(req.Headers.Data())
+	body := encodeBody(&req.Headers, req.Body, &req.SDP, req.Parts)
+	buffer.Write(req.Headers.Encode())
 	buffer.WriteString("\r\n")
+	buffer.Write(body)
 
 	return buffer.Bytes()
 }
 
 func (req Request) GetRawBody() string {
-	return req.rawBody
+	return string(req.rawBody)
 }
 
 func (req Request) GetSourceAddres() net.Addr {
@@ -90,20 +99,182 @@ func (req Request) MakeResponse(c ResponseCode) (Response, error) {
 		}
 		r.Headers.From = &from
 		r.Headers.To = &to
-		r.Headers.CSeq = &CSeq{
-			Value:  cseq.Value + 1,
-			Method: req.Method,
+		r.Headers.CSeq = &cseq
+		if c > Trying && c < MultipleChoices {
+			r.Headers.RecordRoutes = req.RouteSet()
 		}
 		r.SourceAddres = req.GetSourceAddres()
 		return r, nil
 	}
 }
 
+// MakeErrorResponse copies whatever of Via, From, To, Call-ID and CSeq
+// the request has, so a malformed request can still be answered.
+func (req Request) MakeErrorResponse(c ResponseCode) Response {
+	r := NewResponse(c, "", NewHeaders())
+	r.Headers.Vias = append(r.Headers.Vias, req.Headers.Vias...)
+	r.Headers.From = req.Headers.From
+	r.Headers.To = req.Headers.To
+	r.Headers.CallID = req.Headers.CallID
+	r.Headers.CSeq = req.Headers.CSeq
+	r.SourceAddres = req.GetSourceAddres()
+	return r
+}
+
+// inTransaction builds request of the same transaction as req, it has
+// the same Request-URI, top Via, Call-ID, From, To, Route and CSeq
+// number (RFC 3261 9.1, 17.1.1.3)
+func (req Request) inTransaction(m MethodType) Request {
+	h := NewHeaders()
+	if len(req.Headers.Vias) > 0 {
+		h.Vias = append(h.Vias, req.Headers.Vias[0])
+	}
+	h.Routes = append(h.Routes, req.Headers.Routes...)
+	h.CallID = req.Headers.CallID
+	h.From = req.Headers.From
+	h.To = req.Headers.To
+	h.CSeq = &CSeq{
+		Method: m,
+	}
+	if req.Headers.CSeq != nil {
+		h.CSeq.Value = req.Headers.CSeq.Value
+	}
+	h.MaxForwards = &IntegerHeader{
+		Value: DEFAULT_MAX_FORWARDS,
+	}
+	r := NewRequest(m, "", req.URI, h)
+	r.SourceAddres = req.SourceAddres
+	return r
+}
+
+// MakeCancel builds CANCEL for the request
+func (req Request) MakeCancel() Request {
+	return req.inTransaction(CANCEL)
+}
+
+// MakeAck builds ACK for non-2xx final response to INVITE, To is taken
+// from the response for its tag
+func (req Request) MakeAck(resp Response) Request {
+	ack := req.inTransaction(ACK)
+	ack.Headers.To = resp.Headers.To
+	return ack
+}
+
+var ErrMissingMandatoryHeader = errors.New("missing mandatory header")
+var ErrCSeqMethodMismatch = errors.New("cseq method does not match request method")
+var ErrWrongMaxForwards = errors.New("max-forwards out of range")
+
+// Validate checks headers every request must have (RFC 3261 8.1.1)
+// and that CSeq method matches request method. Max-Forwards may be
+// absent, it is added on forwarding (RFC 3261 16.6). Header decoded
+// with error fails it first.
+func (req Request) Validate() error {
+	hs := req.Headers
+	if req.headerErr != nil {
+		return req.headerErr
+	} else if len(hs.Vias) == 0 {
+		return fmt.Errorf("%w: Via", ErrMissingMandatoryHeader)
+	} else if hs.From == nil {
+		return fmt.Errorf("%w: From", ErrMissingMandatoryHeader)
+	} else if hs.To == nil {
+		return fmt.Errorf("%w: To", ErrMissingMandatoryHeader)
+	} else if hs.CallID == nil || hs.CallID.Value == "" {
+		return fmt.Errorf("%w: Call-ID", ErrMissingMandatoryHeader)
+	} else if hs.CSeq == nil {
+		return fmt.Errorf("%w: CSeq", ErrMissingMandatoryHeader)
+	} else if hs.CSeq.Method != req.Method {
+		return ErrCSeqMethodMismatch
+	} else if hs.MaxForwards != nil && (hs.MaxForwards.Value < 0 || hs.MaxForwards.Value > 255) {
+		return ErrWrongMaxForwards
+	}
+	return nil
+}
+
+const DEFAULT_MAX_FORWARDS = 70
+
+// DecrementMaxForwards counts the hop through this element
+func (req *Request) DecrementMaxForwards() {
+	if req.Headers.MaxForwards == nil {
+		req.Headers.MaxForwards = &IntegerHeader{
+			Value: DEFAULT_MAX_FORWARDS,
+		}
+	} else if req.Headers.MaxForwards.Value > 0 {
+		mf := *req.Headers.MaxForwards
+		mf.Value--
+		req.Headers.MaxForwards = &mf
+	}
+}
+
+// UnsupportedOptions returns tags of Require and Proxy-Require missing
+// in supported. ACK and CANCEL are never rejected for extensions
+// (RFC 3261 8.2.2.3).
+func (req Request) UnsupportedOptions(supported []OptionTag) []OptionTag {
+	if req.Method.IncludeIn(ACK, CANCEL) {
+		return nil
+	}
+	unsupported := make([]OptionTag, 0)
+	required := append(append([]OptionTag{}, req.Headers.Require...), req.Headers.ProxyRequire...)
+	for _, tag := range required {
+		found := false
+		for _, s := range supported {
+			if strings.EqualFold(string(s), string(tag)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unsupported = append(unsupported, tag)
+		}
+	}
+	return unsupported
+}
+
+// RouteSet of the dialog created by the request on UAS side (RFC 3261 12.1.1)
+func (req Request) RouteSet() []Route {
+	routes := make([]Route, len(req.Headers.RecordRoutes))
+	copy(routes, req.Headers.RecordRoutes)
+	return routes
+}
+
+// PreprocessRoute restores Request-URI replaced by a strict router and
+// removes the top Route pointing to this element (RFC 3261 16.4).
+// Record-Route URI of the element has no user part, that is how it is
+// told apart from a Request-URI addressed to a local user.
+func (req *Request) PreprocessRoute(isLocal func(URI) bool) {
+	if n := len(req.Headers.Routes); n > 0 && req.URI.Login == "" && isLocal(req.URI) {
+		req.URI = req.Headers.Routes[n-1].Address.URI
+		req.Headers.Routes = req.Headers.Routes[:n-1]
+	}
+	if len(req.Headers.Routes) > 0 && isLocal(req.Headers.Routes[0].Address.URI) {
+		req.Headers.Routes = req.Headers.Routes[1:]
+	}
+}
+
+// SetRouteSet fills Request-URI and Route of in-dialog request
+// sent to remote target (RFC 3261 12.2.1.1).
+func (req *Request) SetRouteSet(routes []Route, target URI) {
+	if len(routes) == 0 {
+		req.URI = target
+		req.Headers.Routes = nil
+	} else if routes[0].Address.URI.LR {
+		req.URI = target
+		req.Headers.Routes = append([]Route{}, routes...)
+	} else {
+		req.URI = routes[0].Address.URI
+		req.Headers.Routes = append([]Route{}, routes[1:]...)
+		req.Headers.Routes = append(req.Headers.Routes, Route{
+			Address: Address{
+				URI: target,
+			},
+		})
+	}
+}
+
 func NewRequest(m MethodType, b string, uri URI, h Headers) Request {
 	return Request{
 		Method:  m,
 		URI:     uri,
 		Headers: h,
-		rawBody: b,
+		rawBody: []byte(b),
 	}
 }
@@ -9,10 +9,13 @@ import (
 
 type Response struct {
 	Code         ResponseCode
+	Reason       string
 	Headers      Headers
 	SDP          sdp.SDP
+	Body         []byte
+	Parts        []BodyPart
 	SourceAddres net.Addr
-	rawBody      string
+	rawBody      []byte
 }
 
 func (resp Response) GetHeaders() *Headers {
@@ -21,16 +24,26 @@ func (resp Response) GetHeaders() *Headers {
 
 func (resp Response) Data() []byte {
 	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("SIP/2.0 %d %s", resp.Code, ResponseCodes[int(resp.Code)]))
+	buffer.WriteString(fmt.Sprintf("SIP/2.0 %d %s", resp.Code, resp.GetReason()))
 	buffer.WriteString("\r\n")
-	buffer.Write(resp.Headers.Data())
+	body := encodeBody(&resp.Headers, resp.Body, &resp.SDP, resp.Parts)
+	buffer.Write(resp.Headers.Encode())
 	buffer.WriteString("\r\n")
+	buffer.Write(body)
 
 	return buffer.Bytes()
 }
 
+// GetReason returns received reason phrase or the standard one
+func (resp Response) GetReason() string {
+	if resp.Reason != "" {
+		return resp.Reason
+	}
+	return resp.Code.Reason()
+}
+
 func (resp Response) GetRawBody() string {
-	return resp.rawBody
+	return string(resp.rawBody)
 }
 
 func (resp Response) GetSourceAddres() net.Addr {
@@ -49,10 +62,19 @@ func (resp Response) GetRecipientAddrs() []string {
 	}
 }
 
+// RouteSet of the dialog created by the response on UAC side (RFC 3261 12.1.2)
+func (resp Response) RouteSet() []Route {
+	routes := make([]Route, 0, len(resp.Headers.RecordRoutes))
+	for i := len(resp.Headers.RecordRoutes) - 1; i >= 0; i-- {
+		routes = append(routes, resp.Headers.RecordRoutes[i])
+	}
+	return routes
+}
+
 func NewResponse(c ResponseCode, b string, h Headers) Response {
 	return Response{
 		Code:    c,
 		Headers: h,
-		rawBody: b,
+		rawBody: []byte(b),
 	}
 }
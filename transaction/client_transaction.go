@@ -0,0 +1,134 @@
+package transaction
+
+import (
+	"signal/sip"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ClientTransaction sends request and passes its responses to
+// transaction user (RFC 3261 17.1). Accepted state of INVITE passes
+// 2xx retransmissions until Timer M (RFC 6026 7.2), ACK for 2xx is
+// sent by transaction user.
+type ClientTransaction struct {
+	transaction
+	invite bool
+	ack    *sip.Request
+}
+
+func (ct *ClientTransaction) start() error {
+	if err := ct.layer.transport.SendSIP(ct.request); err != nil {
+		return err
+	}
+
+	if ct.invite {
+		if !ct.reliable() {
+			ct.startTimer("A", ct.interval, ct.onRetransmit)
+		}
+		ct.startTimer("B", 64*T1, ct.onTimeout)
+	} else {
+		if !ct.reliable() {
+			ct.startTimer("E", ct.interval, ct.onRetransmit)
+		}
+		ct.startTimer("F", 64*T1, ct.onTimeout)
+	}
+	return nil
+}
+
+// onRetransmit of Timer A and Timer E
+func (ct *ClientTransaction) onRetransmit() {
+	if err := ct.layer.transport.SendSIP(ct.request); err != nil {
+		ct.fail(nil, err)
+	} else if ct.invite {
+		ct.startTimer("A", ct.backoff(false), ct.onRetransmit)
+	} else if ct.state == Proceeding {
+		ct.interval = T2
+		ct.startTimer("E", ct.interval, ct.onRetransmit)
+	} else {
+		ct.startTimer("E", ct.backoff(true), ct.onRetransmit)
+	}
+}
+
+// onTimeout of Timer B and Timer F
+func (ct *ClientTransaction) onTimeout() {
+	ct.fail(nil, ErrTimeout)
+}
+
+func (ct *ClientTransaction) fail(resp *sip.Response, err error) {
+	log.Warn().Err(err).Str("Call-ID", ct.callID()).
+		Str("where", "ClientTransaction.fail").
+		Str("Method", string(ct.request.Method)).
+		Str("State", ct.state.String()).
+		Msg("Transaction failed")
+	ct.layer.timeout(Timeout{
+		Request:  ct.request,
+		Response: resp,
+		Err:      err,
+	})
+	ct.terminate()
+}
+
+// receive returns whether response is passed to transaction user
+func (ct *ClientTransaction) receive(resp sip.Response) bool {
+	switch ct.state {
+	case Calling, Trying, Proceeding:
+		if resp.Code.Class() == sip.Provisional {
+			ct.state = Proceeding
+			ct.stopTimer("A")
+			// INVITE may ring as long as the callee wants (RFC 3261 17.1.1.2)
+			ct.stopTimer("B")
+		} else if ct.invite && resp.Code.Class() == sip.Success {
+			ct.state = Accepted
+			ct.stopTimers()
+			ct.startTimer("M", 64*T1, ct.terminate)
+		} else {
+			ct.state = Completed
+			ct.stopTimers()
+			if ct.invite {
+				ack := ct.request.MakeAck(resp)
+				ct.ack = &ack
+				ct.sendAck()
+				ct.startTimer("D", ct.wait(TIMER_D), ct.terminate)
+			} else {
+				ct.startTimer("K", ct.wait(T4), ct.terminate)
+			}
+		}
+		return true
+	case Accepted:
+		return resp.Code.Class() == sip.Success
+	case Completed:
+		if ct.invite {
+			ct.sendAck()
+		}
+	}
+	return false
+}
+
+// sendAck for non-2xx final response, within the transaction
+// (RFC 3261 17.1.1.3)
+func (ct *ClientTransaction) sendAck() {
+	if err := ct.layer.transport.SendSIP(*ct.ack); err != nil {
+		log.Error().Err(err).Str("Call-ID", ct.callID()).
+			Str("where", "ClientTransaction.sendAck").
+			Msg("While send ACK")
+	}
+}
+
+func (ct *ClientTransaction) terminate() {
+	ct.state = Terminated
+	ct.stopTimers()
+	ct.layer.removeClient(ct)
+}
+
+func newClientTransaction(l *Layer, key string, req sip.Request) *ClientTransaction {
+	if req.Method == sip.INVITE {
+		return &ClientTransaction{
+			transaction: newTransaction(l, key, req, Calling),
+			invite:      true,
+		}
+	} else {
+		return &ClientTransaction{
+			transaction: newTransaction(l, key, req, Trying),
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package transaction
+
+import (
+	"signal/clock"
+	"signal/sip"
+	"signal/transport"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Layer keeps transactions between transport and transaction user,
+// it implements transport.Transport so user sends through it.
+// Responses without client transaction are dropped, messages without
+// Via branch pass statelessly.
+type Layer struct {
+	transport transport.Transport
+	clock     clock.Clock
+	timeouts  chan Timeout
+	mu        sync.Mutex
+	clients   map[string]*ClientTransaction
+	servers   map[string]*ServerTransaction
+	accepted  map[string]*ServerTransaction
+}
+
+// Timeouts of transactions, for transaction user
+func (l *Layer) Timeouts() <-chan Timeout {
+	return l.timeouts
+}
+
+func (l *Layer) Run(mq chan sip.Message) {
+	messages := make(chan sip.Message)
+	go l.transport.Run(messages)
+	for m := range messages {
+		if l.receive(m) {
+			mq <- m
+		}
+	}
+}
+
+// receive returns whether message is passed to transaction user
+func (l *Layer) receive(m sip.Message) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch m := m.(type) {
+	case sip.Request:
+		if key, ok := makeKey(m.Headers.Vias, m.Method); !ok {
+			return true
+		} else if st, ok := l.servers[key]; ok {
+			st.receive(m)
+			return false
+		} else if m.Method == sip.ACK {
+			if key, ok := dialogKey(&m.Headers); ok {
+				if st, ok := l.accepted[key]; ok {
+					st.ack()
+				}
+			}
+			return true
+		} else {
+			l.servers[key] = newServerTransaction(l, key, m)
+			return true
+		}
+	case sip.Response:
+		if m.Headers.CSeq == nil {
+			return true
+		} else if key, ok := makeKey(m.Headers.Vias, m.Headers.CSeq.Method); !ok {
+			return true
+		} else if ct, ok := l.clients[key]; ok {
+			return ct.receive(m)
+		} else {
+			cid, _ := m.GetHeaders().GetCallID()
+			log.Debug().Str("Call-ID", cid).
+				Str("where", "Layer.receive").
+				Int("Code", int(m.Code)).
+				Msg("Response does not match transaction")
+			return false
+		}
+	}
+	return true
+}
+
+func (l *Layer) Send(addr string, body []byte) error {
+	return l.transport.Send(addr, body)
+}
+
+// SendSIP starts client transaction for request or sends response
+// within its server transaction. ACK has no transaction of its own.
+// Connection of the transport is opened before the lock is taken, so
+// dialing does not hold up other transactions.
+func (l *Layer) SendSIP(m sip.Message) error {
+	if d, ok := l.transport.(transport.Dialer); ok {
+		if err := d.Dial(m); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch m := m.(type) {
+	case sip.Request:
+		if key, ok := makeKey(m.Headers.Vias, m.Method); !ok || m.Method == sip.ACK {
+			return l.transport.SendSIP(m)
+		} else if _, ok := l.clients[key]; ok {
+			return ErrTransactionTerminated
+		} else {
+			ct := newClientTransaction(l, key, m)
+			if err := ct.start(); err != nil {
+				ct.terminate()
+				return err
+			}
+			l.clients[key] = ct
+			return nil
+		}
+	case sip.Response:
+		if m.Headers.CSeq == nil {
+			return l.transport.SendSIP(m)
+		} else if key, ok := makeKey(m.Headers.Vias, m.Headers.CSeq.Method); !ok {
+			return l.transport.SendSIP(m)
+		} else if st, ok := l.servers[key]; ok {
+			return st.respond(m)
+		} else {
+			return l.transport.SendSIP(m)
+		}
+	}
+	return l.transport.SendSIP(m)
+}
+
+// MatchInvite returns INVITE of server transaction with the branch of
+// CANCEL, pending when INVITE has no final response yet (RFC 3261 9.2)
+func (l *Layer) MatchInvite(cancel sip.Request) (sip.Request, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if key, ok := makeKey(cancel.Headers.Vias, sip.INVITE); !ok {
+		return sip.Request{}, false, ErrTransactionNotExists
+	} else if st, ok := l.servers[key]; !ok {
+		return sip.Request{}, false, ErrTransactionNotExists
+	} else {
+		return st.request, st.state == Proceeding, nil
+	}
+}
+
+// timeout is delivered without lock, transaction user may be sending
+func (l *Layer) timeout(t Timeout) {
+	go func() {
+		l.timeouts <- t
+	}()
+}
+
+func (l *Layer) removeClient(ct *ClientTransaction) {
+	if l.clients[ct.key] == ct {
+		delete(l.clients, ct.key)
+	}
+}
+
+func (l *Layer) removeServer(st *ServerTransaction) {
+	if l.servers[st.key] == st {
+		delete(l.servers, st.key)
+	}
+	if l.accepted[st.dialog] == st {
+		delete(l.accepted, st.dialog)
+	}
+}
+
+func NewLayer(t transport.Transport, c clock.Clock) *Layer {
+	return &Layer{
+		transport: t,
+		clock:     c,
+		timeouts:  make(chan Timeout),
+		clients:   make(map[string]*ClientTransaction),
+		servers:   make(map[string]*ServerTransaction),
+		accepted:  make(map[string]*ServerTransaction),
+	}
+}
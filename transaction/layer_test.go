@@ -0,0 +1,386 @@
+package transaction
+
+import (
+	"errors"
+	"signal/clock"
+	"signal/sip"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testTransport struct {
+	mu   sync.Mutex
+	sent []sip.Message
+}
+
+func (t *testTransport) Run(mq chan sip.Message) {}
+
+func (t *testTransport) Send(addr string, body []byte) error {
+	return nil
+}
+
+func (t *testTransport) SendSIP(m sip.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, m)
+	return nil
+}
+
+func (t *testTransport) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sent)
+}
+
+func (t *testTransport) last() sip.Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sent[len(t.sent)-1]
+}
+
+func newTestLayer() (*Layer, *testTransport, *clock.Fake) {
+	tt := &testTransport{}
+	c := clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	return NewLayer(tt, c), tt, c
+}
+
+func testRequest(m sip.MethodType, branch string) sip.Request {
+	h := sip.NewHeaders()
+	h.PushVia(sip.Via{
+		Host:   "127.0.0.1:5060",
+		Branch: branch,
+	})
+	h.CallID = &sip.PlainHeader{
+		Value: "call-id",
+	}
+	h.From = &sip.Destination{Tag: "from-tag"}
+	h.To = &sip.Destination{}
+	h.CSeq = &sip.CSeq{
+		Value:  1,
+		Method: m,
+	}
+	return sip.NewRequest(m, "", sip.URI{Host: "127.0.0.1:5060"}, h)
+}
+
+func waitTimeout(t *testing.T, l *Layer) Timeout {
+	select {
+	case timeout := <-l.Timeouts():
+		return timeout
+	case <-time.After(time.Second):
+		t.Fatal("timeout is not reported")
+		return Timeout{}
+	}
+}
+
+func TestClientInviteTimeout(t *testing.T) {
+	l, tt, c := newTestLayer()
+
+	req := testRequest(sip.INVITE, sip.NewBranch())
+	if err := l.SendSIP(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Timer A doubles from T1: retransmissions at 1, 3, 7, 15, 31, 63 T1
+	c.Advance(T1)
+	if n := tt.count(); n != 2 {
+		t.Errorf("INVITE sent %d times after T1, expected 2", n)
+	}
+	c.Advance(63*T1 - time.Millisecond)
+	if n := tt.count(); n != 7 {
+		t.Errorf("INVITE sent %d times before Timer B, expected 7", n)
+	}
+	c.Advance(time.Millisecond)
+
+	timeout := waitTimeout(t, l)
+	if !errors.Is(timeout.Err, ErrTimeout) {
+		t.Errorf("Timeout error %v, expected %v", timeout.Err, ErrTimeout)
+	} else if timeout.Request.Method != sip.INVITE {
+		t.Errorf("Timeout method %s, expected %s", timeout.Request.Method, sip.INVITE)
+	} else if c.Pending() != 0 {
+		t.Errorf("Timers of terminated transaction are running")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.clients) != 0 {
+		t.Errorf("Terminated transaction is kept")
+	}
+}
+
+func TestClientInviteRinging(t *testing.T) {
+	l, tt, c := newTestLayer()
+
+	req := testRequest(sip.INVITE, sip.NewBranch())
+	if err := l.SendSIP(req); err != nil {
+		t.Fatal(err)
+	} else if !l.receive(req.MakeErrorResponse(sip.Ringing)) {
+		t.Fatal("Provisional response is not passed")
+	}
+
+	n := tt.count()
+	c.Advance(128 * T1)
+	select {
+	case timeout := <-l.Timeouts():
+		t.Errorf("Ringing INVITE timed out: %v", timeout.Err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if tt.count() != n {
+		t.Errorf("INVITE is retransmitted in Proceeding")
+	} else if !l.receive(req.MakeErrorResponse(sip.Ok)) {
+		t.Errorf("2xx after long ringing is not passed")
+	}
+}
+
+func TestReliableTransport(t *testing.T) {
+	l, tt, c := newTestLayer()
+
+	req := testRequest(sip.INVITE, sip.NewBranch())
+	req.Headers.Vias[0].Transport = "TCP"
+	if err := l.SendSIP(req); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(T1)
+	if n := tt.count(); n != 1 {
+		t.Errorf("INVITE sent %d times over TCP, expected 1", n)
+	}
+	if !l.receive(req.MakeErrorResponse(sip.BusyHere)) {
+		t.Fatal("Final response is not passed")
+	}
+	c.Advance(time.Millisecond)
+
+	invite := testRequest(sip.INVITE, sip.NewBranch())
+	invite.Headers.Vias[0].Transport = "TCP"
+	l.receive(invite)
+	if err := l.SendSIP(invite.MakeErrorResponse(sip.BusyHere)); err != nil {
+		t.Fatal(err)
+	}
+	n := tt.count()
+	c.Advance(T2)
+	if tt.count() != n {
+		t.Errorf("Response is retransmitted over TCP")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.clients) != 0 {
+		t.Errorf("Timer D is not zero over TCP")
+	}
+}
+
+func TestClientResponses(t *testing.T) {
+	l, tt, c := newTestLayer()
+
+	req := testRequest(sip.BYE, sip.NewBranch())
+	if err := l.SendSIP(req); err != nil {
+		t.Fatal(err)
+	}
+
+	trying := req.MakeErrorResponse(sip.Trying)
+	ok := req.MakeErrorResponse(sip.Ok)
+	if !l.receive(trying) {
+		t.Errorf("Provisional response is not passed")
+	} else if !l.receive(ok) {
+		t.Errorf("Final response is not passed")
+	} else if l.receive(ok) {
+		t.Errorf("Final response retransmission is passed")
+	}
+
+	other := testRequest(sip.BYE, sip.NewBranch())
+	if l.receive(other.MakeErrorResponse(sip.Ok)) {
+		t.Errorf("Response without transaction is passed")
+	}
+
+	n := tt.count()
+	c.Advance(T4)
+	if tt.count() != n {
+		t.Errorf("Request is retransmitted after final response")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.clients) != 0 {
+		t.Errorf("Transaction is not terminated by Timer K")
+	}
+}
+
+func TestServerInviteAccepted(t *testing.T) {
+	l, tt, c := newTestLayer()
+
+	req := testRequest(sip.INVITE, sip.NewBranch())
+	if !l.receive(req) {
+		t.Fatal("INVITE is not passed")
+	} else if l.receive(req) {
+		t.Errorf("INVITE retransmission is passed")
+	}
+
+	if err := l.SendSIP(req.MakeErrorResponse(sip.Ok)); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Advance(T1)
+	if n := tt.count(); n != 2 {
+		t.Errorf("2xx sent %d times after T1, expected 2", n)
+	}
+
+	// ACK for 2xx is new transaction matched by Call-ID and CSeq
+	ack := testRequest(sip.ACK, sip.NewBranch())
+	if !l.receive(ack) {
+		t.Errorf("ACK for 2xx is not passed")
+	}
+	c.Advance(64 * T1)
+	if n := tt.count(); n != 2 {
+		t.Errorf("2xx is retransmitted after ACK")
+	}
+
+	select {
+	case timeout := <-l.Timeouts():
+		t.Errorf("Unexpected timeout %v", timeout.Err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.servers) != 0 || len(l.accepted) != 0 {
+		t.Errorf("Transaction is not terminated by Timer L")
+	}
+}
+
+func TestServerInviteNoAck(t *testing.T) {
+	l, tt, c := newTestLayer()
+
+	req := testRequest(sip.INVITE, sip.NewBranch())
+	l.receive(req)
+	if err := l.SendSIP(req.MakeErrorResponse(sip.BusyHere)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Timer G doubles from T1 up to T2: 1, 3, 7, 15, 23 ... 63 T1
+	c.Advance(64 * T1)
+	timeout := waitTimeout(t, l)
+	if timeout.Response == nil || timeout.Response.Code != sip.BusyHere {
+		t.Errorf("Timeout without final response")
+	} else if n := tt.count(); n != 11 {
+		t.Errorf("Final response sent %d times, expected 11", n)
+	}
+}
+
+func TestServerInviteConfirmed(t *testing.T) {
+	l, tt, c := newTestLayer()
+
+	branch := sip.NewBranch()
+	req := testRequest(sip.INVITE, branch)
+	l.receive(req)
+	if err := l.SendSIP(req.MakeErrorResponse(sip.BusyHere)); err != nil {
+		t.Fatal(err)
+	} else if l.receive(testRequest(sip.ACK, branch)) {
+		t.Errorf("ACK for non-2xx is passed")
+	}
+
+	key, _ := makeKey(req.Headers.Vias, req.Method)
+	l.mu.Lock()
+	if state := l.servers[key].state; state != Confirmed {
+		t.Errorf("State %s, expected %s", state, Confirmed)
+	}
+	l.mu.Unlock()
+
+	c.Advance(T4)
+	if n := tt.count(); n != 1 {
+		t.Errorf("Final response is retransmitted after ACK")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.servers[key]; ok {
+		t.Errorf("Transaction is not terminated by Timer I")
+	}
+}
+
+func TestServerRetransmission(t *testing.T) {
+	l, tt, _ := newTestLayer()
+
+	invite := testRequest(sip.INVITE, sip.NewBranch())
+	l.receive(invite)
+	if l.receive(invite) {
+		t.Errorf("INVITE retransmission is passed")
+	} else if tt.count() != 0 {
+		t.Errorf("Response sent before transaction user answered")
+	}
+
+	if err := l.SendSIP(invite.MakeErrorResponse(sip.Ringing)); err != nil {
+		t.Fatal(err)
+	} else if l.receive(invite) {
+		t.Errorf("INVITE retransmission is passed")
+	} else if tt.count() != 2 {
+		t.Errorf("Provisional response sent %d times, expected 2", tt.count())
+	} else if resp, ok := tt.last().(sip.Response); !ok || resp.Code != sip.Ringing {
+		t.Errorf("Retransmission is not answered with the last response")
+	}
+
+	bye := testRequest(sip.BYE, sip.NewBranch())
+	l.receive(bye)
+	if err := l.SendSIP(bye.MakeErrorResponse(sip.Ok)); err != nil {
+		t.Fatal(err)
+	} else if l.receive(bye) {
+		t.Errorf("BYE retransmission is passed")
+	} else if resp, ok := tt.last().(sip.Response); !ok || resp.Code != sip.Ok {
+		t.Errorf("Retransmission is not answered with the last response")
+	}
+}
+
+func TestMatchInvite(t *testing.T) {
+	l, _, _ := newTestLayer()
+
+	branch := sip.NewBranch()
+	invite := testRequest(sip.INVITE, branch)
+	cancel := testRequest(sip.CANCEL, branch)
+	l.receive(invite)
+	if !l.receive(cancel) {
+		t.Fatal("CANCEL is not passed")
+	}
+
+	if req, pending, err := l.MatchInvite(cancel); err != nil {
+		t.Fatal(err)
+	} else if req.Method != sip.INVITE || !pending {
+		t.Errorf("CANCEL matched %s pending %t, expected pending INVITE", req.Method, pending)
+	}
+
+	if err := l.SendSIP(invite.MakeErrorResponse(sip.RequestTerminated)); err != nil {
+		t.Fatal(err)
+	} else if _, pending, err := l.MatchInvite(cancel); err != nil || pending {
+		t.Errorf("INVITE is pending after final response")
+	}
+
+	if _, _, err := l.MatchInvite(testRequest(sip.CANCEL, sip.NewBranch())); !errors.Is(err, ErrTransactionNotExists) {
+		t.Errorf("Error %v, expected %v", err, ErrTransactionNotExists)
+	}
+}
+
+func TestClientInviteAck(t *testing.T) {
+	l, tt, c := newTestLayer()
+
+	req := testRequest(sip.INVITE, sip.NewBranch())
+	if err := l.SendSIP(req); err != nil {
+		t.Fatal(err)
+	}
+
+	busy := req.MakeErrorResponse(sip.BusyHere)
+	if !l.receive(busy) {
+		t.Fatal("Final response is not passed")
+	} else if ack, ok := tt.last().(sip.Request); !ok || ack.Method != sip.ACK {
+		t.Fatal("ACK is not sent for non-2xx")
+	} else if ack.Headers.Vias[0].Branch != req.Headers.Vias[0].Branch {
+		t.Errorf("ACK branch %s, expected %s", ack.Headers.Vias[0].Branch, req.Headers.Vias[0].Branch)
+	}
+
+	n := tt.count()
+	if l.receive(busy) {
+		t.Errorf("Final response retransmission is passed")
+	} else if tt.count() != n+1 {
+		t.Errorf("ACK is not sent again for retransmission")
+	}
+	c.Advance(TIMER_D)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.clients) != 0 {
+		t.Errorf("Transaction is not terminated by Timer D")
+	}
+}
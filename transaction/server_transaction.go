@@ -0,0 +1,130 @@
+package transaction
+
+import (
+	"signal/sip"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ServerTransaction sends responses of transaction user for received
+// request (RFC 3261 17.2). 2xx for INVITE is retransmitted in Accepted
+// state until ACK or Timer L over any transport, as ACK for it is end
+// to end (RFC 3261 13.3.1.4, RFC 6026 7.1).
+type ServerTransaction struct {
+	transaction
+	invite   bool
+	acked    bool
+	dialog   string
+	response *sip.Response
+}
+
+func (st *ServerTransaction) respond(resp sip.Response) error {
+	if st.state != Trying && st.state != Proceeding {
+		return ErrTransactionTerminated
+	} else if err := st.layer.transport.SendSIP(resp); err != nil {
+		return err
+	}
+	st.response = &resp
+
+	if resp.Code.Class() == sip.Provisional {
+		st.state = Proceeding
+	} else if st.invite && resp.Code.Class() == sip.Success {
+		st.state = Accepted
+		st.startTimer("G", st.interval, st.onRetransmit)
+		st.startTimer("L", 64*T1, st.onTimeout)
+		if key, ok := dialogKey(resp.GetHeaders()); ok {
+			st.dialog = key
+			st.layer.accepted[key] = st
+		}
+	} else if st.invite {
+		st.state = Completed
+		if !st.reliable() {
+			st.startTimer("G", st.interval, st.onRetransmit)
+		}
+		st.startTimer("H", 64*T1, st.onTimeout)
+	} else {
+		st.state = Completed
+		st.startTimer("J", st.wait(64*T1), st.terminate)
+	}
+	return nil
+}
+
+// onRetransmit of Timer G, the final response until ACK
+func (st *ServerTransaction) onRetransmit() {
+	if err := st.layer.transport.SendSIP(*st.response); err != nil {
+		st.fail(err)
+	} else {
+		st.startTimer("G", st.backoff(true), st.onRetransmit)
+	}
+}
+
+// onTimeout of Timer H and Timer L, accepted INVITE ends normally when
+// ACK came
+func (st *ServerTransaction) onTimeout() {
+	if st.acked {
+		st.terminate()
+	} else {
+		st.fail(ErrTimeout)
+	}
+}
+
+func (st *ServerTransaction) fail(err error) {
+	log.Warn().Err(err).Str("Call-ID", st.callID()).
+		Str("where", "ServerTransaction.fail").
+		Str("Method", string(st.request.Method)).
+		Str("State", st.state.String()).
+		Msg("Transaction failed")
+	st.layer.timeout(Timeout{
+		Request:  st.request,
+		Response: st.response,
+		Err:      err,
+	})
+	st.terminate()
+}
+
+// receive absorbs retransmission of the request, the most recent
+// response is sent again (RFC 3261 17.2.1, 17.2.2)
+func (st *ServerTransaction) receive(req sip.Request) {
+	if req.Method == sip.ACK {
+		st.ack()
+	} else if st.response != nil && st.state != Confirmed {
+		log.Debug().Str("Call-ID", st.callID()).
+			Str("where", "ServerTransaction.receive").
+			Str("Method", string(req.Method)).
+			Int("Code", int(st.response.Code)).
+			Msg("Request retransmission, response sent again")
+		if err := st.layer.transport.SendSIP(*st.response); err != nil {
+			st.fail(err)
+		}
+	}
+}
+
+func (st *ServerTransaction) ack() {
+	st.stopTimer("G")
+	if st.state == Accepted {
+		st.acked = true
+	} else if st.state == Completed {
+		st.state = Confirmed
+		st.stopTimer("H")
+		st.startTimer("I", st.wait(T4), st.terminate)
+	}
+}
+
+func (st *ServerTransaction) terminate() {
+	st.state = Terminated
+	st.stopTimers()
+	st.layer.removeServer(st)
+}
+
+func newServerTransaction(l *Layer, key string, req sip.Request) *ServerTransaction {
+	if req.Method == sip.INVITE {
+		return &ServerTransaction{
+			transaction: newTransaction(l, key, req, Proceeding),
+			invite:      true,
+		}
+	} else {
+		return &ServerTransaction{
+			transaction: newTransaction(l, key, req, Trying),
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"signal/clock"
+	"signal/sip"
+	"time"
+)
+
+// Timer values of RFC 3261 17.1.1.1
+var (
+	T1 = 500 * time.Millisecond
+	T2 = 4 * time.Second
+	T4 = 5 * time.Second
+)
+
+// Timer D wait for response retransmissions over unreliable transport
+var TIMER_D = 32 * time.Second
+
+type State int
+
+const (
+	Calling State = iota
+	Trying
+	Proceeding
+	Completed
+	Confirmed
+	Accepted
+	Terminated
+)
+
+var STATES = map[State]string{
+	Calling:    "Calling",
+	Trying:     "Trying",
+	Proceeding: "Proceeding",
+	Completed:  "Completed",
+	Confirmed:  "Confirmed",
+	Accepted:   "Accepted",
+	Terminated: "Terminated",
+}
+
+func (s State) String() string {
+	return STATES[s]
+}
+
+var ErrTimeout = errors.New("transaction timeout")
+var ErrTransactionTerminated = errors.New("transaction terminated")
+var ErrTransactionNotExists = errors.New("transaction not exists")
+
+// Timeout reports transaction which ended without final response or
+// without ACK, Err is ErrTimeout or error of transport.
+type Timeout struct {
+	Request  sip.Request
+	Response *sip.Response
+	Err      error
+}
+
+// makeKey of transaction by top Via branch and method, ACK belongs to
+// INVITE transaction (RFC 3261 17.1.3, 17.2.3). Messages without branch
+// are handled statelessly.
+func makeKey(vias []sip.Via, method sip.MethodType) (string, bool) {
+	if len(vias) == 0 || vias[0].Branch == "" {
+		return "", false
+	} else if method == sip.ACK {
+		method = sip.INVITE
+	}
+	return fmt.Sprintf("%s:%s", vias[0].Branch, method), true
+}
+
+// dialogKey matches ACK for 2xx, sent as new transaction, with
+// accepted INVITE (RFC 3261 13.3.1.4)
+func dialogKey(hs *sip.Headers) (string, bool) {
+	if cid, err := hs.GetCallID(); err != nil {
+		return "", false
+	} else if cseq, err := hs.GetCSeq(); err != nil {
+		return "", false
+	} else {
+		return fmt.Sprintf("%s:%d", cid, cseq.Value), true
+	}
+}
+
+type transaction struct {
+	key      string
+	state    State
+	request  sip.Request
+	layer    *Layer
+	interval time.Duration
+	timers   map[string]clock.Timer
+}
+
+// startTimer runs f under lock of layer unless the timer was stopped
+// or restarted meanwhile
+func (t *transaction) startTimer(name string, d time.Duration, f func()) {
+	t.stopTimer(name)
+	var timer clock.Timer
+	timer = t.layer.clock.AfterFunc(d, func() {
+		t.layer.mu.Lock()
+		defer t.layer.mu.Unlock()
+		if t.timers[name] == timer {
+			delete(t.timers, name)
+			f()
+		}
+	})
+	t.timers[name] = timer
+}
+
+func (t *transaction) stopTimer(name string) {
+	if timer, ok := t.timers[name]; ok {
+		timer.Stop()
+		delete(t.timers, name)
+	}
+}
+
+func (t *transaction) stopTimers() {
+	for name := range t.timers {
+		t.stopTimer(name)
+	}
+}
+
+// backoff doubles retransmit interval, up to T2 when limited
+func (t *transaction) backoff(limited bool) time.Duration {
+	t.interval *= 2
+	if limited && t.interval > T2 {
+		t.interval = T2
+	}
+	return t.interval
+}
+
+// reliable transport of the request by its top Via, messages are not
+// retransmitted over it and no time is left for retransmissions
+// (RFC 3261 17.1.1.2, 17.1.2.2, 17.2.1, 17.2.2)
+func (t *transaction) reliable() bool {
+	vias := t.request.Headers.Vias
+	return len(vias) > 0 && vias[0].GetTransport() != "UDP"
+}
+
+// wait for retransmissions, none over reliable transport
+func (t *transaction) wait(d time.Duration) time.Duration {
+	if t.reliable() {
+		return 0
+	}
+	return d
+}
+
+func (t *transaction) callID() string {
+	cid, _ := t.request.GetHeaders().GetCallID()
+	return cid
+}
+
+func newTransaction(l *Layer, key string, req sip.Request, state State) transaction {
+	return transaction{
+		key:      key,
+		state:    state,
+		request:  req,
+		layer:    l,
+		interval: T1,
+		timers:   make(map[string]clock.Timer),
+	}
+}
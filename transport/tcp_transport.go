@@ -1 +1,310 @@
 package transport
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"signal/clock"
+	"signal/sip"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNoContentLength = errors.New("message on stream has no content length")
+var ErrMessageTooLarge = errors.New("message on stream is too large")
+var ErrTransportNotRunning = errors.New("transport is not running")
+
+// MAX_HEADER_SIZE and MAX_BODY_SIZE of message on stream, larger one
+// closes the connection
+const MAX_HEADER_SIZE = 16 * 1024
+const MAX_BODY_SIZE = 64 * 1024
+
+// TCP_IDLE_TIMEOUT closes connection which got no message for the time
+var TCP_IDLE_TIMEOUT = 3 * time.Minute
+
+// TCP_DIAL_TIMEOUT limits opening of connection to the remote address
+var TCP_DIAL_TIMEOUT = 10 * time.Second
+
+// TCP_DEFAULT_PORT of target URI without port (RFC 3261 19.1.2)
+const TCP_DEFAULT_PORT = "5060"
+
+// TCPConnection is stream of SIP messages with one remote address
+type TCPConnection struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	clock  clock.Clock
+	mu     sync.Mutex
+}
+
+// Listen passes messages of the stream to mq until the connection is
+// closed or idle for TCP_IDLE_TIMEOUT of the clock
+func (c *TCPConnection) Listen(mq chan sip.Message) {
+	defer c.Close()
+
+	for {
+		idle := c.clock.AfterFunc(TCP_IDLE_TIMEOUT, c.onIdle)
+		body, err := readMessage(c.reader)
+		idle.Stop()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Info().Err(err).Str("transport", "TCP").
+					Str("remote", c.conn.RemoteAddr().String()).
+					Msg("Connection closed")
+			}
+			return
+		} else {
+			deliver(mq, body, c.conn.RemoteAddr())
+		}
+	}
+}
+
+// Send body on the connection, addr is the remote one of the connection
+func (c *TCPConnection) Send(addr net.Addr, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(body)
+	return err
+}
+
+func (c *TCPConnection) Close() {
+	c.conn.Close()
+}
+
+func (c *TCPConnection) onIdle() {
+	log.Info().Str("transport", "TCP").
+		Str("remote", c.conn.RemoteAddr().String()).
+		Msg("Idle connection closed")
+	c.Close()
+}
+
+func NewTCPConnection(conn net.Conn, c clock.Clock) *TCPConnection {
+	return &TCPConnection{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		clock:  c,
+	}
+}
+
+// readMessage frames the next message of the stream by its Content-Length,
+// CRLF between messages is keepalive (RFC 3261 18.3, RFC 5626 4.4.1)
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	var head bytes.Buffer
+	length := -1
+	for {
+		line, err := readLine(r, MAX_HEADER_SIZE-head.Len())
+		if err != nil {
+			return nil, err
+		} else if trimmed := strings.TrimSpace(line); trimmed == "" && head.Len() == 0 {
+			continue
+		} else if trimmed == "" {
+			head.WriteString(line)
+			break
+		} else if name, value, ok := strings.Cut(trimmed, ":"); ok {
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "content-length", "l":
+				if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+					return nil, err
+				} else if length > MAX_BODY_SIZE {
+					return nil, ErrMessageTooLarge
+				}
+			}
+		}
+		head.WriteString(line)
+	}
+
+	if length < 0 {
+		return nil, ErrNoContentLength
+	}
+	body := make([]byte, head.Len()+length)
+	copy(body, head.Bytes())
+	if _, err := io.ReadFull(r, body[head.Len():]); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// readLine up to limit bytes, longer line is ErrMessageTooLarge
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if line = append(line, chunk...); len(line) > limit {
+			return "", ErrMessageTooLarge
+		} else if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return string(line), nil
+	}
+}
+
+// TCPTransport keeps one connection per remote address for messages both
+// ways, so responses go back on the connection of the request
+type TCPTransport struct {
+	laddr    *net.TCPAddr
+	clock    clock.Clock
+	listener *net.TCPListener
+	mq       chan sip.Message
+	mu       sync.Mutex
+	conns    map[string]*TCPConnection
+}
+
+func (t *TCPTransport) Run(mq chan sip.Message) {
+	if listener, err := net.ListenTCP("tcp", t.laddr); err != nil {
+		log.Err(err)
+	} else {
+		t.mu.Lock()
+		t.listener = listener
+		t.mq = mq
+		t.mu.Unlock()
+		defer t.listener.Close()
+
+		for {
+			if conn, err := t.listener.Accept(); errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				continue
+			} else if c := NewTCPConnection(conn, t.clock); t.serve(conn.RemoteAddr().String(), c) != c {
+				c.Close()
+			}
+		}
+	}
+}
+
+// serve connection under key until it is closed, connection served
+// under the key already is kept and returned in place of c
+func (t *TCPTransport) serve(key string, c *TCPConnection) *TCPConnection {
+	t.mu.Lock()
+	if served, ok := t.conns[key]; ok {
+		t.mu.Unlock()
+		return served
+	}
+	t.conns[key] = c
+	mq := t.mq
+	t.mu.Unlock()
+
+	go func() {
+		c.Listen(mq)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.conns[key] == c {
+			delete(t.conns, key)
+		}
+	}()
+	return c
+}
+
+// connection to rawAddr, it is opened when there is none. Connection
+// opened meanwhile by another sender is used and the own one closed.
+func (t *TCPTransport) connection(rawAddr string) (*TCPConnection, error) {
+	t.mu.Lock()
+	c, ok := t.conns[rawAddr]
+	running := t.mq != nil
+	t.mu.Unlock()
+	if ok {
+		return c, nil
+	} else if !running {
+		return nil, ErrTransportNotRunning
+	}
+
+	conn, err := net.DialTimeout("tcp", rawAddr, TCP_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	c = NewTCPConnection(conn, t.clock)
+	if served := t.serve(rawAddr, c); served != c {
+		c.Close()
+		return served, nil
+	}
+	return c, nil
+}
+
+func (t *TCPTransport) Send(rawAddr string, body []byte) error {
+	if c, err := t.connection(rawAddr); err != nil {
+		return err
+	} else {
+		return c.Send(c.conn.RemoteAddr(), body)
+	}
+}
+
+// SendSIP sends m on connection of its address, request to target with
+// transport=tcp opens connection to the target when there is none and
+// response opens one to the source of request (RFC 3261 18.1.1, 18.2.2)
+func (t *TCPTransport) SendSIP(m sip.Message) error {
+	if rawAddr, err := t.target(m); err != nil {
+		return err
+	} else {
+		return t.Send(rawAddr, m.Data())
+	}
+}
+
+// Dial opens connection SendSIP of m uses
+func (t *TCPTransport) Dial(m sip.Message) error {
+	if rawAddr, err := t.target(m); err != nil {
+		return err
+	} else {
+		_, err := t.connection(rawAddr)
+		return err
+	}
+}
+
+// target address of m, connection of its source or target of request
+func (t *TCPTransport) target(m sip.Message) (string, error) {
+	var rawAddr string
+	if addr := m.GetSourceAddres(); addr != nil {
+		rawAddr = addr.String()
+	}
+	t.mu.Lock()
+	_, ok := t.conns[rawAddr]
+	t.mu.Unlock()
+	if req, isRequest := m.(sip.Request); !ok && isRequest && strings.EqualFold(req.URI.Transport, "tcp") {
+		rawAddr = req.URI.Host
+		if _, _, err := net.SplitHostPort(rawAddr); err != nil {
+			rawAddr = net.JoinHostPort(rawAddr, TCP_DEFAULT_PORT)
+		}
+	} else if rawAddr == "" {
+		return "", ErrConnectionDoesNotExists
+	}
+	return rawAddr, nil
+}
+
+// Addr the transport listens on, nil until Run
+func (t *TCPTransport) Addr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Addr()
+}
+
+// Close the listener and every connection
+func (t *TCPTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	for _, c := range t.conns {
+		c.Close()
+	}
+}
+
+func NewTCPTransport(ip string, port int, c clock.Clock) *TCPTransport {
+	return &TCPTransport{
+		clock: c,
+		conns: make(map[string]*TCPConnection),
+		laddr: &net.TCPAddr{
+			IP:   net.ParseIP(ip),
+			Port: port,
+		},
+	}
+}
@@ -0,0 +1,253 @@
+package transport_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"signal/clock"
+	"signal/sip"
+	"signal/transport"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var TCP_OPTIONS = "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\n" +
+	"Via: SIP/2.0/TCP 127.0.0.1:5070;branch=z9hG4bK-%d\r\n" +
+	"Max-Forwards: 70\r\n" +
+	"To: <sip:bob@127.0.0.1>\r\n" +
+	"From: <sip:alice@127.0.0.1>;tag=1928301774\r\n" +
+	"Call-ID: a84b4c76e66710\r\n" +
+	"CSeq: %d OPTIONS\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"l: %d\r\n" +
+	"\r\n" +
+	"%s"
+
+func options(cseq int, body string) string {
+	return fmt.Sprintf(TCP_OPTIONS, cseq, cseq, len(body), body)
+}
+
+func receive(t *testing.T, mq chan sip.Message) sip.Message {
+	select {
+	case m := <-mq:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("Message is not received")
+		return nil
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestTCPTransport$ signal/transport
+func TestTCPTransport(t *testing.T) {
+	tt := transport.NewTCPTransport("127.0.0.1", 0, clock.REAL)
+	mq := make(chan sip.Message)
+	go tt.Run(mq)
+	defer tt.Close()
+
+	var addr net.Addr
+	for i := 0; i < 100 && addr == nil; i++ {
+		time.Sleep(time.Millisecond)
+		addr = tt.Addr()
+	}
+	if addr == nil {
+		t.Fatal("Transport does not listen")
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// keepalive, two messages in one segment and one split in two
+	stream := "\r\n\r\n" + options(1, "") + options(2, "hello") + options(3, "bye")
+	if _, err := conn.Write([]byte(stream[:len(stream)-10])); err != nil {
+		t.Fatal(err)
+	}
+	first, second := receive(t, mq), receive(t, mq)
+	if cseq, _ := first.GetHeaders().GetCSeq(); cseq.Value != 1 {
+		t.Errorf("First message CSeq %d", cseq.Value)
+	} else if cseq, _ := second.GetHeaders().GetCSeq(); cseq.Value != 2 || second.GetHeaders().ContentLength.Value != 5 {
+		t.Errorf("Second message %s", second.Data())
+	}
+	if _, err := conn.Write([]byte(stream[len(stream)-10:])); err != nil {
+		t.Fatal(err)
+	} else if third := receive(t, mq); third.GetHeaders().ContentLength.Value != 3 {
+		t.Errorf("Split message %s", third.Data())
+	}
+
+	// response goes back on the connection of the request
+	if resp, err := first.(sip.Request).MakeResponse(sip.Ok); err != nil {
+		t.Fatal(err)
+	} else if err := tt.SendSIP(resp); err != nil {
+		t.Fatal(err)
+	} else {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		} else if line != "SIP/2.0 200 OK\r\n" {
+			t.Errorf("Response %q", line)
+		}
+	}
+
+	// request with malformed header is passed on to be answered 400
+	malformed := strings.Replace(options(4, ""), "CSeq: 4", "CSeq: abc", 1)
+	if _, err := conn.Write([]byte(malformed)); err != nil {
+		t.Fatal(err)
+	} else if req, ok := receive(t, mq).(sip.Request); !ok {
+		t.Error("Malformed request is not passed")
+	} else if err := req.Validate(); err == nil {
+		t.Errorf("Malformed request is valid: %s", req.Data())
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestTCPMessageTooLarge$ signal/transport
+func TestTCPMessageTooLarge(t *testing.T) {
+	tt := transport.NewTCPTransport("127.0.0.1", 0, clock.REAL)
+	mq := make(chan sip.Message)
+	go tt.Run(mq)
+	defer tt.Close()
+
+	var addr net.Addr
+	for i := 0; i < 100 && addr == nil; i++ {
+		time.Sleep(time.Millisecond)
+		addr = tt.Addr()
+	}
+	if addr == nil {
+		t.Fatal("Transport does not listen")
+	}
+
+	huge := strings.Replace(options(1, ""), "l: 0", "l: 99999999999999", 1)
+	long := strings.Replace(options(2, ""), "Max-Forwards: 70", "Subject: "+strings.Repeat("x", transport.MAX_HEADER_SIZE), 1)
+	for _, m := range []string{huge, long} {
+		if conn, err := net.Dial("tcp", addr.String()); err != nil {
+			t.Fatal(err)
+		} else {
+			defer conn.Close()
+			conn.Write([]byte(m))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			var ne net.Error
+			if _, err := conn.Read(make([]byte, 1)); err == nil || errors.As(err, &ne) && ne.Timeout() {
+				t.Errorf("Connection is not closed: %v", err)
+			}
+		}
+	}
+	select {
+	case m := <-mq:
+		t.Errorf("Too large message is passed %s", m.Data())
+	default:
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestTCPIdleTimeout$ signal/transport
+func TestTCPIdleTimeout(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	tt := transport.NewTCPTransport("127.0.0.1", 0, fake)
+	mq := make(chan sip.Message)
+	go tt.Run(mq)
+	defer tt.Close()
+
+	var addr net.Addr
+	for i := 0; i < 100 && addr == nil; i++ {
+		time.Sleep(time.Millisecond)
+		addr = tt.Addr()
+	}
+	if addr == nil {
+		t.Fatal("Transport does not listen")
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(options(1, ""))); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, mq)
+
+	// the message restarted the idle timer
+	for i := 0; i < 100 && fake.Pending() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	fake.Advance(transport.TCP_IDLE_TIMEOUT - time.Second)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var ne net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("Connection closed before idle timeout: %v", err)
+	}
+
+	fake.Advance(time.Second)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.As(err, &ne) && ne.Timeout() {
+		t.Errorf("Idle connection is not closed: %v", err)
+	}
+}
+
+// go clean -testcache && go test -timeout 30s -run ^TestTCPDial$ signal/transport
+func TestTCPDial(t *testing.T) {
+	remote, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			if conn, err := remote.Accept(); err != nil {
+				return
+			} else {
+				accepted <- conn
+			}
+		}
+	}()
+
+	tt := transport.NewTCPTransport("127.0.0.1", 0, clock.REAL)
+	defer tt.Close()
+	if err := tt.Send(remote.Addr().String(), []byte("ping")); !errors.Is(err, transport.ErrTransportNotRunning) {
+		t.Errorf("Dial before Run: %v", err)
+	}
+
+	mq := make(chan sip.Message)
+	go tt.Run(mq)
+	for i := 0; i < 100 && tt.Addr() == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// concurrent senders share one connection
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tt.Send(remote.Addr().String(), []byte("ping")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	open, pings := 0, 0
+	for done := false; !done; {
+		select {
+		case conn := <-accepted:
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			b, err := io.ReadAll(conn)
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				open++
+			}
+			pings += strings.Count(string(b), "ping")
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	if open != 1 || pings != 10 {
+		t.Errorf("%d connections open, %d of 10 messages received", open, pings)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"net"
 	"signal/sip"
+
+	"github.com/rs/zerolog/log"
 )
 
 type TransportType string
@@ -17,8 +19,29 @@ type Transport interface {
 	// Close(net.Addr)
 }
 
+// Dialer opens connection for message before it is sent, so the sender
+// does not wait for it while holding its lock
+type Dialer interface {
+	Dial(sip.Message) error
+}
+
 type Connection interface {
 	Listen(chan sip.Message)
 	Send(net.Addr, []byte) error
 	Close()
 }
+
+// deliver message of body to mq, request with malformed header is passed
+// on so the server answers it 400, malformed response is dropped
+// (RFC 3261 8.2.2, 8.1.3.1)
+func deliver(mq chan sip.Message, body []byte, addr net.Addr) {
+	m, err := sip.NewMessage(body, addr)
+	if _, isRequest := m.(sip.Request); err != nil && isRequest {
+		log.Info().Err(err).Str("transport", "recived").Msg("Malformed request")
+		mq <- m
+	} else if err != nil {
+		log.Error().Err(err).Str("transport", "recived").Msg(string(body))
+	} else {
+		mq <- m
+	}
+}
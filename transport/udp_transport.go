@@ -9,6 +9,10 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// MAX_DATAGRAM_SIZE is the largest UDP payload, a message with SDP is
+// often larger than MTU and comes fragmented (RFC 3261 18.1.1)
+const MAX_DATAGRAM_SIZE = 65535
+
 type UDPTransport struct {
 	conn    *net.UDPConn
 	clients []*net.UDPConn
@@ -22,19 +26,16 @@ func (t *UDPTransport) Run(mq chan sip.Message) {
 		t.conn = conn
 		defer t.conn.Close()
 
+		buffer := make([]byte, MAX_DATAGRAM_SIZE)
 		for {
-			buffer := make([]byte, 1024)
 			if l, addr, err := t.conn.ReadFrom(buffer); err != nil {
 				continue
 			} else {
-				body := string(buffer[:l])
-				// log.Debug().Str("body", body).Msg("Receivd message")
-				p := sip.NewParser(body)
-				if m, err := sip.NewMessage(p, addr); err != nil {
-					log.Error().Err(err).Str("transport", "recived").Err(err).Msg(body)
-				} else {
-					mq <- m
-				}
+				// decoded message keeps referencing its body, so it gets a
+				// copy of the datagram and the buffer is reused
+				body := append([]byte(nil), buffer[:l]...)
+				// log.Debug().Bytes("body", body).Msg("Receivd message")
+				deliver(mq, body, addr)
 			}
 		}
 	}
@@ -2,20 +2,34 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"signal/media"
+	"signal/sdp"
 	"signal/sip"
+	"signal/transaction"
 
-	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
 )
 
+// UAC keeps dialog of every fork of INVITE by To tag, dialog is the one
+// of the first 2xx or the last early one until then. Early media is taken
+// from the first fork sending session, earlyTag is its To tag.
 type UAC struct {
 	callID       string
 	tag          string
-	toTag        string
-	from         sip.Destination
+	dialog       *sip.Dialog
+	dialogs      map[string]*sip.Dialog
+	forks        map[string]*sip.Request
+	invite       *sip.Request
+	ack          *sip.Request
+	offer        func(sip.Request) sip.Request
+	reinviting   bool
+	updating     bool
+	negotiated   bool
+	allowsUpdate bool
+	earlyTag     string
+	answered     int
+	rseqs        map[string]int
+	sessionTimer sessionTimer
 	server       *Server
 	meeting      *Meeting
 	registration *Registration
@@ -26,7 +40,28 @@ type UAC struct {
 func (uac *UAC) handleRequest(ctx context.Context, cid string, req *sip.Request) error {
 	uac.history.writeRequest(req)
 	switch req.Method {
+	case sip.INVITE:
+		return uac.onReinvite(ctx, cid, req)
+	case sip.UPDATE:
+		return uac.onUpdate(ctx, cid, req)
+	case sip.ACK:
+		if req.SDP.Origin != nil {
+			if err := uac.mediaChanal.Accept(&req.SDP); err != nil {
+				log.Info().Err(err).Str("Call-ID", cid).
+					Str("where", "UAC.handleRequest").
+					Msg("Answer in ACK is not accepted")
+			}
+		}
 	case sip.BYE:
+		if uac.dialog == nil {
+			return uac.sendResponse(sip.CallLegDoesNotExist, nil)
+		} else if err := uac.dialog.ReceiveRequest(*req); err != nil {
+			log.Info().Err(err).Str("Call-ID", cid).
+				Str("where", "UAC.handleRequest").
+				Msg("Request rejected by dialog")
+			return uac.sendResponse(sip.InternalServerError, nil)
+		}
+		uac.sessionTimer.stop()
 		uac.sendResponse(sip.Ok, nil)
 		uac.meeting.scenario.uacEmit(UAC_END, ctx, uac)
 	}
@@ -36,11 +71,72 @@ func (uac *UAC) handleRequest(ctx context.Context, cid string, req *sip.Request)
 func (uac *UAC) handleResponse(ctx context.Context, cid string, resp *sip.Response) error {
 	uac.history.writeResponse(resp)
 
-	if to, err := resp.GetHeaders().GetTo(); err == nil && to.Tag != "" {
-		uac.toTag = to.Tag
+	cseq, err := resp.GetHeaders().GetCSeq()
+	if err != nil {
+		return err
+	} else if cseq.Method == sip.UPDATE {
+		return uac.onOfferResponse(ctx, cid, cseq.Method, resp)
+	} else if cseq.Method != sip.INVITE {
+		log.Info().Str("Call-ID", uac.callID).
+			Str("where", "UAC.handleResponse").
+			Str("meeting_id", uac.meeting.id.String()).
+			Str("Method", string(cseq.Method)).
+			Int("code", int(resp.Code)).
+			Msg("Response received")
+		return nil
+	} else if to, err := resp.GetHeaders().GetTo(); err != nil {
+		return err
+	} else if resp.Code.Class() == sip.Success && to.Tag != "" && uac.dialog != nil && uac.dialog.State == sip.DialogConfirmed && to.Tag != uac.dialog.RemoteTag {
+		return uac.dropFork(resp)
+	} else if to.Tag != "" && resp.Code > sip.Trying && resp.Code < sip.MultipleChoices {
+		if err := uac.updateDialog(*resp); err != nil {
+			return err
+		}
 	}
 
-	switch resp.Code {
+	if resp.Code.Class() == sip.Provisional && resp.Headers.IsRequired(sip.OPTION_100REL) {
+		if ok, err := uac.prack(resp); err != nil || !ok {
+			return err
+		}
+	}
+
+	if resp.Code.Class() == sip.Success && uac.answered == cseq.Value {
+		return uac.ackAgain(cseq.Value)
+	} else if resp.Code.Class() == sip.Success {
+		uac.answered = cseq.Value
+	}
+
+	if uac.invite.Headers.To.Tag != "" {
+		return uac.onOfferResponse(ctx, cid, cseq.Method, resp)
+	} else if resp.Code == sip.SessionIntervalTooSmall && uac.sessionTimer.tooSmall(resp) {
+		return uac.recall()
+	} else if resp.Code.Class() == sip.Provisional && resp.SDP.Origin != nil && !uac.negotiated {
+		if uac.earlyTag != "" && uac.earlyTag != resp.Headers.To.Tag {
+			log.Info().Str("Call-ID", uac.callID).
+				Str("where", "UAC.handleResponse").
+				Str("meeting_id", uac.meeting.id.String()).
+				Str("tag", resp.Headers.To.Tag).
+				Msg("Early media of another fork is ignored")
+		} else if err := uac.mediaChanal.Accept(&resp.SDP); err != nil {
+			log.Info().Err(err).Str("Call-ID", uac.callID).
+				Str("where", "UAC.handleResponse").
+				Str("meeting_id", uac.meeting.id.String()).
+				Msg("Early media is not accepted")
+		} else {
+			uac.earlyTag = resp.Headers.To.Tag
+		}
+	} else if resp.Code.Class() == sip.Success && resp.SDP.Origin != nil {
+		if err := uac.mediaChanal.Accept(&resp.SDP); err != nil {
+			log.Info().Err(err).Str("Call-ID", uac.callID).
+				Str("where", "UAC.handleResponse").
+				Str("meeting_id", uac.meeting.id.String()).
+				Msg("Answer is not accepted")
+		} else {
+			uac.negotiated = true
+		}
+	}
+
+	switch resp.Code.Equivalent() {
 	case sip.Trying:
 		log.Info().Str("Call-ID", uac.callID).
 			Str("where", "UAC.onTrying").
@@ -52,89 +148,440 @@ func (uac *UAC) handleResponse(ctx context.Context, cid string, resp *sip.Respon
 			Str("meeting_id", uac.meeting.id.String()).
 			Msg("Ringing received")
 		uac.meeting.scenario.uacEmit(UAC_RINGING, ctx, uac)
+	case sip.SessionProgress:
+		log.Info().Str("Call-ID", uac.callID).
+			Str("where", "UAC.onSessionProgress").
+			Str("meeting_id", uac.meeting.id.String()).
+			Str("early_media", uac.earlyTag).
+			Msg("Session progress received")
+		uac.meeting.scenario.uacEmit(UAC_PROGRESS, ctx, uac)
 	case sip.Ok:
 		log.Info().Str("Call-ID", uac.callID).
-			Str("where", "UAC.onRinging").
+			Str("where", "UAC.onOk").
 			Str("meeting_id", uac.meeting.id.String()).
-			Msg("Ringing received")
+			Msg("Ok received")
+		if uac.sessionTimer.received(resp) {
+			uac.startSessionTimer()
+		} else {
+			uac.sessionTimer.stop()
+		}
 		uac.meeting.scenario.uacEmit(UAC_READY, ctx, uac)
+	default:
+		if resp.Code.Class() >= sip.Redirection {
+			log.Info().Str("Call-ID", uac.callID).
+				Str("where", "UAC.onFailure").
+				Str("meeting_id", uac.meeting.id.String()).
+				Int("code", int(resp.Code)).
+				Str("reason", resp.GetReason()).
+				Msg("Call failed")
+			uac.meeting.scenario.uacEmit(UAC_END, ctx, uac)
+		}
 	}
 	return nil
 }
 
-func (uac *UAC) getBaseHeaders() sip.Headers {
-	headers := sip.NewHeaders(nil)
-	headers.CallID = &sip.PlainHeader{
-		Value: uac.callID,
+// ackAgain answers retransmission of 2xx handled once for the INVITE,
+// ACK is sent again when it was sent already, before that the caller
+// has not acknowledged yet and the retransmission is absorbed (RFC 3261
+// 13.2.2.4)
+func (uac *UAC) ackAgain(cseq int) error {
+	if uac.ack == nil || uac.ack.Headers.CSeq.Value != cseq {
+		log.Debug().Str("Call-ID", uac.callID).
+			Str("where", "UAC.ackAgain").
+			Str("meeting_id", uac.meeting.id.String()).
+			Msg("2xx retransmission before ACK absorbed")
+		return nil
 	}
-	headers.From = &uac.from
-	headers.To = &uac.registration.Destination
-	headers.To.Tag = uac.toTag
-	headers.Vias = make([]sip.Via, 0)
-	host := fmt.Sprintf("%s:%d", viper.GetString("server.host"), viper.GetInt("server.port"))
-	headers.PushVia(sip.Via{
-		Host:     host,
-		Branch:   uuid.NewString(),
-		Received: "",
-		Rport:    false,
+	log.Info().Str("Call-ID", uac.callID).
+		Str("where", "UAC.ackAgain").
+		Str("meeting_id", uac.meeting.id.String()).
+		Msg("2xx retransmission, ACK sent again")
+	return uac.server.transport.SendSIP(*uac.ack)
+}
+
+// onReinvite changes session of the established call, re-INVITE while
+// own one is pending is answered 491 (RFC 3261 14.2)
+func (uac *UAC) onReinvite(ctx context.Context, cid string, req *sip.Request) error {
+	if uac.dialog == nil {
+		return uac.sendResponse(sip.CallLegDoesNotExist, nil)
+	} else if err := uac.dialog.ReceiveRequest(*req); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "UAC.onReinvite").
+			Msg("Request rejected by dialog")
+		return uac.sendResponse(sip.InternalServerError, nil)
+	} else if uac.dialog.State == sip.DialogEarly {
+		return uac.sendResponse(sip.InternalServerError, nil)
+	} else if uac.reinviting || uac.updating || uac.ack == nil {
+		return uac.sendResponse(sip.RequestPending, nil)
+	} else if intervalTooSmall(req) {
+		return uac.sendResponse(sip.SessionIntervalTooSmall, withMinSE)
+	}
+
+	mode := uac.mediaChanal.Mode()
+	if f, err := answerSession(uac.mediaChanal, req); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "UAC.onReinvite").
+			Msg("Offer is not acceptable")
+		return uac.sendResponse(sip.NotAcceptableHere, nil)
+	} else if err := uac.sendResponse(sip.Ok, f); err != nil {
+		return err
+	} else if uac.mediaChanal.Mode() != mode {
+		uac.meeting.relayHold(uac.callID, req.SDP.Mode())
+	}
+	return nil
+}
+
+// onOfferResponse ends re-INVITE or UPDATE of the server, 2xx gives the
+// answer and INVITE is acknowledged, 491 is retried later, 422 at once
+// with larger interval and the call ends when the callee lost the dialog
+// (RFC 3261 14.1, RFC 3311 5.1, RFC 4028 7.3)
+func (uac *UAC) onOfferResponse(ctx context.Context, cid string, m sip.MethodType, resp *sip.Response) error {
+	if resp.Code.Class() == sip.Provisional {
+		return nil
+	}
+
+	if m == sip.INVITE {
+		uac.reinviting = false
+	} else {
+		uac.updating = false
+	}
+	if resp.Code.Class() == sip.Success {
+		log.Info().Str("Call-ID", uac.callID).
+			Str("where", "UAC.onOfferResponse").
+			Str("meeting_id", uac.meeting.id.String()).
+			Str("Method", string(m)).
+			Msg("Offer accepted")
+		uac.dialog.ReceiveResponse(*resp)
+		if resp.SDP.Origin != nil {
+			if err := uac.mediaChanal.Accept(&resp.SDP); err != nil {
+				log.Info().Err(err).Str("Call-ID", cid).
+					Str("where", "UAC.onOfferResponse").
+					Msg("Answer is not accepted")
+			}
+		}
+		if uac.sessionTimer.received(resp) {
+			uac.startSessionTimer()
+		} else {
+			uac.sessionTimer.stop()
+		}
+		if m == sip.INVITE {
+			return uac.accept()
+		}
+	} else if resp.Code == sip.RequestPending {
+		offer := uac.offer
+		uac.server.later(glareDelay(true), func(ctx context.Context) {
+			if m == sip.INVITE && uac.isEstablished() {
+				uac.reinvite(offer)
+			} else if m == sip.UPDATE && uac.dialog != nil {
+				uac.update(offer)
+			}
+		})
+	} else if resp.Code == sip.SessionIntervalTooSmall && uac.sessionTimer.tooSmall(resp) {
+		if m == sip.INVITE {
+			return uac.reinvite(uac.offer)
+		}
+		return uac.update(uac.offer)
+	} else if resp.Code == sip.CallLegDoesNotExist || resp.Code == sip.RequestTimeout {
+		uac.bye()
+		uac.meeting.scenario.uacEmit(UAC_END, ctx, uac)
+	} else {
+		log.Info().Str("Call-ID", cid).
+			Str("where", "UAC.onOfferResponse").
+			Str("Method", string(m)).
+			Int("code", int(resp.Code)).
+			Msg("Offer rejected, session is not changed")
+	}
+	return nil
+}
+
+// onUpdate changes session before or after the call is answered, offer
+// while own one is pending, INVITE included, is answered 491 (RFC 3311
+// 5.2)
+func (uac *UAC) onUpdate(ctx context.Context, cid string, req *sip.Request) error {
+	if uac.dialog == nil {
+		return uac.sendResponse(sip.CallLegDoesNotExist, nil)
+	} else if err := uac.dialog.ReceiveRequest(*req); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "UAC.onUpdate").
+			Msg("Request rejected by dialog")
+		return uac.sendResponse(sip.InternalServerError, nil)
+	} else if intervalTooSmall(req) {
+		return uac.sendResponse(sip.SessionIntervalTooSmall, withMinSE)
+	} else if req.SDP.Origin == nil {
+		return uac.sendResponse(sip.Ok, nil)
+	} else if uac.reinviting || uac.updating || !uac.negotiated {
+		return uac.sendResponse(sip.RequestPending, nil)
+	}
+
+	mode := uac.mediaChanal.Mode()
+	if answer, err := uac.mediaChanal.Answer(&req.SDP); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "UAC.onUpdate").
+			Msg("Offer is not acceptable")
+		return uac.sendResponse(sip.NotAcceptableHere, nil)
+	} else if err := uac.sendResponse(sip.Ok, withSession(answer)); err != nil {
+		return err
+	} else if uac.mediaChanal.Mode() != mode {
+		uac.meeting.relayHold(uac.callID, req.SDP.Mode())
+	}
+	return nil
+}
+
+// prack acknowledges reliable provisional response taking answer it
+// carries, retransmission and response out of RSeq order are not
+// processed again (RFC 3262 4)
+func (uac *UAC) prack(resp *sip.Response) (bool, error) {
+	d, ok := uac.dialogs[resp.Headers.To.Tag]
+	if resp.Headers.RSeq == nil || !ok {
+		return false, nil
+	}
+	rseq := resp.Headers.RSeq.Value
+	if last, ok := uac.rseqs[resp.Headers.To.Tag]; ok && rseq != last+1 {
+		return false, nil
+	}
+	uac.rseqs[resp.Headers.To.Tag] = rseq
+
+	if resp.SDP.Origin != nil && !uac.negotiated {
+		if err := uac.mediaChanal.Accept(&resp.SDP); err != nil {
+			log.Info().Err(err).Str("Call-ID", uac.callID).
+				Str("where", "UAC.prack").
+				Msg("Answer is not accepted")
+		} else {
+			uac.negotiated = true
+			uac.earlyTag = resp.Headers.To.Tag
+		}
+	}
+	_, err := uac.sendInDialog(d, sip.PRACK, func(req sip.Request) sip.Request {
+		req.Headers.RAck = &sip.RAck{
+			RSeq:   rseq,
+			CSeq:   resp.Headers.CSeq.Value,
+			Method: resp.Headers.CSeq.Method,
+		}
+		return req
 	})
-	headers.CSeq = &sip.CSeq{
-		Value:  0,
-		Method: sip.INVITE,
+	return true, err
+}
+
+// dropFork acknowledges 2xx of another fork once the call is confirmed
+// and ends its dialog by BYE, retransmission of the 2xx gets the same
+// ACK (RFC 3261 13.2.2.4)
+func (uac *UAC) dropFork(resp *sip.Response) error {
+	tag := resp.Headers.To.Tag
+	if ack, ok := uac.forks[tag]; ok {
+		return uac.server.transport.SendSIP(*ack)
 	}
-	headers.ContentLength = &sip.IntegerHeader{
-		Value: 0,
+
+	log.Info().Str("Call-ID", uac.callID).
+		Str("where", "UAC.dropFork").
+		Str("meeting_id", uac.meeting.id.String()).
+		Str("tag", tag).
+		Msg("2xx of another fork, its dialog is ended")
+	d, ok := uac.dialogs[tag]
+	if !ok {
+		var err error
+		if d, err = sip.NewUACDialog(*uac.invite, *resp); err != nil {
+			return err
+		}
+		d.LocalCSeq = resp.Headers.CSeq.Value
+		uac.dialogs[tag] = d
+	}
+	d.ReceiveResponse(*resp)
+	if ack, err := uac.sendInDialog(d, sip.ACK, func(req sip.Request) sip.Request {
+		req.Headers.CSeq.Value = resp.Headers.CSeq.Value
+		return req
+	}); err != nil {
+		return err
+	} else {
+		uac.forks[tag] = &ack
+	}
+	_, err := uac.sendInDialog(d, sip.BYE, nil)
+	return err
+}
+
+// earlyDialogs of forks which sent provisional response but no 2xx
+func (uac *UAC) earlyDialogs() []*sip.Dialog {
+	early := make([]*sip.Dialog, 0)
+	for _, d := range uac.dialogs {
+		if d.State == sip.DialogEarly {
+			early = append(early, d)
+		}
+	}
+	return early
+}
+
+// supported option tags of INVITE, reliable provisional responses are
+// required or not offered by the account of the callee (RFC 3262 4)
+func (uac *UAC) supported(req sip.Request) sip.Request {
+	switch uac.registration.Account.reliability() {
+	case ReliabilityNone:
+		req.Headers.Supported = make([]sip.OptionTag, 0)
+		for _, tag := range uac.server.supportedOptionTags() {
+			if tag != sip.OPTION_100REL {
+				req.Headers.Supported = append(req.Headers.Supported, tag)
+			}
+		}
+	case ReliabilityRequired:
+		req.Headers.Supported = uac.server.supportedOptionTags()
+		req.Headers.Require = []sip.OptionTag{sip.OPTION_100REL}
+	default:
+		req.Headers.Supported = uac.server.supportedOptionTags()
+	}
+	return req
+}
+
+// handleTimeout fails the call when the far end does not answer
+func (uac *UAC) handleTimeout(ctx context.Context, cid string, t transaction.Timeout) error {
+	log.Info().Err(t.Err).Str("Call-ID", cid).
+		Str("where", "UAC.handleTimeout").
+		Str("meeting_id", uac.meeting.id.String()).
+		Str("Method", string(t.Request.Method)).
+		Msg("Transaction timeout")
+	uac.sessionTimer.stop()
+	uac.meeting.scenario.uacEmit(UAC_END, ctx, uac)
+	return nil
+}
+
+// failure to relay to the caller when INVITE failed, the code of the
+// callee or 408 when it did not answer. 503 of the callee is not about
+// this server, it is relayed as 500 (RFC 3261 16.7)
+func (uac *UAC) failure() sip.ResponseCode {
+	if resp := uac.history.getFinal(uac.invite.Headers.CSeq.Value); resp == nil {
+		return sip.RequestTimeout
+	} else if resp.Code == sip.ServiceUnavailable {
+		return sip.InternalServerError
+	} else {
+		return resp.Code
 	}
+}
 
-	return headers
+// updateDialog by 1xx or 2xx for INVITE with To tag, each fork gets
+// early dialog of its own and the first 2xx confirms the call (RFC 3261
+// 12.1.2, 13.2.2.4)
+func (uac *UAC) updateDialog(resp sip.Response) error {
+	if resp.Headers.Allows != nil {
+		uac.allowsUpdate = resp.Headers.IsAllowed(sip.UPDATE)
+	}
+	tag := resp.Headers.To.Tag
+	if d, ok := uac.dialogs[tag]; ok {
+		d.ReceiveResponse(resp)
+		if uac.dialog.State == sip.DialogEarly {
+			uac.dialog = d
+		}
+	} else if d, err := sip.NewUACDialog(*uac.invite, resp); err != nil {
+		return err
+	} else {
+		uac.dialogs[tag] = d
+		if uac.dialog == nil || uac.dialog.State == sip.DialogEarly {
+			uac.dialog = d
+		}
+	}
+	return nil
 }
 
+// sendRequest sends request within the dialog to the callee. ACK for
+// 2xx is a transaction of its own with CSeq number of INVITE, CANCEL
+// belongs to INVITE transaction.
 func (uac *UAC) sendRequest(m sip.MethodType, f func(sip.Request) sip.Request) error {
+	if m == sip.CANCEL {
+		return uac.cancel()
+	} else if uac.dialog == nil {
+		return sip.ErrDialogNotExists
+	}
+
+	if req, err := uac.sendInDialog(uac.dialog, m, f); err != nil {
+		return err
+	} else if m == sip.ACK {
+		uac.ack = &req
+	} else if m == sip.INVITE {
+		uac.invite = &req
+		uac.ack = nil
+	}
 	return nil
 }
 
+// sendInDialog sends request within dialog d of the call or of a fork
+func (uac *UAC) sendInDialog(d *sip.Dialog, m sip.MethodType, f func(sip.Request) sip.Request) (sip.Request, error) {
+	var req sip.Request
+	if m == sip.ACK {
+		req = d.NewAck(uac.invite.Headers.CSeq.Value)
+	} else {
+		req = d.NewRequest(m)
+	}
+	req.Headers.PushVia(uac.server.via())
+	req.Headers.MaxForwards = &sip.IntegerHeader{
+		Value: sip.DEFAULT_MAX_FORWARDS,
+	}
+	if m == sip.INVITE || m == sip.UPDATE {
+		req.Headers.Contacts = uac.invite.Headers.Contacts
+		req.Headers.Supported = uac.server.supportedOptionTags()
+		req = uac.sessionTimer.request(req)
+	}
+	req.SourceAddres = uac.registration.SourceAddres
+
+	if f != nil {
+		req = f(req)
+	}
+
+	return req, uac.server.transport.SendSIP(req)
+}
+
+// sendResponse answers the last received request, 2xx for INVITE or
+// UPDATE of the established call starts the session timer
 func (uac *UAC) sendResponse(c sip.ResponseCode, f func(sip.Response) sip.Response) error {
-	return nil
+	req := uac.history.topRequest()
+	if resp, err := req.MakeResponse(c); err != nil {
+		return err
+	} else {
+		refreshed := false
+		if m := resp.Headers.CSeq.Method; (m == sip.INVITE || m == sip.UPDATE) && c.Class() == sip.Success {
+			resp.Headers.Contacts = []sip.Contact{uac.server.contact(uac.dialog.LocalURI.Login)}
+			if refreshed = uac.isEstablished(); refreshed {
+				resp = uac.sessionTimer.answer(req, resp)
+			}
+		}
+		if f != nil {
+			resp = f(resp)
+		}
+
+		if err := uac.server.transport.SendSIP(resp); err != nil {
+			return err
+		} else if refreshed {
+			uac.startSessionTimer()
+		}
+		return nil
+	}
 }
 
-func (uac *UAC) call(from sip.Destination) error {
+func (uac *UAC) call(from sip.Destination, maxForwards int) error {
 	log.Info().Str("Call-ID", uac.callID).
 		Str("where", "UAC.call").
 		Msg("Start call")
-	h := sip.NewHeaders(nil)
+	h := sip.NewHeaders()
 	h.CallID = &sip.PlainHeader{
 		Value: uac.callID,
 	}
-	h.Contacts = uac.registration.Contacts
 	h.From = &from
-	h.To = &uac.registration.Destination
-	h.To.Tag = ""
+	to := uac.registration.Destination
+	to.Tag = ""
+	h.To = &to
 	h.Vias = make([]sip.Via, 0)
-	host := fmt.Sprintf("%s:%d", viper.GetString("server.host"), viper.GetInt("server.port"))
-	h.PushVia(sip.Via{
-		Host:     host,
-		Branch:   uuid.NewString(),
-		Received: "",
-		Rport:    false,
-	})
+	h.PushVia(uac.server.via())
 	h.ContentLength = &sip.IntegerHeader{
 		Value: 0,
 	}
 	h.CSeq = &sip.CSeq{
-		Value:  0,
+		Value:  1,
 		Method: sip.INVITE,
 	}
-	h.Contacts = make([]sip.Contact, 0)
-	h.Contacts = append(h.Contacts, sip.Contact{
-		Address: sip.Address{
-			URI: sip.URI{
-				Host:  host,
-				Login: from.Address.URI.Login,
-			},
-		},
-	})
+	h.Contacts = []sip.Contact{uac.server.contact(from.Address.URI.Login)}
+
+	h.Allows = ALLOWED_METHODS
+	h.MaxForwards = &sip.IntegerHeader{
+		Value: maxForwards,
+	}
 
-	req := sip.NewRequest(sip.INVITE, "", h.To.Address.URI, h)
+	req := uac.sessionTimer.request(uac.supported(sip.NewRequest(sip.INVITE, "", h.To.Address.URI, h)))
+	req.SDP = *uac.mediaChanal.Offer(sdp.Sendrecv)
 	req.SourceAddres = uac.registration.SourceAddres
 	if err := uac.server.transport.SendSIP(req); err != nil {
 		log.Error().Err(err).Str("Call-ID", uac.callID).
@@ -142,19 +589,119 @@ func (uac *UAC) call(from sip.Destination) error {
 			Msg("While start call")
 		return err
 	} else {
+		uac.invite = &req
 		return nil
 	}
 }
 
+// recall sends INVITE again with interval raised by 422, it is a new
+// transaction with the next CSeq of the Call-ID (RFC 4028 7.3)
+func (uac *UAC) recall() error {
+	req := uac.sessionTimer.request(*uac.invite)
+	req.Headers.Vias = []sip.Via{uac.server.via()}
+	req.Headers.CSeq = &sip.CSeq{
+		Value:  uac.invite.Headers.CSeq.Value + 1,
+		Method: sip.INVITE,
+	}
+	log.Info().Str("Call-ID", uac.callID).
+		Str("where", "UAC.recall").
+		Int("Session-Expires", uac.sessionTimer.interval).
+		Msg("Session interval too small, call again")
+	if err := uac.server.transport.SendSIP(req); err != nil {
+		log.Error().Err(err).Str("Call-ID", uac.callID).
+			Str("where", "UAC.recall").
+			Msg("While call again")
+		return err
+	}
+	uac.invite = &req
+	return nil
+}
+
+// cancel INVITE which has no final response yet (RFC 3261 9.1)
+func (uac *UAC) cancel() error {
+	if uac.invite == nil || uac.history.isAnswered(uac.invite.Headers.CSeq.Value) {
+		return nil
+	}
+	log.Info().Str("Call-ID", uac.callID).
+		Str("where", "UAC.cancel").
+		Msg("Cancel call")
+	if err := uac.server.transport.SendSIP(uac.invite.MakeCancel()); err != nil {
+		log.Error().Err(err).Str("Call-ID", uac.callID).
+			Str("where", "UAC.cancel").
+			Msg("While cancel call")
+		return err
+	}
+	return nil
+}
+
 func (uac *UAC) accept() error {
 	return uac.sendRequest(sip.ACK, nil)
 }
 
+func (uac *UAC) bye() error {
+	uac.sessionTimer.stop()
+	return uac.sendRequest(sip.BYE, nil)
+}
+
+// reinvite changes session of established call, f sets the offer
+func (uac *UAC) reinvite(f func(sip.Request) sip.Request) error {
+	if err := uac.sendRequest(sip.INVITE, f); err != nil {
+		return err
+	}
+	uac.offer = f
+	uac.reinviting = true
+	return nil
+}
+
+// update changes session before or after the call is answered, f sets
+// the offer (RFC 3311 5.1)
+func (uac *UAC) update(f func(sip.Request) sip.Request) error {
+	if err := uac.sendRequest(sip.UPDATE, f); err != nil {
+		return err
+	}
+	uac.offer = f
+	uac.updating = true
+	return nil
+}
+
+// refresh session by UPDATE without offer when the callee allows it,
+// re-INVITE offers the current session, pending offer refreshes anyway
+// (RFC 4028 7.4)
+func (uac *UAC) refresh() error {
+	if uac.reinviting || uac.updating {
+		return nil
+	} else if uac.canUpdate() {
+		return uac.update(nil)
+	}
+	return uac.reinvite(offerSession(uac.mediaChanal, uac.mediaChanal.Mode()))
+}
+
+// startSessionTimer after 2xx of INVITE or UPDATE, missed refresh ends
+// the meeting
+func (uac *UAC) startSessionTimer() {
+	uac.sessionTimer.start(uac.server, uac.refresh, func(ctx context.Context) {
+		uac.meeting.expire(ctx, uac.callID)
+	})
+}
+
+// canUpdate when the callee allows UPDATE within the dialog
+func (uac *UAC) canUpdate() bool {
+	return uac.dialog != nil && uac.allowsUpdate
+}
+
+func (uac *UAC) isEstablished() bool {
+	return uac.dialog != nil && uac.dialog.State == sip.DialogConfirmed && uac.ack != nil
+}
+
 func NewUAC(cid string, s *Server, r *Registration) (*UAC, error) {
 	uac := &UAC{
 		callID:       cid,
 		server:       s,
 		registration: r,
+		dialogs:      make(map[string]*sip.Dialog),
+		forks:        make(map[string]*sip.Request),
+		rseqs:        make(map[string]int),
+		sessionTimer: newSessionTimer(),
 		history:      NewHistory(),
 	}
 
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"math/rand"
 	"signal/media"
 	"signal/sip"
+	"signal/transaction"
+	"strconv"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/spf13/viper"
+	"github.com/rs/zerolog/log"
 )
 
 type UAS struct {
@@ -17,6 +20,19 @@ type UAS struct {
 	meeting      *Meeting
 	registration *Registration
 	history      *History
+	dialog       *sip.Dialog
+	ack          *sip.Request
+	offer        func(sip.Request) sip.Request
+	reinviting   bool
+	updating     bool
+	negotiated   bool
+	reliable     bool
+	answered     bool
+	confirmed    bool
+	rseq         int
+	provisional  *sip.Response
+	afterPrack   func() error
+	sessionTimer sessionTimer
 	mediaChanal  *media.MediaChanal
 }
 
@@ -24,60 +40,284 @@ func (uas *UAS) handleRequest(ctx context.Context, cid string, req *sip.Request)
 	uas.history.writeRequest(req)
 
 	switch req.Method {
+	case sip.INVITE:
+		return uas.onReinvite(ctx, cid, req)
+	case sip.UPDATE:
+		return uas.onUpdate(ctx, cid, req)
+	case sip.PRACK:
+		return uas.onPrack(ctx, cid, req)
 	case sip.ACK:
-		uas.meeting.scenario.uasEmit(UAS_READY, ctx, uas)
-	case sip.CANCEL, sip.BYE:
+		initial := req.Headers.CSeq.Value == uas.history.getInvite().Headers.CSeq.Value
+		if initial && uas.confirmed {
+			// retransmission of ACK for the initial 2xx (RFC 3261 13.3.1.4)
+			return nil
+		} else if req.SDP.Origin != nil {
+			if err := uas.mediaChanal.Accept(&req.SDP); err != nil {
+				log.Info().Err(err).Str("Call-ID", cid).
+					Str("where", "UAS.handleRequest").
+					Msg("Answer in ACK is not accepted")
+			} else {
+				uas.negotiated = true
+			}
+		}
+		if initial {
+			uas.confirmed = true
+			uas.meeting.scenario.uasEmit(UAS_READY, ctx, uas)
+		}
+	case sip.CANCEL:
 		uas.sendResponse(sip.Ok, nil)
+		uas.respond(uas.history.getInvite(), sip.RequestTerminated, nil)
+		uas.meeting.scenario.uasEmit(UAS_CANCEL, ctx, uas)
 		uas.meeting.scenario.uasEmit(UAS_END, ctx, uas)
+	case sip.BYE:
+		if uas.dialog == nil {
+			return uas.sendResponse(sip.CallLegDoesNotExist, nil)
+		} else if err := uas.dialog.ReceiveRequest(*req); err != nil {
+			log.Info().Err(err).Str("Call-ID", cid).
+				Str("where", "UAS.handleRequest").
+				Msg("Request rejected by dialog")
+			return uas.sendResponse(sip.InternalServerError, nil)
+		}
+		uas.sessionTimer.stop()
+		uas.sendResponse(sip.Ok, nil)
+		uas.meeting.scenario.uasEmit(UAS_END, ctx, uas)
+	}
+	return nil
+}
+
+// onReinvite changes session of the established call, re-INVITE while
+// own one is pending is answered 491 (RFC 3261 14.2)
+func (uas *UAS) onReinvite(ctx context.Context, cid string, req *sip.Request) error {
+	if uas.dialog == nil {
+		return uas.sendResponse(sip.CallLegDoesNotExist, nil)
+	} else if err := uas.dialog.ReceiveRequest(*req); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "UAS.onReinvite").
+			Msg("Request rejected by dialog")
+		return uas.sendResponse(sip.InternalServerError, nil)
+	} else if uas.dialog.State == sip.DialogEarly {
+		return uas.sendResponse(sip.InternalServerError, nil)
+	} else if uas.reinviting || uas.updating {
+		return uas.sendResponse(sip.RequestPending, nil)
+	} else if intervalTooSmall(req) {
+		return uas.sendResponse(sip.SessionIntervalTooSmall, withMinSE)
+	}
+
+	mode := uas.mediaChanal.Mode()
+	if f, err := answerSession(uas.mediaChanal, req); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "UAS.onReinvite").
+			Msg("Offer is not acceptable")
+		return uas.sendResponse(sip.NotAcceptableHere, nil)
+	} else if err := uas.sendResponse(sip.Ok, f); err != nil {
+		return err
+	} else if uas.mediaChanal.Mode() != mode {
+		uas.meeting.relayHold(uas.callID, req.SDP.Mode())
+	}
+	return nil
+}
+
+// onUpdate changes session before or after the call is answered, offer
+// while own one is pending is answered 491 and offer before the one of
+// INVITE is answered gets 500 (RFC 3311 5.2)
+func (uas *UAS) onUpdate(ctx context.Context, cid string, req *sip.Request) error {
+	if uas.dialog == nil {
+		return uas.sendResponse(sip.CallLegDoesNotExist, nil)
+	} else if err := uas.dialog.ReceiveRequest(*req); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "UAS.onUpdate").
+			Msg("Request rejected by dialog")
+		return uas.sendResponse(sip.InternalServerError, nil)
+	} else if intervalTooSmall(req) {
+		return uas.sendResponse(sip.SessionIntervalTooSmall, withMinSE)
+	} else if req.SDP.Origin == nil {
+		return uas.sendResponse(sip.Ok, nil)
+	} else if uas.reinviting || uas.updating {
+		return uas.sendResponse(sip.RequestPending, nil)
+	} else if !uas.negotiated {
+		return uas.sendResponse(sip.InternalServerError, withRetryAfter)
+	}
+
+	mode := uas.mediaChanal.Mode()
+	if answer, err := uas.mediaChanal.Answer(&req.SDP); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "UAS.onUpdate").
+			Msg("Offer is not acceptable")
+		return uas.sendResponse(sip.NotAcceptableHere, nil)
+	} else if err := uas.sendResponse(sip.Ok, withSession(answer)); err != nil {
+		return err
+	} else if uas.mediaChanal.Mode() != mode {
+		uas.meeting.relayHold(uas.callID, req.SDP.Mode())
+	}
+	return nil
+}
+
+// withRetryAfter of 0 to 10 seconds, the peer sends its offer again once
+// the one of INVITE is answered (RFC 3311 5.2)
+func withRetryAfter(resp sip.Response) sip.Response {
+	resp.Headers.Set("Retry-After", strconv.Itoa(rand.Intn(11)))
+	return resp
+}
+
+// onPrack acknowledges the reliable provisional response, PRACK answers
+// its offer or makes a new one (RFC 3262 3, 5)
+func (uas *UAS) onPrack(ctx context.Context, cid string, req *sip.Request) error {
+	if uas.dialog == nil {
+		return uas.sendResponse(sip.CallLegDoesNotExist, nil)
+	} else if err := uas.dialog.ReceiveRequest(*req); err != nil {
+		log.Info().Err(err).Str("Call-ID", cid).
+			Str("where", "UAS.onPrack").
+			Msg("Request rejected by dialog")
+		return uas.sendResponse(sip.InternalServerError, nil)
+	} else if p := uas.provisional; p == nil || req.Headers.RAck == nil || *req.Headers.RAck != (sip.RAck{
+		RSeq:   p.Headers.RSeq.Value,
+		CSeq:   p.Headers.CSeq.Value,
+		Method: p.Headers.CSeq.Method,
+	}) {
+		return uas.sendResponse(sip.CallLegDoesNotExist, nil)
+	}
+
+	provisional := uas.provisional
+	uas.provisional = nil
+	var f func(sip.Response) sip.Response
+	if req.SDP.Origin != nil && provisional.SDP.Origin != nil && !uas.negotiated {
+		if err := uas.mediaChanal.Accept(&req.SDP); err != nil {
+			log.Info().Err(err).Str("Call-ID", cid).
+				Str("where", "UAS.onPrack").
+				Msg("Answer in PRACK is not accepted")
+		} else {
+			uas.negotiated = true
+		}
+	} else if req.SDP.Origin != nil {
+		if answer, err := uas.mediaChanal.Answer(&req.SDP); err != nil {
+			log.Info().Err(err).Str("Call-ID", cid).
+				Str("where", "UAS.onPrack").
+				Msg("Offer is not acceptable")
+			return uas.sendResponse(sip.NotAcceptableHere, nil)
+		} else {
+			f = withSession(answer)
+		}
+	}
+
+	if err := uas.sendResponse(sip.Ok, f); err != nil {
+		return err
+	} else if next := uas.afterPrack; next != nil {
+		uas.afterPrack = nil
+		return next()
 	}
 	return nil
 }
 
 func (uas *UAS) handleResponse(ctx context.Context, cid string, resp *sip.Response) error {
 	uas.history.writeResponse(resp)
-	switch resp.Code {
+	if cseq, err := resp.GetHeaders().GetCSeq(); err != nil {
+		return err
+	} else if cseq.Method == sip.INVITE || cseq.Method == sip.UPDATE {
+		return uas.onOfferResponse(ctx, cid, cseq.Method, resp)
+	}
+	switch resp.Code.Equivalent() {
 	case sip.Ok:
 		uas.meeting.scenario.uasEmit(UAS_END, ctx, uas)
 	}
 	return nil
 }
 
-func (uas *UAS) getBaseHeaders() sip.Headers {
-	headers := sip.NewHeaders(nil)
-	invite := uas.history.getInvite()
-	copy(headers.Vias, invite.Headers.Vias)
-	host := fmt.Sprintf("%s:%d", viper.GetString("server.host"), viper.GetInt("server.port"))
-	headers.PushVia(sip.Via{
-		Host:     host,
-		Branch:   uuid.NewString(),
-		Received: "",
-		Rport:    false,
-	})
-	to, _ := invite.GetHeaders().GetTo()
-	to.Tag = uas.tag
-	headers.To = &to
-	from, _ := invite.GetHeaders().GetFrom()
-	headers.From = &from
-	headers.CallID = &sip.PlainHeader{
-		Value: uas.callID,
+// onOfferResponse ends re-INVITE or UPDATE of the server, 2xx gives the
+// answer and INVITE is acknowledged, 491 is retried later, 422 at once
+// with larger interval and the call ends when the caller lost the dialog
+// (RFC 3261 14.1, RFC 3311 5.1, RFC 4028 7.3)
+func (uas *UAS) onOfferResponse(ctx context.Context, cid string, m sip.MethodType, resp *sip.Response) error {
+	if resp.Code.Class() == sip.Provisional {
+		return nil
+	} else if resp.Code.Class() == sip.Success && m == sip.INVITE && uas.ack != nil && uas.ack.Headers.CSeq.Value == resp.Headers.CSeq.Value {
+		return uas.server.transport.SendSIP(*uas.ack)
 	}
-	topRequest := uas.history.topRequest()
-	cseq, _ := topRequest.GetHeaders().GetCSeq()
-	headers.CSeq = &cseq
-	headers.ContentLength = &sip.IntegerHeader{
-		Value: 0,
+
+	if m == sip.INVITE {
+		uas.reinviting = false
+	} else {
+		uas.updating = false
 	}
+	if resp.Code.Class() == sip.Success {
+		uas.dialog.ReceiveResponse(*resp)
+		if resp.SDP.Origin != nil {
+			if err := uas.mediaChanal.Accept(&resp.SDP); err != nil {
+				log.Info().Err(err).Str("Call-ID", cid).
+					Str("where", "UAS.onOfferResponse").
+					Msg("Answer is not accepted")
+			}
+		}
+		if uas.sessionTimer.received(resp) {
+			uas.startSessionTimer()
+		} else {
+			uas.sessionTimer.stop()
+		}
+		if m == sip.INVITE {
+			return uas.sendRequest(sip.ACK, nil)
+		}
+	} else if resp.Code == sip.RequestPending {
+		offer := uas.offer
+		uas.server.later(glareDelay(false), func(ctx context.Context) {
+			if m == sip.INVITE && uas.isEstablished() {
+				uas.reinvite(offer)
+			} else if m == sip.UPDATE && uas.dialog != nil {
+				uas.update(offer)
+			}
+		})
+	} else if resp.Code == sip.SessionIntervalTooSmall && uas.sessionTimer.tooSmall(resp) {
+		if m == sip.INVITE {
+			return uas.reinvite(uas.offer)
+		}
+		return uas.update(uas.offer)
+	} else if resp.Code == sip.CallLegDoesNotExist || resp.Code == sip.RequestTimeout {
+		uas.bye()
+		uas.meeting.scenario.uasEmit(UAS_END, ctx, uas)
+	} else {
+		log.Info().Str("Call-ID", cid).
+			Str("where", "UAS.onOfferResponse").
+			Str("Method", string(m)).
+			Int("code", int(resp.Code)).
+			Msg("Offer rejected, session is not changed")
+	}
+	return nil
+}
 
-	return headers
+// handleTimeout ends the call, accepted INVITE which got no ACK is
+// closed with BYE (RFC 3261 13.3.1.4)
+func (uas *UAS) handleTimeout(ctx context.Context, cid string, t transaction.Timeout) error {
+	log.Info().Err(t.Err).Str("Call-ID", cid).
+		Str("where", "UAS.handleTimeout").
+		Str("Method", string(t.Request.Method)).
+		Msg("Transaction timeout")
+	uas.sessionTimer.stop()
+	if t.Request.Method == sip.INVITE && t.Response != nil && t.Response.Code.Class() == sip.Success {
+		if err := uas.bye(); err != nil {
+			log.Error().Err(err).Str("Call-ID", cid).
+				Str("where", "UAS.handleTimeout").
+				Msg("While send BYE")
+		}
+	}
+	uas.meeting.scenario.uasEmit(UAS_END, ctx, uas)
+	return nil
 }
 
+// sendRequest sends request within the dialog to the caller
 func (uas *UAS) sendRequest(m sip.MethodType, f func(sip.Request) sip.Request) error {
-	headers := uas.getBaseHeaders()
-
-	invite := uas.history.getInvite()
-	from, _ := invite.GetHeaders().GetFrom()
+	if uas.dialog == nil {
+		return sip.ErrDialogNotExists
+	}
 
-	req := sip.NewRequest(m, "", from.Address.URI, headers)
+	req := uas.dialog.NewRequest(m)
+	req.Headers.PushVia(uas.server.via())
+	req.Headers.MaxForwards = &sip.IntegerHeader{
+		Value: sip.DEFAULT_MAX_FORWARDS,
+	}
+	if m == sip.INVITE || m == sip.UPDATE {
+		req.Headers.Contacts = []sip.Contact{uas.server.contact(uas.dialog.LocalURI.Login)}
+		req.Headers.Supported = uas.server.supportedOptionTags()
+		req = uas.sessionTimer.request(req)
+	}
+	req.SourceAddres = uas.history.getInvite().GetSourceAddres()
 
 	if f != nil {
 		req = f(req)
@@ -85,23 +325,121 @@ func (uas *UAS) sendRequest(m sip.MethodType, f func(sip.Request) sip.Request) e
 
 	if err := uas.server.transport.SendSIP(req); err != nil {
 		return err
+	} else if m == sip.ACK {
+		uas.ack = &req
 	}
 	return nil
 }
 
+// sendResponse answers the last received request
 func (uas *UAS) sendResponse(c sip.ResponseCode, f func(sip.Response) sip.Response) error {
-	headers := uas.getBaseHeaders()
-
-	resp := sip.NewResponse(c, sip.ResponseCodes[int(c)], headers)
+	return uas.respond(uas.history.topRequest(), c, f)
+}
 
-	if f != nil {
-		resp = f(resp)
+// rejectReliability answers 420 when the caller requires reliable
+// provisional responses the account does not use and 421 when the
+// account requires them but the caller does not support (RFC 3262 3)
+func (uas *UAS) rejectReliability(req *sip.Request) (bool, error) {
+	rel := uas.registration.Account.reliability()
+	if rel == ReliabilityNone && req.Headers.IsRequired(sip.OPTION_100REL) {
+		return true, uas.respond(req, sip.BadExtension, func(resp sip.Response) sip.Response {
+			resp.Headers.Unsupported = []sip.OptionTag{sip.OPTION_100REL}
+			return resp
+		})
+	} else if rel == ReliabilityRequired && !req.Headers.IsSupported(sip.OPTION_100REL) {
+		return true, uas.respond(req, sip.ExtensionRequired, func(resp sip.Response) sip.Response {
+			resp.Headers.Require = []sip.OptionTag{sip.OPTION_100REL}
+			return resp
+		})
 	}
+	uas.reliable = rel != ReliabilityNone && req.Headers.IsSupported(sip.OPTION_100REL)
+	return false, nil
+}
 
-	if err := uas.server.transport.SendSIP(resp); err != nil {
+// retransmitProvisional sends reliable provisional response again with
+// doubling interval until PRACK, INVITE is rejected after 64*T1 (RFC
+// 3262 3)
+func (uas *UAS) retransmitProvisional(resp *sip.Response, interval, elapsed time.Duration) {
+	uas.server.later(interval, func(ctx context.Context) {
+		if uas.provisional != resp {
+			return
+		} else if elapsed += interval; elapsed >= 64*transaction.T1 {
+			log.Info().Str("Call-ID", uas.callID).
+				Str("where", "UAS.retransmitProvisional").
+				Msg("No PRACK for reliable provisional response")
+			uas.respond(uas.history.getInvite(), sip.InternalServerError, nil)
+			uas.meeting.scenario.uasEmit(UAS_END, ctx, uas)
+		} else if err := uas.server.transport.SendSIP(*resp); err != nil {
+			log.Error().Err(err).Str("Call-ID", uas.callID).
+				Str("where", "UAS.retransmitProvisional").
+				Msg("While retransmit provisional response")
+		} else if next := 2 * interval; elapsed+next > 64*transaction.T1 {
+			uas.retransmitProvisional(resp, 64*transaction.T1-elapsed, elapsed)
+		} else {
+			uas.retransmitProvisional(resp, next, elapsed)
+		}
+	})
+}
+
+// respond keeps Via of req so the response goes through its server
+// transaction, 1xx and 2xx for INVITE create the dialog. 1xx is sent
+// reliably when the caller supports it and no other is pending, 2xx for
+// INVITE or UPDATE starts the session timer.
+func (uas *UAS) respond(req *sip.Request, c sip.ResponseCode, f func(sip.Response) sip.Response) error {
+	if resp, err := req.MakeResponse(c); err != nil {
 		return err
+	} else {
+		to := *resp.Headers.To
+		to.Tag = uas.tag
+		resp.Headers.To = &to
+
+		if req.Method == sip.UPDATE && c.Class() == sip.Success {
+			resp.Headers.Contacts = []sip.Contact{uas.server.contact(to.Address.URI.Login)}
+		} else if req.Method == sip.INVITE && c > sip.Trying && c < sip.MultipleChoices {
+			resp.Headers.Contacts = []sip.Contact{uas.server.contact(to.Address.URI.Login)}
+			resp.Headers.Allows = ALLOWED_METHODS
+			if uas.dialog == nil {
+				if uas.dialog, err = sip.NewUASDialog(*req, resp); err != nil {
+					return err
+				}
+				uas.dialog.DropLocalRoutes(uas.server.isLocalURI)
+			} else if c >= sip.Ok {
+				uas.dialog.Confirm()
+			}
+		}
+
+		refreshed := (req.Method == sip.INVITE || req.Method == sip.UPDATE) && c.Class() == sip.Success && uas.isEstablished()
+		if refreshed {
+			resp = uas.sessionTimer.answer(req, resp)
+		}
+
+		reliable := req.Method == sip.INVITE && c > sip.Trying && c < sip.Ok && uas.reliable && uas.provisional == nil
+		if reliable {
+			uas.rseq++
+			resp.Headers.Require = []sip.OptionTag{sip.OPTION_100REL}
+			resp.Headers.RSeq = &sip.IntegerHeader{
+				Value: uas.rseq,
+			}
+		} else if req.Method == sip.INVITE && c >= sip.Ok {
+			uas.provisional = nil
+		}
+
+		if f != nil {
+			resp = f(resp)
+		}
+
+		if err := uas.server.transport.SendSIP(resp); err != nil {
+			return err
+		} else if reliable {
+			uas.provisional = &resp
+			uas.negotiated = uas.negotiated || req.SDP.Origin != nil && resp.SDP.Origin != nil
+			uas.retransmitProvisional(&resp, transaction.T1, 0)
+		} else if refreshed {
+			uas.startSessionTimer()
+		}
+		uas.answered = uas.answered || req.Method == sip.INVITE && c >= sip.Ok
+		return nil
 	}
-	return nil
 }
 
 func (uas *UAS) trying() error {
@@ -112,11 +450,104 @@ func (uas *UAS) ringing() error {
 	return uas.sendResponse(sip.Ringing, nil)
 }
 
+// earlyMedia sends provisional response c with answer to the offer of
+// INVITE so the caller hears media before the call is answered, offer
+// is made only in reliable one (RFC 3261 13.2.1, RFC 3262 5)
+func (uas *UAS) earlyMedia(c sip.ResponseCode) error {
+	invite := uas.history.getInvite()
+	if invite.SDP.Origin == nil && !uas.reliable {
+		return uas.respond(invite, c, nil)
+	} else if f, err := answerSession(uas.mediaChanal, invite); err != nil {
+		log.Info().Err(err).Str("Call-ID", uas.callID).
+			Str("where", "UAS.earlyMedia").
+			Msg("Offer is not acceptable")
+		return uas.respond(invite, c, nil)
+	} else {
+		return uas.respond(invite, c, f)
+	}
+}
+
+// accept answers INVITE with 2xx carrying the session, it waits for PRACK
+// of reliable provisional response with session (RFC 3262 3). Offer and
+// answer completed by then are not repeated in the 2xx (RFC 3262 5).
 func (uas *UAS) accept() error {
-	return uas.sendResponse(sip.Ok, nil)
+	if uas.provisional != nil && uas.provisional.SDP.Origin != nil {
+		uas.afterPrack = uas.accept
+		return nil
+	}
+	invite := uas.history.getInvite()
+	if uas.negotiated {
+		return uas.respond(invite, sip.Ok, nil)
+	} else if f, err := answerSession(uas.mediaChanal, invite); err != nil {
+		log.Info().Err(err).Str("Call-ID", uas.callID).
+			Str("where", "UAS.accept").
+			Msg("Offer is not acceptable")
+		return uas.respond(invite, sip.NotAcceptableHere, nil)
+	} else if err := uas.respond(invite, sip.Ok, f); err != nil {
+		return err
+	} else {
+		uas.negotiated = uas.negotiated || invite.SDP.Origin != nil
+		return nil
+	}
+}
+
+// reject ends INVITE of the caller by failure response c
+func (uas *UAS) reject(c sip.ResponseCode) error {
+	return uas.respond(uas.history.getInvite(), c, nil)
+}
+
+// reinvite changes session of established call, f sets the offer
+func (uas *UAS) reinvite(f func(sip.Request) sip.Request) error {
+	if err := uas.sendRequest(sip.INVITE, f); err != nil {
+		return err
+	}
+	uas.offer = f
+	uas.reinviting = true
+	return nil
+}
+
+// update changes session before or after the call is answered, f sets
+// the offer (RFC 3311 5.1)
+func (uas *UAS) update(f func(sip.Request) sip.Request) error {
+	if err := uas.sendRequest(sip.UPDATE, f); err != nil {
+		return err
+	}
+	uas.offer = f
+	uas.updating = true
+	return nil
+}
+
+// refresh session by UPDATE without offer when the caller allows it,
+// re-INVITE offers the current session, pending offer refreshes anyway
+// (RFC 4028 7.4, 9)
+func (uas *UAS) refresh() error {
+	if uas.reinviting || uas.updating {
+		return nil
+	} else if uas.canUpdate() {
+		return uas.update(nil)
+	}
+	return uas.reinvite(offerSession(uas.mediaChanal, uas.mediaChanal.Mode()))
+}
+
+// startSessionTimer after 2xx of INVITE or UPDATE, missed refresh ends
+// the meeting
+func (uas *UAS) startSessionTimer() {
+	uas.sessionTimer.start(uas.server, uas.refresh, func(ctx context.Context) {
+		uas.meeting.expire(ctx, uas.callID)
+	})
+}
+
+// canUpdate when the caller allows UPDATE within the dialog
+func (uas *UAS) canUpdate() bool {
+	return uas.dialog != nil && uas.history.getInvite().Headers.IsAllowed(sip.UPDATE)
+}
+
+func (uas *UAS) isEstablished() bool {
+	return uas.dialog != nil && uas.dialog.State == sip.DialogConfirmed
 }
 
 func (uas *UAS) bye() error {
+	uas.sessionTimer.stop()
 	return uas.sendRequest(sip.BYE, nil)
 }
 
@@ -126,10 +557,12 @@ func (uas *UAS) cencel() error {
 
 func NewUAS(cid string, s *Server) (*UAS, error) {
 	uas := &UAS{
-		callID:  cid,
-		tag:     uuid.NewString(),
-		server:  s,
-		history: NewHistory(),
+		callID:       cid,
+		tag:          uuid.NewString(),
+		server:       s,
+		rseq:         rand.Intn(1 << 30),
+		sessionTimer: newSessionTimer(),
+		history:      NewHistory(),
 	}
 
 	return uas, nil